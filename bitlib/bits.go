@@ -0,0 +1,95 @@
+package bitlib
+
+import (
+	"errors"
+	"io"
+)
+
+// Writer packs bits most significant bit first into an io.ByteWriter.
+type Writer struct {
+	w     io.ByteWriter
+	acc   uint64
+	count uint
+	err   error
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.ByteWriter) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteBits writes the low count bits of value, where count is at most 32.
+// Errors are held until Flush.
+func (b *Writer) WriteBits(count uint, value uint64) {
+	b.acc = b.acc<<count | value&(1<<count-1)
+	b.count += count
+	for b.count >= 8 && b.err == nil {
+		b.count -= 8
+		b.err = b.w.WriteByte(byte(b.acc >> b.count))
+	}
+}
+
+// WriteBit writes a single bit.
+func (b *Writer) WriteBit(bit bool) {
+	if bit {
+		b.WriteBits(1, 1)
+	} else {
+		b.WriteBits(1, 0)
+	}
+}
+
+// Flush pads the final byte with zero bits, writes it and returns the first
+// error encountered while writing.
+func (b *Writer) Flush() error {
+	if b.count > 0 {
+		b.WriteBits(8-b.count, 0)
+	}
+
+	return b.err
+}
+
+// Reader unpacks bits most significant bit first from an io.ByteReader.
+type Reader struct {
+	r     io.ByteReader
+	acc   uint64
+	count uint
+}
+
+// NewReader returns a Reader that reads from r.
+func NewReader(r io.ByteReader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadBits reads count bits, where count is at most 32. It returns
+// io.ErrUnexpectedEOF if the input ends first.
+func (b *Reader) ReadBits(count uint) (uint64, error) {
+	for b.count < count {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			return 0, err
+		}
+
+		b.acc = b.acc<<8 | uint64(c)
+		b.count += 8
+	}
+
+	b.count -= count
+
+	return b.acc >> b.count & (1<<count - 1), nil
+}
+
+// ReadBit reads a single bit.
+func (b *Reader) ReadBit() (bool, error) {
+	bit, err := b.ReadBits(1)
+
+	return bit == 1, err
+}
+
+// Align discards any bits left in the current byte.
+func (b *Reader) Align() {
+	b.count -= b.count % 8
+}
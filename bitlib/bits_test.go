@@ -0,0 +1,66 @@
+package bitlib
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterBasic(t *testing.T) {
+	var output bytes.Buffer
+	writer := NewWriter(&output)
+	writer.WriteBits(3, 0b101)
+	writer.WriteBit(true)
+	writer.WriteBits(12, 0xabc)
+	writer.WriteBits(2, 0b01)
+	assert.NoError(t, writer.Flush())
+
+	assert.Equal(t, []byte{0b1011_1010, 0b1011_1100, 0b0100_0000}, output.Bytes())
+}
+
+func TestReaderBasic(t *testing.T) {
+	reader := NewReader(bytes.NewReader([]byte{0b1011_1010, 0b1011_1100, 0b0100_0000}))
+
+	value, err := reader.ReadBits(3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0b101), value)
+
+	bit, err := reader.ReadBit()
+	assert.NoError(t, err)
+	assert.True(t, bit)
+
+	value, err = reader.ReadBits(12)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0xabc), value)
+
+	value, err = reader.ReadBits(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0b01), value)
+
+	reader.Align()
+	_, err = reader.ReadBits(1)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestRoundTripWide(t *testing.T) {
+	var output bytes.Buffer
+	writer := NewWriter(&output)
+	for i := uint(1); i <= 32; i++ {
+		writer.WriteBits(i, 1<<i-1)
+		writer.WriteBits(i, 0)
+	}
+	assert.NoError(t, writer.Flush())
+
+	reader := NewReader(bytes.NewReader(output.Bytes()))
+	for i := uint(1); i <= 32; i++ {
+		value, err := reader.ReadBits(i)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1<<i-1), value)
+
+		value, err = reader.ReadBits(i)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), value)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/pipelinelib"
+)
+
+// file compresses, decompresses, tests or lists one file, returning its exit
+// code.
+func (c *config) file(name string) int {
+	input, info, status := openInput(name)
+	if input == nil {
+		return status
+	}
+	defer input.Close()
+
+	switch {
+	case c.list:
+		return c.listFile(name, input, info)
+	case c.test:
+		return report(name, decompress(input, io.Discard))
+	case c.decompress:
+		return c.decompressFile(name, input, info)
+	default:
+		return c.compressFile(name, input, info)
+	}
+}
+
+// openInput opens name for reading, where - is standard input. Only regular
+// files are read, as gzip does.
+func openInput(name string) (*os.File, fs.FileInfo, int) {
+	if name == "-" {
+		return os.Stdin, nil, exitOK
+	}
+
+	input, err := os.Open(name)
+	if err != nil {
+		return nil, nil, report(name, err)
+	}
+
+	info, err := input.Stat()
+	if err != nil {
+		input.Close()
+		return nil, nil, report(name, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		input.Close()
+		fmt.Fprintf(os.Stderr, "bwt: %v: not a regular file -- ignored\n", name)
+		return nil, nil, exitWarning
+	}
+
+	return input, info, exitOK
+}
+
+// report prints err, if any, and returns the matching exit code.
+func report(name string, err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	fmt.Fprintf(os.Stderr, "bwt: %v: %v\n", name, err)
+
+	return exitError
+}
+
+func (c *config) toStdout(name string) bool {
+	return c.stdout || name == "-"
+}
+
+func (c *config) compressFile(name string, input *os.File, info fs.FileInfo) int {
+	if c.toStdout(name) {
+		if isTerminal(os.Stdout) && !c.force {
+			fmt.Fprintln(os.Stderr, "bwt: compressed data not written to a terminal, use -f to force compression")
+			return exitError
+		}
+
+		return report(name, c.compress(input, os.Stdout))
+	}
+
+	if strings.HasSuffix(name, Suffix) {
+		fmt.Fprintf(os.Stderr, "bwt: %v already has %v suffix -- unchanged\n", name, Suffix)
+		return exitWarning
+	}
+
+	return c.writeOutput(name, name+Suffix, info, func(output io.Writer) error {
+		return c.compress(input, output)
+	})
+}
+
+func (c *config) decompressFile(name string, input *os.File, info fs.FileInfo) int {
+	if c.toStdout(name) {
+		return report(name, decompress(input, os.Stdout))
+	}
+
+	if !strings.HasSuffix(name, Suffix) || filepath.Base(name) == Suffix {
+		fmt.Fprintf(os.Stderr, "bwt: %v: unknown suffix -- ignored\n", name)
+		return exitWarning
+	}
+
+	return c.writeOutput(name, strings.TrimSuffix(name, Suffix), info, func(output io.Writer) error {
+		return decompress(input, output)
+	})
+}
+
+// writeOutput creates outputName, fills it with write and gives it the mode
+// and modification time of the input. The output is removed if write fails,
+// and the input is removed if it succeeds unless -k was given.
+func (c *config) writeOutput(inputName, outputName string, info fs.FileInfo, write func(io.Writer) error) int {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if c.force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	output, err := os.OpenFile(outputName, flags, 0o600)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			fmt.Fprintf(os.Stderr, "bwt: %v already exists, use -f to overwrite\n", outputName)
+			return exitWarning
+		}
+
+		return report(outputName, err)
+	}
+
+	buffered := bufio.NewWriter(output)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = output.Chmod(info.Mode().Perm())
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(outputName, info.ModTime(), info.ModTime())
+	}
+
+	if err != nil {
+		os.Remove(outputName)
+		return report(inputName, err)
+	}
+
+	if !c.keep {
+		return report(inputName, os.Remove(inputName))
+	}
+
+	return exitOK
+}
+
+func (c *config) compress(input io.Reader, output io.Writer) error {
+	opts := pipelinelib.DefaultOptions()
+	opts.BlockSize = c.blockSize
+	opts.Concurrency = c.threads
+	opts.Search = c.search
+
+	writer := pipelinelib.NewWriter(output, &opts)
+	if _, err := io.Copy(writer, bufio.NewReader(input)); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+func decompress(input io.Reader, output io.Writer) error {
+	reader, err := pipelinelib.NewReader(bufio.NewReader(input))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, reader)
+
+	return err
+}
+
+// listFile prints the compressed and original sizes of a file, using the
+// block index when there is one and decompressing the file otherwise.
+func (c *config) listFile(name string, input *os.File, info fs.FileInfo) int {
+	if !c.listed {
+		fmt.Printf("%12v %12v %6v %v\n", "compressed", "uncompressed", "ratio", "name")
+		c.listed = true
+	}
+
+	var compressed, original int64
+	var err error
+	if info != nil {
+		compressed = info.Size()
+		original, err = indexedSize(input, compressed)
+	}
+
+	if info == nil || errors.Is(err, formatlib.ErrNoIndex) {
+		counter := &countingReader{r: input}
+		var counted countingWriter
+		err = decompress(counter, &counted)
+		compressed, original = counter.n, counted.n
+	}
+
+	if err != nil {
+		return report(name, err)
+	}
+
+	ratio := 0.0
+	if original > 0 {
+		ratio = 100 * (1 - float64(compressed)/float64(original))
+	}
+
+	fmt.Printf("%12v %12v %5.1f%% %v\n", compressed, original, ratio, strings.TrimSuffix(name, Suffix))
+
+	return exitOK
+}
+
+func indexedSize(input *os.File, size int64) (int64, error) {
+	reader, err := pipelinelib.NewSeekableReader(input, size)
+	if err != nil {
+		return 0, err
+	}
+
+	return reader.Size(), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+
+	return len(p), nil
+}
+
+// isTerminal reports whether f looks like a terminal, which is any character
+// device other than the null device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	null, err := os.Stat(os.DevNull)
+
+	return err != nil || !os.SameFile(info, null)
+}
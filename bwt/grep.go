@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"git.neds.sh/jack.massey/bwt/pipelinelib"
+)
+
+// Exit codes for grep follow grep rather than gzip.
+const (
+	grepMatched = 0
+	grepNoMatch = 1
+	grepError   = 2
+)
+
+// grepChunk is the number of bytes extracted at a time while looking for the
+// ends of a matching line.
+const grepChunk = 256
+
+const grepUsage = `usage: bwt grep [-n] [-c] [-i] pattern [files...]
+
+Print the lines of compressed files that contain pattern, which is matched as
+a fixed string within each line. Files compressed with -s are searched without
+decompressing them, and other files are decompressed as they are read. With
+no files, or when a file is -, read standard input.
+`
+
+// grepConfig holds the parsed grep command line.
+type grepConfig struct {
+	lineNumbers bool
+	count       bool
+	fold        bool
+	pattern     []byte
+	// names is set when there are several files, so each line is prefixed
+	// with its file's name.
+	names bool
+	out   *bufio.Writer
+}
+
+// grep prints the lines of compressed files matching a pattern.
+func grep(args []string) int {
+	flags := flag.NewFlagSet("bwt grep", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), grepUsage)
+		flags.PrintDefaults()
+	}
+
+	var g grepConfig
+	flags.BoolVar(&g.lineNumbers, "n", false, "prefix each line with its line number")
+	flags.BoolVar(&g.count, "c", false, "print only the number of matching lines")
+	flags.BoolVar(&g.fold, "i", false, "ignore the case of ASCII letters")
+
+	if err := flags.Parse(expandFlags(flags, args)); err != nil {
+		return grepError
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return grepError
+	}
+
+	g.pattern = []byte(flags.Arg(0))
+	if bytes.IndexByte(g.pattern, '\n') >= 0 {
+		fmt.Fprintln(os.Stderr, "bwt grep: pattern must not contain a newline")
+		return grepError
+	}
+
+	files := flags.Args()[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	g.names = len(files) > 1
+
+	g.out = bufio.NewWriter(os.Stdout)
+	status := grepNoMatch
+	for _, name := range files {
+		matched, err := g.file(name)
+		if err != nil {
+			report(name, err)
+			status = grepError
+		} else if matched && status == grepNoMatch {
+			status = grepMatched
+		}
+	}
+
+	if err := g.out.Flush(); err != nil {
+		report("standard output", err)
+		return grepError
+	}
+
+	return status
+}
+
+// file prints the matching lines of one file and reports whether there were
+// any.
+func (g *grepConfig) file(name string) (bool, error) {
+	if name == "-" {
+		return g.stream("(standard input)", os.Stdin)
+	}
+
+	input, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// An empty pattern matches every line, so there is nothing to gain from
+	// searching.
+	searcher, err := pipelinelib.NewSearcher(input, info.Size())
+	if errors.Is(err, pipelinelib.ErrNoSearch) || (err == nil && len(g.pattern) == 0) {
+		return g.stream(name, io.NewSectionReader(input, 0, info.Size()))
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return g.search(name, searcher)
+}
+
+// search prints the matching lines of a file with search data, extracting
+// only the lines around each match. With -n newlines are located along with
+// the pattern, which gives the start and number of each line.
+func (g *grepConfig) search(name string, searcher *pipelinelib.Searcher) (bool, error) {
+	patterns := [][]byte{g.pattern}
+	if g.lineNumbers {
+		patterns = append(patterns, []byte("\n"))
+	}
+
+	lines := 0
+	newlines := 0
+	lineStart := int64(0)
+	lineEnd := int64(-1)
+	err := searcher.LocateFunc(patterns, g.fold, func(pattern int, match int64) error {
+		if pattern == 1 {
+			newlines++
+			lineStart = match + 1
+			return nil
+		}
+
+		// Later matches on a line that has been printed are skipped.
+		if match <= lineEnd {
+			return nil
+		}
+
+		if !g.lineNumbers {
+			var err error
+			if lineStart, err = findLineStart(searcher, match); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if lineEnd, err = findLineEnd(searcher, match); err != nil {
+			return err
+		}
+
+		lines++
+		if g.count {
+			return nil
+		}
+
+		line := make([]byte, lineEnd-lineStart)
+		if _, err := searcher.ReadAt(line, lineStart); err != nil {
+			return err
+		}
+		g.printLine(name, newlines+1, line)
+
+		return nil
+	})
+
+	g.printCount(name, lines)
+
+	return lines > 0, err
+}
+
+// findLineStart returns the offset of the start of the line holding offset.
+func findLineStart(r *pipelinelib.Searcher, offset int64) (int64, error) {
+	chunk := make([]byte, grepChunk)
+	for offset > 0 {
+		start := max(0, offset-grepChunk)
+		n, err := r.ReadAt(chunk[:offset-start], start)
+		if err != nil {
+			return 0, err
+		}
+
+		if i := bytes.LastIndexByte(chunk[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		offset = start
+	}
+
+	return 0, nil
+}
+
+// findLineEnd returns the offset of the newline ending the line holding
+// offset, or the size of the data if the last line has no newline.
+func findLineEnd(r *pipelinelib.Searcher, offset int64) (int64, error) {
+	chunk := make([]byte, grepChunk)
+	for offset < r.Size() {
+		n, err := r.ReadAt(chunk, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		if i := bytes.IndexByte(chunk[:n], '\n'); i >= 0 {
+			return offset + int64(i), nil
+		}
+		offset += int64(n)
+	}
+
+	return r.Size(), nil
+}
+
+// stream prints the matching lines of a file without search data by
+// decompressing all of it.
+func (g *grepConfig) stream(name string, input io.Reader) (bool, error) {
+	reader, err := pipelinelib.NewReader(bufio.NewReader(input))
+	if err != nil {
+		return false, err
+	}
+
+	pattern := g.pattern
+	if g.fold {
+		pattern = lowerASCII(pattern)
+	}
+
+	lines := bufio.NewReader(reader)
+	matched := 0
+	for number := 1; ; number++ {
+		line, err := lines.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+
+		if len(line) == 0 {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		text := line
+		if g.fold {
+			text = lowerASCII(line)
+		}
+
+		if bytes.Contains(text, pattern) {
+			matched++
+			if !g.count {
+				g.printLine(name, number, line)
+			}
+		}
+	}
+
+	g.printCount(name, matched)
+
+	return matched > 0, reader.Close()
+}
+
+// lowerASCII returns a copy of text with ASCII letters in lower case, which
+// is the case folding done by fmindexlib.
+func lowerASCII(text []byte) []byte {
+	lower := make([]byte, len(text))
+	for i, c := range text {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+
+	return lower
+}
+
+func (g *grepConfig) printLine(name string, number int, line []byte) {
+	if g.names {
+		fmt.Fprintf(g.out, "%v:", name)
+	}
+
+	if g.lineNumbers {
+		fmt.Fprintf(g.out, "%v:", number)
+	}
+
+	g.out.Write(line)
+	g.out.WriteByte('\n')
+}
+
+func (g *grepConfig) printCount(name string, lines int) {
+	if !g.count {
+		return
+	}
+
+	if g.names {
+		fmt.Fprintf(g.out, "%v:", name)
+	}
+
+	fmt.Fprintf(g.out, "%v\n", lines)
+}
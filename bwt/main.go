@@ -1,26 +1,208 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
-	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/pipelinelib"
 )
 
-// DefaultBlockSize is the default block size to use for each bwt block.
-const DefaultBlockSize = 512 * 1024
+// Exit codes follow gzip: warnings such as skipped files do not hide errors.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitWarning = 2
+)
+
+// Suffix is appended to the names of compressed files.
+const Suffix = ".bwt"
+
+// levelBlockSize is the block size of each compression level, so that the
+// default level gives pipelinelib.DefaultBlockSize.
+const (
+	levelBlockSize = 128 * 1024
+	defaultLevel   = pipelinelib.DefaultBlockSize / levelBlockSize
+)
+
+const usage = `usage: bwt [-d] [-c] [-k] [-f] [-t] [-l] [-s] [-1..-9] [-b size] [-T threads] [files...]
+       bwt grep [-n] [-c] [-i] pattern [files...]
+       bwt transcode < file.bz2 > file.bwt
+       bwt stage bwt|ibwt|mtf|imtf|dc|undc|if|unif|rle|unrle [flags] < input > output
+
+Compress or decompress files with the BWT pipeline. With no files, or when a
+file is -, read standard input and write standard output.
+`
+
+// config holds the parsed command line.
+type config struct {
+	decompress bool
+	stdout     bool
+	keep       bool
+	force      bool
+	test       bool
+	list       bool
+	search     bool
+	blockSize  int
+	threads    int
+	// listed is set once -l has printed its heading.
+	listed bool
+}
 
 func main() {
-	writer := bufio.NewWriter(os.Stdout)
-	err := bwtlib.BWTStream(bufio.NewReader(os.Stdin), writer, DefaultBlockSize)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error! %v\n", err.Error())
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "grep":
+			os.Exit(grep(os.Args[2:]))
+		case "transcode":
+			os.Exit(transcode())
+		case "stage":
+			os.Exit(stage(os.Args[2:]))
+		}
+	}
+
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("bwt", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	var c config
+	flags.BoolVar(&c.decompress, "d", false, "decompress")
+	flags.BoolVar(&c.stdout, "c", false, "write to standard output and keep input files")
+	flags.BoolVar(&c.keep, "k", false, "keep input files")
+	flags.BoolVar(&c.force, "f", false, "overwrite output files and compress to a terminal")
+	flags.BoolVar(&c.test, "t", false, "test the integrity of compressed files")
+	flags.BoolVar(&c.list, "l", false, "list the sizes of compressed files")
+	flags.BoolVar(&c.search, "s", false, "store search data so that bwt grep need not decompress")
+	blockSize := flags.String("b", "", "block size in bytes, with an optional k or m suffix")
+	flags.IntVar(&c.threads, "T", 0, "number of blocks to compress at once, 0 for GOMAXPROCS")
+
+	// As in gzip, the last level given wins, and -b overrides them all.
+	c.blockSize = defaultLevel * levelBlockSize
+	for level := 1; level <= 9; level++ {
+		size := level * levelBlockSize
+		flags.BoolFunc(strconv.Itoa(level), fmt.Sprintf("use %v KiB blocks", size/1024), func(string) error {
+			c.blockSize = size
+			return nil
+		})
+	}
+
+	if err := flags.Parse(expandFlags(flags, args)); err != nil {
+		return exitError
+	}
+
+	if *blockSize != "" {
+		size, err := parseSize(*blockSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bwt: invalid block size %q: %v\n", *blockSize, err)
+			return exitError
+		}
+		c.blockSize = size
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := exitOK
+	for _, name := range files {
+		status = worse(status, c.file(name))
+	}
+
+	return status
+}
+
+// worse returns the more severe of two exit codes.
+func worse(a, b int) int {
+	if a == exitError || b == exitError {
+		return exitError
 	}
-	err = writer.Flush()
+
+	return max(a, b)
+}
+
+// expandFlags splits grouped flags such as -dc into -d -c, as gzip does. A
+// flag that takes a value may end a group, with the rest of the argument as
+// its value, so -kT4 becomes -k -T 4. Arguments from the first that is not a
+// flag or a flag's value are left alone, as flag.Parse stops there.
+func expandFlags(flags *flag.FlagSet, args []string) []string {
+	expanded := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			return append(expanded, args[i:]...)
+		}
+
+		split, needsValue := splitFlags(flags, arg)
+		expanded = append(expanded, split...)
+		if needsValue && i+1 < len(args) {
+			i++
+			expanded = append(expanded, args[i])
+		}
+	}
+
+	return expanded
+}
+
+// splitFlags splits a group of single letter flags, returning arg unchanged
+// if it is not one. It also reports whether the group ends with a flag whose
+// value is the next argument.
+func splitFlags(flags *flag.FlagSet, arg string) ([]string, bool) {
+	if strings.Contains(arg, "=") {
+		return []string{arg}, false
+	}
+
+	var split []string
+	for i, name := range arg[1:] {
+		f := flags.Lookup(string(name))
+		if f == nil {
+			return []string{arg}, false
+		}
+		split = append(split, "-"+string(name))
+
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+
+		if value := arg[2+i:]; value != "" {
+			return append(split, value), false
+		}
+
+		return split, true
+	}
+
+	return split, false
+}
+
+// parseSize parses a size in bytes with an optional k or m suffix.
+func parseSize(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		multiplier = 1024
+		s = s[:len(s)-1]
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		multiplier = 1024 * 1024
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.Atoi(s)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error! %v\n", err.Error())
-		os.Exit(1)
+		return 0, err
 	}
+
+	if size < 1 || size > 1<<30/multiplier {
+		return 0, errors.New("out of range")
+	}
+
+	return size * multiplier, nil
 }
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.neds.sh/jack.massey/bwt/pipelinelib"
+)
+
+// runCommand runs command with args, stdin as standard input and standard
+// output and error captured, returning its exit code, standard output and
+// standard error.
+func runCommand(t *testing.T, command func([]string) int, stdin []byte, args ...string) (int, []byte, string) {
+	t.Helper()
+	dir := t.TempDir()
+	stdinName := filepath.Join(dir, "stdin")
+	if err := os.WriteFile(stdinName, stdin, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make([]*os.File, 3)
+	for i, name := range []string{stdinName, filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")} {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	stdinFile, stdoutFile, stderrFile := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	status := command(args)
+	os.Stdin, os.Stdout, os.Stderr = stdinFile, stdoutFile, stderrFile
+
+	stdout, err := os.ReadFile(files[1].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stderr, err := os.ReadFile(files[2].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, stdout, string(stderr)
+}
+
+// writeFile writes data to name in dir, returning its path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// compressed returns data compressed with the default options.
+func compressed(t *testing.T, data []byte, opts *pipelinelib.Options) []byte {
+	t.Helper()
+	var output bytes.Buffer
+	writer := pipelinelib.NewWriter(&output, opts)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return output.Bytes()
+}
+
+var testText = []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100))
+
+func TestExpandFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Bool("d", false, "")
+	flags.Bool("c", false, "")
+	flags.Bool("k", false, "")
+	flags.Int("T", 0, "")
+	flags.String("b", "", "")
+
+	cases := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-dc"}, []string{"-d", "-c"}},
+		{[]string{"-d", "-c", "file"}, []string{"-d", "-c", "file"}},
+		{[]string{"-T4"}, []string{"-T", "4"}},
+		{[]string{"-kT4", "file"}, []string{"-k", "-T", "4", "file"}},
+		{[]string{"-kT", "4", "-d"}, []string{"-k", "-T", "4", "-d"}},
+		{[]string{"-b64k"}, []string{"-b", "64k"}},
+		{[]string{"-b=64k", "-dc"}, []string{"-b=64k", "-d", "-c"}},
+		{[]string{"-b", "-dc"}, []string{"-b", "-dc"}},
+		{[]string{"-dx"}, []string{"-dx"}},
+		{[]string{"--d"}, []string{"--d"}},
+		{[]string{"-d", "--", "-dc"}, []string{"-d", "--", "-dc"}},
+		{[]string{"-", "-dc"}, []string{"-", "-dc"}},
+		{[]string{"file", "-dc"}, []string{"file", "-dc"}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, expandFlags(flags, c.args), c.args)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected int
+	}{
+		{"100", 100},
+		{"64k", 64 * 1024},
+		{"2M", 2 * 1024 * 1024},
+		{"1024m", 1 << 30},
+	}
+
+	for _, c := range cases {
+		size, err := parseSize(c.s)
+		assert.NoError(t, err, c.s)
+		assert.Equal(t, c.expected, size, c.s)
+	}
+
+	for _, s := range []string{"", "k", "0", "-1", "1025m", "1g", "ten"} {
+		_, err := parseSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRunLevels(t *testing.T) {
+	cases := []struct {
+		args      []string
+		blockSize int
+	}{
+		{nil, pipelinelib.DefaultBlockSize},
+		{[]string{"-1"}, levelBlockSize},
+		{[]string{"-9", "-1"}, levelBlockSize},
+		{[]string{"-1", "-9"}, 9 * levelBlockSize},
+		{[]string{"-91"}, levelBlockSize},
+		{[]string{"-c3", "-k5"}, 5 * levelBlockSize},
+		{[]string{"-9", "-b", "64k", "-1"}, 64 * 1024},
+		{[]string{"-b100", "-2"}, 100},
+		{[]string{"-T4"}, pipelinelib.DefaultBlockSize},
+		{[]string{"-kT4"}, pipelinelib.DefaultBlockSize},
+		{[]string{"-T", "2", "-3"}, 3 * levelBlockSize},
+	}
+
+	for _, c := range cases {
+		status, stdout, stderr := runCommand(t, run, testText, append(c.args, "-c")...)
+		assert.Equal(t, exitOK, status, c.args, stderr)
+
+		reader, err := pipelinelib.NewReader(bytes.NewReader(stdout))
+		if !assert.NoError(t, err, c.args) {
+			continue
+		}
+		assert.Equal(t, c.blockSize, reader.Header.BlockSize, c.args)
+	}
+}
+
+func TestRunFlagErrors(t *testing.T) {
+	for _, args := range [][]string{{"-x"}, {"-T"}, {"-Tx"}, {"-b", "0"}, {"-b", "big"}} {
+		status, stdout, _ := runCommand(t, run, testText, append(args, "-c")...)
+		assert.Equal(t, exitError, status, args)
+		assert.Len(t, stdout, 0, args)
+	}
+}
+
+func TestRunCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "text", testText)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	status, stdout, stderr := runCommand(t, run, nil, path)
+	assert.Equal(t, exitOK, status, stderr)
+	assert.Len(t, stdout, 0)
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	info, err := os.Stat(path + Suffix)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	assert.True(t, info.ModTime().Equal(modTime))
+
+	status, _, stderr = runCommand(t, run, nil, "-d", path+Suffix)
+	assert.Equal(t, exitOK, status, stderr)
+
+	decompressed, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, testText, decompressed)
+
+	info, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	assert.True(t, info.ModTime().Equal(modTime))
+
+	_, err = os.Stat(path + Suffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunKeepAndStdout(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "text", testText)
+
+	status, _, stderr := runCommand(t, run, nil, "-k", path)
+	assert.Equal(t, exitOK, status, stderr)
+	_, err := os.Stat(path)
+	assert.NoError(t, err)
+	_, err = os.Stat(path + Suffix)
+	assert.NoError(t, err)
+
+	// -c writes to standard output and keeps the input without -k.
+	assert.NoError(t, os.Remove(path+Suffix))
+	status, stdout, stderr := runCommand(t, run, nil, "-c", path)
+	assert.Equal(t, exitOK, status, stderr)
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+	_, err = os.Stat(path + Suffix)
+	assert.True(t, os.IsNotExist(err))
+
+	status, decompressed, stderr := runCommand(t, run, stdout, "-d")
+	assert.Equal(t, exitOK, status, stderr)
+	assert.Equal(t, testText, decompressed)
+
+	status, decompressed, stderr = runCommand(t, run, stdout, "-dc", "-")
+	assert.Equal(t, exitOK, status, stderr)
+	assert.Equal(t, testText, decompressed)
+}
+
+func TestRunExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "text", testText)
+	writeFile(t, dir, "text"+Suffix, []byte("existing"))
+
+	status, _, stderr := runCommand(t, run, nil, path)
+	assert.Equal(t, exitWarning, status)
+	assert.Contains(t, stderr, "already exists")
+
+	existing, err := os.ReadFile(path + Suffix)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("existing"), existing)
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	status, _, stderr = runCommand(t, run, nil, "-f", path)
+	assert.Equal(t, exitOK, status, stderr)
+
+	status, decompressed, stderr := runCommand(t, run, nil, "-dc", path+Suffix)
+	assert.Equal(t, exitOK, status, stderr)
+	assert.Equal(t, testText, decompressed)
+}
+
+func TestRunExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	text := writeFile(t, dir, "text", testText)
+	named := writeFile(t, dir, "named"+Suffix, testText)
+	bare := writeFile(t, dir, Suffix, compressed(t, testText, nil))
+	missing := filepath.Join(dir, "missing")
+
+	cases := []struct {
+		args   []string
+		status int
+		stderr string
+	}{
+		{[]string{"-k", named}, exitWarning, "already has .bwt suffix"},
+		{[]string{"-d", text}, exitWarning, "unknown suffix"},
+		{[]string{"-d", bare}, exitWarning, "unknown suffix"},
+		{[]string{"-k", dir}, exitWarning, "not a regular file"},
+		{[]string{"-k", missing}, exitError, "missing"},
+		{[]string{"-dk", named}, exitError, "named" + Suffix},
+		// An error is worse than a warning, whichever comes first.
+		{[]string{"-k", missing, named}, exitError, "missing"},
+		{[]string{"-k", named, missing}, exitError, "missing"},
+	}
+
+	for _, c := range cases {
+		status, _, stderr := runCommand(t, run, nil, c.args...)
+		assert.Equal(t, c.status, status, c.args)
+		assert.Contains(t, stderr, c.stderr, c.args)
+	}
+}
+
+func TestRunTerminal(t *testing.T) {
+	// Any character device other than the null device counts as a terminal.
+	terminal, err := os.OpenFile("/dev/zero", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no character device to write to:", err)
+	}
+	defer terminal.Close()
+
+	dir := t.TempDir()
+	path := writeFile(t, dir, "text", testText)
+	compressedPath := writeFile(t, dir, "text"+Suffix, compressed(t, testText, nil))
+	runToTerminal := func(args []string) int {
+		os.Stdout = terminal
+		return run(args)
+	}
+
+	for _, c := range []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"-c", path}, exitError},
+		{[]string{"-cf", path}, exitOK},
+		// Decompressed data may be written to a terminal.
+		{[]string{"-dc", compressedPath}, exitOK},
+	} {
+		status, _, stderr := runCommand(t, runToTerminal, nil, c.args...)
+		assert.Equal(t, c.status, status, c.args)
+		if c.status == exitError {
+			assert.Contains(t, stderr, "not written to a terminal")
+		}
+	}
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestRunTest(t *testing.T) {
+	dir := t.TempDir()
+	valid := compressed(t, testText, nil)
+	validPath := writeFile(t, dir, "valid"+Suffix, valid)
+
+	corrupt := append([]byte{}, valid...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	corruptPath := writeFile(t, dir, "corrupt"+Suffix, corrupt)
+
+	status, stdout, stderr := runCommand(t, run, nil, "-t", validPath)
+	assert.Equal(t, exitOK, status, stderr)
+	assert.Len(t, stdout, 0)
+
+	status, _, stderr = runCommand(t, run, nil, "-t", corruptPath)
+	assert.Equal(t, exitError, status)
+	assert.Contains(t, stderr, corruptPath)
+
+	status, _, _ = runCommand(t, run, valid, "-t")
+	assert.Equal(t, exitOK, status)
+
+	status, _, _ = runCommand(t, run, testText, "-t")
+	assert.Equal(t, exitError, status)
+
+	// -t leaves the files alone.
+	for _, path := range []string{validPath, corruptPath} {
+		_, err := os.Stat(path)
+		assert.NoError(t, err)
+	}
+}
+
+func TestRunList(t *testing.T) {
+	dir := t.TempDir()
+	indexed := compressed(t, testText, nil)
+	indexedPath := writeFile(t, dir, "indexed"+Suffix, indexed)
+
+	opts := pipelinelib.DefaultOptions()
+	opts.Index = false
+	unindexed := compressed(t, testText, &opts)
+	unindexedPath := writeFile(t, dir, "unindexed"+Suffix, unindexed)
+
+	status, stdout, stderr := runCommand(t, run, nil, "-l", indexedPath, unindexedPath)
+	assert.Equal(t, exitOK, status, stderr)
+
+	lines := strings.Split(strings.TrimSuffix(string(stdout), "\n"), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, []string{"compressed", "uncompressed", "ratio", "name"}, strings.Fields(lines[0]))
+
+		indexedFields := strings.Fields(lines[1])
+		assert.Equal(t, []string{strconv.Itoa(len(indexed)), strconv.Itoa(len(testText))}, indexedFields[:2])
+		assert.Equal(t, strings.TrimSuffix(indexedPath, Suffix), indexedFields[3])
+
+		unindexedFields := strings.Fields(lines[2])
+		assert.Equal(t, []string{strconv.Itoa(len(unindexed)), strconv.Itoa(len(testText))}, unindexedFields[:2])
+	}
+
+	// Standard input is listed by decompressing it.
+	status, stdout, stderr = runCommand(t, run, indexed, "-l")
+	assert.Equal(t, exitOK, status, stderr)
+	lines = strings.Split(strings.TrimSuffix(string(stdout), "\n"), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, []string{strconv.Itoa(len(indexed)), strconv.Itoa(len(testText))}, strings.Fields(lines[1])[:2])
+	}
+
+	status, _, _ = runCommand(t, run, testText, "-l")
+	assert.Equal(t, exitError, status)
+}
+
+// grepText has lines of many lengths, some longer than the blocks it is
+// compressed in, with matches at their starts, middles and ends.
+func grepText() []byte {
+	var text bytes.Buffer
+	for i := 0; i < 200; i++ {
+		text.WriteString(strings.Repeat("abc ", i%23))
+		switch i % 7 {
+		case 0:
+			text.WriteString("Needle")
+		case 3:
+			text.WriteString("a needle and another needle")
+		case 5:
+			text.WriteString(strings.Repeat("x", 150) + "NEEDLE")
+		}
+		text.WriteString(strings.Repeat(" def", i%5))
+		text.WriteByte('\n')
+	}
+	text.WriteString("needle without a newline")
+
+	return text.Bytes()
+}
+
+// expectedGrep returns the output of bwt grep on text as a plain line scan
+// finds it.
+func expectedGrep(text []byte, pattern string, prefix string, numbers, count, fold bool) string {
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+
+	var output strings.Builder
+	matched := 0
+	for i, line := range strings.Split(string(text), "\n") {
+		searched := line
+		if fold {
+			searched = strings.ToLower(line)
+		}
+
+		if !strings.Contains(searched, pattern) {
+			continue
+		}
+
+		matched++
+		if count {
+			continue
+		}
+
+		output.WriteString(prefix)
+		if numbers {
+			output.WriteString(strconv.Itoa(i+1) + ":")
+		}
+		output.WriteString(line + "\n")
+	}
+
+	if count {
+		output.WriteString(prefix + strconv.Itoa(matched) + "\n")
+	}
+
+	return output.String()
+}
+
+func TestGrep(t *testing.T) {
+	text := grepText()
+	dir := t.TempDir()
+
+	opts := pipelinelib.DefaultOptions()
+	opts.BlockSize = 64
+	opts.Search = true
+	searchable := writeFile(t, dir, "searchable"+Suffix, compressed(t, text, &opts))
+
+	opts.Search = false
+	plain := writeFile(t, dir, "plain"+Suffix, compressed(t, text, &opts))
+
+	// The searchable file must be searched rather than decompressed for the
+	// comparison to cover search.
+	input, err := os.Open(searchable)
+	assert.NoError(t, err)
+	defer input.Close()
+	info, err := input.Stat()
+	assert.NoError(t, err)
+	_, err = pipelinelib.NewSearcher(input, info.Size())
+	assert.NoError(t, err)
+
+	for _, pattern := range []string{"needle", "Needle", "le\x20a", "abc abc", "x" + strings.Repeat("x", 70), "def", "haystack"} {
+		for _, flags := range []string{"", "-n", "-c", "-i", "-ni", "-ci", "-nci"} {
+			numbers := strings.Contains(flags, "n")
+			count := strings.Contains(flags, "c")
+			fold := strings.Contains(flags, "i")
+
+			for _, path := range []string{searchable, plain} {
+				args := []string{pattern, path}
+				if flags != "" {
+					args = append([]string{flags}, args...)
+				}
+
+				expected := expectedGrep(text, pattern, "", numbers, count, fold)
+				status, stdout, stderr := runCommand(t, grep, nil, args...)
+				assert.Equal(t, expected, string(stdout), args)
+				assert.Equal(t, "", stderr, args)
+				if expectedGrep(text, pattern, "", false, true, fold) == "0\n" {
+					assert.Equal(t, grepNoMatch, status, args)
+				} else {
+					assert.Equal(t, grepMatched, status, args)
+				}
+			}
+
+			// Several files prefix each line with its file's name.
+			args := []string{pattern, searchable, plain}
+			if flags != "" {
+				args = append([]string{flags}, args...)
+			}
+
+			expected := expectedGrep(text, pattern, searchable+":", numbers, count, fold) +
+				expectedGrep(text, pattern, plain+":", numbers, count, fold)
+			_, stdout, _ := runCommand(t, grep, nil, args...)
+			assert.Equal(t, expected, string(stdout), args)
+		}
+	}
+}
+
+func TestGrepStandardInput(t *testing.T) {
+	text := grepText()
+	status, stdout, stderr := runCommand(t, grep, compressed(t, text, nil), "-n", "needle")
+	assert.Equal(t, grepMatched, status, stderr)
+	assert.Equal(t, expectedGrep(text, "needle", "", true, false, false), string(stdout))
+
+	path := writeFile(t, t.TempDir(), "text"+Suffix, compressed(t, text, nil))
+	status, stdout, stderr = runCommand(t, grep, compressed(t, text, nil), "-c", "needle", "-", path)
+	assert.Equal(t, grepMatched, status, stderr)
+	expected := expectedGrep(text, "needle", "(standard input):", false, true, false) +
+		expectedGrep(text, "needle", path+":", false, true, false)
+	assert.Equal(t, expected, string(stdout))
+}
+
+func TestGrepExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	text := writeFile(t, dir, "text"+Suffix, compressed(t, []byte("hay\nneedle\n"), nil))
+	other := writeFile(t, dir, "other"+Suffix, compressed(t, []byte("hay\n"), nil))
+	plain := writeFile(t, dir, "plain", []byte("needle\n"))
+	missing := filepath.Join(dir, "missing")
+
+	cases := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"needle", text}, grepMatched},
+		{[]string{"needle", other}, grepNoMatch},
+		{[]string{"needle", other, text}, grepMatched},
+		{[]string{"-c", "needle", other}, grepNoMatch},
+		// Errors take precedence over matches, as in grep.
+		{[]string{"needle", text, missing}, grepError},
+		{[]string{"needle", plain}, grepError},
+		{[]string{"need\nle", text}, grepError},
+		{[]string{"-x", "needle", text}, grepError},
+		{[]string{"-n"}, grepError},
+	}
+
+	for _, c := range cases {
+		status, _, _ := runCommand(t, grep, nil, c.args...)
+		assert.Equal(t, c.status, status, c.args)
+	}
+}
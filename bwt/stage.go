@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/bzip2lib"
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/distancelib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+	"git.neds.sh/jack.massey/bwt/pipelinelib"
+)
+
+// MinRun and RunLengthBytes are the run length encoding parameters used by
+// the rle stage's fixed and varint modes, which are recorded in the container
+// header for unrle.
+const (
+	MinRun         = 4
+	RunLengthBytes = 1
+)
+
+// stage runs a single stage of the pipeline from standard input to standard
+// output, so that the stages can be chained and inspected one at a time.
+func stage(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitError
+	}
+
+	flags := flag.NewFlagSet("bwt stage "+args[0], flag.ContinueOnError)
+	var run func(io.Reader, io.Writer) error
+	switch args[0] {
+	case "bwt":
+		indexed := flags.Bool("indexed", false, "store a primary index instead of sentinels, allowing any input bytes")
+		bijective := flags.Bool("bijective", false, "use the bijective BWTS, which needs neither sentinels nor a primary index")
+		rle1 := flags.Bool("rle1", false, "run length encode runs of 4 or more bytes before the BWT, implies -indexed unless -bijective")
+		concurrency := flags.Int("concurrency", 0, "number of blocks to transform at once, 0 for GOMAXPROCS")
+		blockSize := flags.Int("b", pipelinelib.DefaultBlockSize, "block size in bytes")
+		run = func(input io.Reader, output io.Writer) error {
+			opts := bwtlib.StreamOptions{BlockSize: *blockSize, Concurrency: *concurrency, Checksum: true, RLE1: *rle1}
+			switch {
+			case *bijective:
+				opts.Transform = bwtlib.TransformBijective
+			case *indexed, *rle1:
+				opts.Transform = bwtlib.TransformIndexed
+			}
+
+			return bwtlib.BWTStreamWithOptions(input, output, opts)
+		}
+	case "ibwt":
+		raw := flags.Bool("raw", false, "decode a headerless stream written by older versions of bwt")
+		concurrency := flags.Int("concurrency", 0, "number of blocks to decode at once, 0 for GOMAXPROCS")
+		readAhead := flags.Int("read-ahead", 0, "number of blocks to read ahead of the output, at least the concurrency")
+		run = func(input io.Reader, output io.Writer) error {
+			if *raw {
+				return bwtlib.IBWTStream(input, output)
+			}
+
+			opts := bwtlib.StreamOptions{Concurrency: *concurrency, ReadAhead: *readAhead}
+
+			return bwtlib.IBWTStreamWithOptions(input, output, opts)
+		}
+	case "mtf":
+		variant := flags.String("variant", mtflib.VariantMTF.String(), "move to front variant: mtf, mtf1, mtf2, ts0 or wfc")
+		compare := flags.Bool("compare", false, "print the zero-order entropy after each variant, dc and if instead of transforming")
+		run = func(input io.Reader, output io.Writer) error {
+			if *compare {
+				return compareMTF(input, output)
+			}
+
+			v, err := mtflib.ParseVariant(*variant)
+			if err != nil {
+				return err
+			}
+
+			configure := func(header *formatlib.Header) {
+				header.MTFVariant = byte(v)
+			}
+
+			return formatlib.Push(input, output, formatlib.StageMTF, configure, mtfBlock)
+		}
+	case "imtf":
+		run = func(input io.Reader, output io.Writer) error {
+			return formatlib.Pop(input, output, formatlib.StageMTF, imtfBlock)
+		}
+	case "dc":
+		run = distancelib.DistanceStream
+	case "undc":
+		run = distancelib.IDistanceStream
+	case "if":
+		run = distancelib.InversionStream
+	case "unif":
+		run = distancelib.IInversionStream
+	case "rle":
+		mode := flags.String("mode", compresslib.ModeAuto.String(), "run length coding: fixed, zero, varint or auto to choose for each block")
+		run = func(input io.Reader, output io.Writer) error {
+			m, err := compresslib.ParseMode(*mode)
+			if err != nil {
+				return err
+			}
+
+			configure := func(header *formatlib.Header) {
+				configureRLE(header)
+				header.RLEMode = byte(m)
+			}
+
+			return formatlib.Push(input, output, formatlib.StageRLE, configure, rleBlock)
+		}
+	case "unrle":
+		run = func(input io.Reader, output io.Writer) error {
+			return formatlib.Pop(input, output, formatlib.StageRLE, unrleBlock)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "bwt: unknown stage %q\n", args[0])
+		return exitError
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitError
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	err := run(bufio.NewReader(os.Stdin), writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	return report("stage "+args[0], err)
+}
+
+func mtfBlock(header formatlib.Header, block []byte) ([]byte, error) {
+	return mtflib.EncodeBlockWithVariant(nil, block, mtflib.Variant(header.MTFVariant))
+}
+
+func imtfBlock(header formatlib.Header, block []byte) ([]byte, error) {
+	return mtflib.DecodeBlockWithVariant(nil, block, mtflib.Variant(header.MTFVariant))
+}
+
+// compareMTF reads a container and prints the zero-order entropy of its
+// blocks before the move to front, after each variant and after distance
+// coding and inversion frequencies, along with the size an ideal order-0
+// coder would give them.
+func compareMTF(input io.Reader, output io.Writer) error {
+	reader, err := formatlib.NewBlockReader(input)
+	if err != nil {
+		return err
+	}
+
+	names := []string{"none"}
+	transforms := []func([]byte) ([]byte, error){
+		func(block []byte) ([]byte, error) { return block, nil },
+	}
+	for _, variant := range mtflib.Variants {
+		header := formatlib.Header{MTFVariant: byte(variant)}
+		names = append(names, variant.String())
+		transforms = append(transforms, func(block []byte) ([]byte, error) {
+			return mtfBlock(header, block)
+		})
+	}
+	names = append(names, formatlib.StageDistance.String(), formatlib.StageInversion.String())
+	transforms = append(transforms,
+		func(block []byte) ([]byte, error) { return distancelib.DistanceCode(block), nil },
+		func(block []byte) ([]byte, error) { return distancelib.InversionFrequencies(block), nil },
+	)
+
+	bits := make([]float64, len(transforms))
+	size := 0
+	var buffer []byte
+	for {
+		block, err := reader.Next(buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return err
+		}
+		buffer = block.Data
+
+		size += len(block.Data)
+		for i, transform := range transforms {
+			transformed, err := transform(block.Data)
+			if err != nil {
+				return err
+			}
+
+			bits[i] += mtflib.Entropy(transformed) * float64(len(transformed))
+		}
+	}
+
+	fmt.Fprintf(output, "%-8v %9v %12v\n", "variant", "bits/byte", "bytes")
+	for i, b := range bits {
+		perByte := 0.0
+		if size > 0 {
+			perByte = b / float64(size)
+		}
+
+		fmt.Fprintf(output, "%-8v %9.4f %12.0f\n", names[i], perByte, b/8)
+	}
+
+	return nil
+}
+
+func configureRLE(header *formatlib.Header) {
+	header.MinRun = MinRun
+	header.RunLengthBytes = RunLengthBytes
+}
+
+func rleBlock(header formatlib.Header, block []byte) ([]byte, error) {
+	return compresslib.EncodeBlockWithMode(nil, block, compresslib.Mode(header.RLEMode), header.MinRun, header.RunLengthBytes)
+}
+
+func unrleBlock(header formatlib.Header, block []byte) ([]byte, error) {
+	return compresslib.DecodeBlockWithMode(nil, block, compresslib.Mode(header.RLEMode), header.MinRun, header.RunLengthBytes, header.MaxStageSize())
+}
+
+// transcode converts a .bz2 stream on standard input into a pipelinelib
+// container on standard output, one block at a time.
+func transcode() int {
+	reader, err := bzip2lib.NewReader(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return report("transcode", err)
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	compressor := pipelinelib.NewWriter(writer, nil)
+	_, err = io.Copy(compressor, reader)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	return report("transcode", err)
+}
@@ -3,9 +3,12 @@ package bwtlib
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
-	"golang.org/x/exp/slices"
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/parallellib"
 )
 
 // BWT will compress a byte array and output the full bytearray.
@@ -16,40 +19,106 @@ func BWT(input []byte) ([]byte, error) {
 		}
 	}
 
-	input = append([]byte{0x02}, input...)
-	input = append(input, 0x03)
+	text := make([]int32, 0, len(input)+2)
+	text = append(text, 0x02)
+	for _, c := range input {
+		text = append(text, int32(c))
+	}
+	text = append(text, 0x03)
 
-	table := make([]int, 0, len(input)+2)
-	for i := range input {
-		table = append(table, i)
+	// The 0x03 sentinel only appears once, so no rotation is a prefix of
+	// another and the rotations sort in the same order as the suffixes.
+	table := suffixArray(text, 256)
+
+	output := make([]byte, 0, len(text))
+	for _, index := range table {
+		wrappedIndex := int(index) - 1
+		if wrappedIndex < 0 {
+			wrappedIndex = len(text) + wrappedIndex
+		}
+		output = append(output, byte(text[wrappedIndex]))
 	}
 
-	slices.SortFunc(
-		table,
-		func(a, b int) int {
-			for i := range input {
-				if input[(a+i)%len(input)] > input[(b+i)%len(input)] {
-					return 1
-				}
-				if input[(a+i)%len(input)] < input[(b+i)%len(input)] {
-					return -1
-				}
-			}
+	return output, nil
+}
 
-			return 0
-		},
-	)
+// BWTIndexed will transform a byte array without adding sentinels. It returns
+// the last column of the sorted rotations along with the primary index, which
+// is the row holding the original string.
+func BWTIndexed(input []byte) ([]byte, int) {
+	n := len(input)
+
+	// Sorting the suffixes of the doubled input that start in the first copy
+	// sorts the rotations, as each such suffix starts with a full rotation.
+	text := make([]int32, 2*n)
+	for i, c := range input {
+		text[i] = int32(c)
+		text[i+n] = int32(c)
+	}
 
-	output := make([]byte, 0, len(input)+2)
+	table := suffixArray(text, 256)
+
+	output := make([]byte, 0, n)
+	primary := 0
 	for _, index := range table {
-		wrappedIndex := index - 1
+		if int(index) >= n {
+			continue
+		}
+
+		if index == 0 {
+			primary = len(output)
+		}
+
+		wrappedIndex := int(index) - 1
 		if wrappedIndex < 0 {
-			wrappedIndex = len(input) + wrappedIndex
+			wrappedIndex = n + wrappedIndex
 		}
 		output = append(output, input[wrappedIndex])
 	}
 
-	return output, nil
+	return output, primary
+}
+
+// Transform selects how a stream of BWT blocks records the row of the original
+// string in each block.
+type Transform byte
+
+const (
+	// TransformSentinel wraps each block in 0x02 and 0x03 sentinels, so blocks
+	// cannot contain those bytes.
+	TransformSentinel Transform = iota
+	// TransformIndexed stores the primary index at the start of each block,
+	// as bzip2 does, so blocks can contain any byte.
+	TransformIndexed
+	// TransformBijective uses BWTS, which needs neither sentinels nor a
+	// primary index, so blocks can contain any byte and are not enlarged.
+	TransformBijective
+)
+
+// StreamOptions configures BWTStreamWithOptions and IBWTStreamWithOptions.
+type StreamOptions struct {
+	// BlockSize is the maximum number of input bytes in each block.
+	BlockSize int
+	// Transform selects the block transform. It is recorded in the container
+	// header, so it is only used when encoding.
+	Transform Transform
+	// Concurrency is the number of blocks transformed at once, which also
+	// bounds the number of blocks held in memory. Values below 1 use
+	// runtime.GOMAXPROCS. The output does not depend on the concurrency.
+	Concurrency int
+	// ReadAhead is the number of blocks the decoder may read ahead of the
+	// one being written. Values below Concurrency use Concurrency.
+	ReadAhead int
+	// Checksum stores a CRC32 of each block and of the whole stream so that
+	// the decoder can detect corruption. It is recorded in the container
+	// header, so it is only used when encoding.
+	Checksum bool
+	// RLE1 applies compresslib.EncodeRLE1 to each block before the BWT, as
+	// bzip2 does, which shortens long runs before they are sorted. Its run
+	// lengths can be any byte, so it cannot be used with TransformSentinel.
+	// It is recorded in the container header, so it is only used when
+	// encoding.
+	RLE1 bool
 }
 
 func encodeBlockSize(blockSize int) []byte {
@@ -59,54 +128,132 @@ func encodeBlockSize(blockSize int) []byte {
 	return blockSizeEncoded
 }
 
-// BWTStream performs a BWT operation on a byte stream.
+// EncodeBlock applies the transform to block and returns the encoded block,
+// without its block size.
+func EncodeBlock(block []byte, transform Transform) ([]byte, error) {
+	switch transform {
+	case TransformSentinel:
+		return BWT(block)
+	case TransformIndexed:
+		bwtBlock, primary := BWTIndexed(block)
+		return append(encodeBlockSize(primary), bwtBlock...), nil
+	case TransformBijective:
+		return BWTS(block), nil
+	default:
+		return nil, fmt.Errorf("unknown transform %v", transform)
+	}
+}
+
+// BWTStream performs a BWT operation on a byte stream. Each block is written
+// as its 4 byte little-endian size followed by the sentinel BWT of the block.
+// Blocks are transformed on runtime.GOMAXPROCS goroutines.
 func BWTStream(input io.Reader, output io.Writer, blockSize int) error {
-	block := make([]byte, blockSize)
-	for {
-		readN, readErr := io.ReadAtLeast(input, block, blockSize)
-		if readN == 0 {
-			if readErr != nil {
-				if errors.Is(readErr, io.ErrUnexpectedEOF) || errors.Is(readErr, io.EOF) {
-					break
-				}
+	return bwtBlocks(input, formatlib.NewRawBlockWriter(output), StreamOptions{BlockSize: blockSize})
+}
 
-				return readErr
-			}
+// BWTStreamWithOptions performs a BWT operation on a byte stream using the
+// given options. The output is a formatlib container holding a single BWT
+// stage, preceded by an RLE1 stage if opts.RLE1 is set.
+func BWTStreamWithOptions(input io.Reader, output io.Writer, opts StreamOptions) error {
+	if opts.RLE1 && opts.Transform == TransformSentinel {
+		return errors.New("RLE1 needs a transform that allows any byte")
+	}
+
+	header := formatlib.Header{
+		Stages:    []formatlib.Stage{formatlib.StageBWT},
+		BlockSize: opts.BlockSize,
+		Transform: byte(opts.Transform),
+	}
+
+	if opts.RLE1 {
+		header.Stages = []formatlib.Stage{formatlib.StageRLE1, formatlib.StageBWT}
+	}
+
+	if opts.Checksum {
+		header.Flags |= formatlib.FlagChecksum
+	}
+
+	writer, err := formatlib.NewBlockWriter(output, header)
+	if err != nil {
+		return err
+	}
+
+	if err := bwtBlocks(input, writer, opts); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// encodedBlock is a transformed block along with the checksum of the block
+// before it was transformed.
+type encodedBlock struct {
+	data     []byte
+	checksum uint32
+}
+
+// bwtBlocks splits input into blocks of opts.BlockSize bytes and writes each
+// transformed block to output, along with its checksum if opts.Checksum is
+// set. Blocks are transformed concurrently by opts.Concurrency workers but
+// written in input order.
+func bwtBlocks(input io.Reader, output *formatlib.BlockWriter, opts StreamOptions) error {
+	blockSize := opts.BlockSize
+	workers := parallellib.Workers(opts.Concurrency)
+	buffers := make(chan []byte, workers)
+	finished := false
+
+	next := func() ([]byte, error) {
+		if finished {
+			return nil, io.EOF
 		}
 
-		bwtBlock, err := BWT(block[:readN])
-		if err != nil {
-			return err
+		var block []byte
+		select {
+		case block = <-buffers:
+		default:
+			block = make([]byte, blockSize)
 		}
 
-		encodedBlockSize := encodeBlockSize(len(bwtBlock))
+		readN, readErr := io.ReadAtLeast(input, block, blockSize)
+		if readErr != nil {
+			if !errors.Is(readErr, io.ErrUnexpectedEOF) && !errors.Is(readErr, io.EOF) {
+				return nil, readErr
+			}
 
-		n, writeErr := output.Write(encodedBlockSize)
-		if writeErr != nil {
-			return err
+			finished = true
+			if readN == 0 {
+				return nil, io.EOF
+			}
 		}
 
-		if n == 0 {
-			break
-		}
+		return block[:readN], nil
+	}
 
-		n, writeErr = output.Write(bwtBlock)
-		if err != nil {
-			return err
+	work := func(block []byte) (encodedBlock, error) {
+		var encoded encodedBlock
+		if opts.Checksum {
+			encoded.checksum = formatlib.Checksum(block)
 		}
 
-		if n == 0 {
-			break
+		data := block
+		if opts.RLE1 {
+			data = compresslib.EncodeRLE1(block)
 		}
 
-		if readErr != nil {
-			if errors.Is(readErr, io.ErrUnexpectedEOF) || errors.Is(readErr, io.EOF) {
-				break
-			}
+		var err error
+		encoded.data, err = EncodeBlock(data, opts.Transform)
 
-			return readErr
+		select {
+		case buffers <- block[:blockSize]:
+		default:
 		}
+
+		return encoded, err
+	}
+
+	emit := func(encoded encodedBlock) error {
+		return output.WriteBlock(encoded.data, encoded.checksum)
 	}
 
-	return nil
+	return parallellib.Ordered(workers, next, work, emit)
 }
@@ -2,13 +2,88 @@ package bwtlib
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"math/rand"
+	"os"
 	"strings"
 	"testing"
 
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
 )
 
+const iliadPath = "../testfiles/iliad.mb.txt"
+
+// indexedHeader is the container header for an indexed stream of 256 byte
+// blocks.
+const indexedHeader = "BWTZ\x01\x00\x00\x01\x00\x00\x01\x01\x01\x01"
+
+// bwtComparator is the original rotation sorting BWT, kept as a reference for
+// the suffix array implementation.
+func bwtComparator(input []byte) []byte {
+	input = append([]byte{0x02}, input...)
+	input = append(input, 0x03)
+
+	table := make([]int, 0, len(input))
+	for i := range input {
+		table = append(table, i)
+	}
+
+	slices.SortFunc(
+		table,
+		func(a, b int) int {
+			for i := range input {
+				if input[(a+i)%len(input)] > input[(b+i)%len(input)] {
+					return 1
+				}
+				if input[(a+i)%len(input)] < input[(b+i)%len(input)] {
+					return -1
+				}
+			}
+
+			return 0
+		},
+	)
+
+	output := make([]byte, 0, len(input))
+	for _, index := range table {
+		wrappedIndex := index - 1
+		if wrappedIndex < 0 {
+			wrappedIndex = len(input) + wrappedIndex
+		}
+		output = append(output, input[wrappedIndex])
+	}
+
+	return output
+}
+
+// randomBlock returns size bytes drawn from the first alphabetSize byte values,
+// skipping the sentinel characters.
+func randomBlock(rng *rand.Rand, size int, alphabetSize int) []byte {
+	block := make([]byte, size)
+	for i := range block {
+		block[i] = byte(rng.Intn(alphabetSize)) + 0x04
+	}
+
+	return block
+}
+
+func readIliad(tb testing.TB, size int) []byte {
+	data, err := os.ReadFile(iliadPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if size > 0 && size < len(data) {
+		data = data[:size]
+	}
+
+	return data
+}
+
 type StreamFunc func(io.Reader, io.Writer, int) error
 type IStreamFunc func(io.Reader, io.Writer) error
 
@@ -129,3 +204,619 @@ func TestIBWTStreamTwoBlocks(t *testing.T) {
 
 	runIStreamTest(t, IBWTStream, input, expected)
 }
+
+func TestBWTMatchesComparatorRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, alphabetSize := range []int{1, 2, 3, 4, 16, 252} {
+		for size := 0; size < 200; size += 7 {
+			input := randomBlock(rng, size, alphabetSize)
+
+			output, err := BWT(input)
+			assert.NoError(t, err)
+			assert.Equal(t, bwtComparator(input), output, "alphabet %v size %v", alphabetSize, size)
+		}
+	}
+}
+
+func TestBWTMatchesComparatorRepetitive(t *testing.T) {
+	inputs := []string{
+		strings.Repeat("A", 1000),
+		strings.Repeat("AB", 500),
+		strings.Repeat("ABA", 333),
+		strings.Repeat("MISSISSIPPI", 90),
+		strings.Repeat("\x00\x01", 100) + strings.Repeat("\xff", 100),
+	}
+
+	for _, input := range inputs {
+		output, err := BWT([]byte(input))
+		assert.NoError(t, err)
+		assert.Equal(t, bwtComparator([]byte(input)), output)
+	}
+}
+
+func TestBWTMatchesComparatorIliad(t *testing.T) {
+	input := readIliad(t, 16*1024)
+
+	output, err := BWT(input)
+	assert.NoError(t, err)
+	assert.Equal(t, bwtComparator(input), output)
+}
+
+var benchmarkInputs = []struct {
+	name  string
+	input func(testing.TB, int) []byte
+}{
+	{"Iliad", readIliad},
+	{"Repeated", func(_ testing.TB, size int) []byte { return bytes.Repeat([]byte("A"), size) }},
+	{"Periodic", func(_ testing.TB, size int) []byte { return bytes.Repeat([]byte("ABRACADABRA"), size/11) }},
+}
+
+func benchmarkBWT(b *testing.B, sizes []int, f func([]byte) []byte) {
+	for _, benchmarkInput := range benchmarkInputs {
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("%v/%vKiB", benchmarkInput.name, size/1024), func(b *testing.B) {
+				input := benchmarkInput.input(b, size)
+				b.SetBytes(int64(len(input)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f(input)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkBWTSuffixArray(b *testing.B) {
+	benchmarkBWT(b, []int{1024, 4 * 1024, 512 * 1024}, func(input []byte) []byte {
+		output, err := BWT(input)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return output
+	})
+}
+
+// BenchmarkBWTComparator stops at 4 KiB, beyond which the repetitive inputs
+// take minutes per iteration.
+func BenchmarkBWTComparator(b *testing.B) {
+	benchmarkBWT(b, []int{1024, 4 * 1024}, bwtComparator)
+}
+
+func BenchmarkBWTIndexed(b *testing.B) {
+	benchmarkBWT(b, []int{4 * 1024, 512 * 1024}, func(input []byte) []byte {
+		output, _ := BWTIndexed(input)
+		return output
+	})
+}
+
+// BenchmarkBWTIndexedRLE1 includes the time taken by compresslib.EncodeRLE1,
+// and reports throughput in bytes before it.
+func BenchmarkBWTIndexedRLE1(b *testing.B) {
+	benchmarkBWT(b, []int{4 * 1024, 512 * 1024}, func(input []byte) []byte {
+		output, _ := BWTIndexed(compresslib.EncodeRLE1(input))
+		return output
+	})
+}
+
+// BenchmarkBWTComparatorRLE1 shows RLE1 shortening the runs that make the
+// comparator slow.
+func BenchmarkBWTComparatorRLE1(b *testing.B) {
+	benchmarkBWT(b, []int{1024, 4 * 1024}, func(input []byte) []byte {
+		return bwtComparator(compresslib.EncodeRLE1(input))
+	})
+}
+
+func TestIBWTRoundTripRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, alphabetSize := range []int{1, 2, 3, 16, 252} {
+		for size := 0; size < 300; size += 13 {
+			input := randomBlock(rng, size, alphabetSize)
+
+			bwt, err := BWT(input)
+			assert.NoError(t, err)
+
+			output, err := IBWT(bwt)
+			assert.NoError(t, err)
+			assert.Equal(t, input, output, "alphabet %v size %v", alphabetSize, size)
+		}
+	}
+}
+
+func TestIBWTStreamIliad(t *testing.T) {
+	input := readIliad(t, 0)
+
+	var encoded bytes.Buffer
+	err := BWTStream(bytes.NewReader(input), &encoded, 512*1024)
+	assert.NoError(t, err)
+
+	runIStreamTest(t, IBWTStream, encoded.Bytes(), input)
+}
+
+func BenchmarkIBWTStreamIliad(b *testing.B) {
+	input := readIliad(b, 0)
+
+	var encoded bytes.Buffer
+	if err := BWTStream(bytes.NewReader(input), &encoded, 512*1024); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := IBWTStream(bytes.NewReader(encoded.Bytes()), io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBWTIndexedBasic(t *testing.T) {
+	input := []byte("BANANA")
+	expected := []byte("NNBAAA")
+
+	output, primary := BWTIndexed(input)
+	assert.Equal(t, expected, output)
+	assert.Equal(t, 3, primary)
+}
+
+func TestIBWTIndexedBasic(t *testing.T) {
+	input := []byte("NNBAAA")
+	expected := []byte("BANANA")
+
+	output, err := IBWTIndexed(input, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, output)
+}
+
+func TestIBWTIndexedEmpty(t *testing.T) {
+	output, err := IBWTIndexed([]byte{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, output)
+}
+
+func TestIBWTIndexedPrimaryOutOfRange(t *testing.T) {
+	_, err := IBWTIndexed([]byte("NNBAAA"), 6)
+	assert.Error(t, err)
+}
+
+func TestIBWTIndexedRoundTripBinary(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	inputs := [][]byte{
+		[]byte("\x02\x03\x02\x03"),
+		[]byte(strings.Repeat("AB", 64)),
+		bytes.Repeat([]byte{0x00}, 100),
+		bytes.Repeat([]byte{0xff, 0x03, 0x02}, 50),
+	}
+	for size := 1; size < 400; size += 17 {
+		block := make([]byte, size)
+		rng.Read(block)
+		inputs = append(inputs, block)
+	}
+
+	for _, input := range inputs {
+		bwt, primary := BWTIndexed(input)
+
+		output, err := IBWTIndexed(bwt, primary)
+		assert.NoError(t, err)
+		assert.Equal(t, input, output)
+	}
+}
+
+func TestBWTStreamIndexedBasic(t *testing.T) {
+	input := []byte("BANANA")
+	expected := []byte(indexedHeader + "\x0a\x00\x00\x00\x03\x00\x00\x00NNBAAA\x00\x00\x00\x00")
+
+	runStreamTest(t, func(input io.Reader, output io.Writer, blockSize int) error {
+		return BWTStreamWithOptions(input, output, StreamOptions{BlockSize: blockSize, Transform: TransformIndexed})
+	}, input, expected, 256)
+}
+
+func TestIBWTStreamIndexedBasic(t *testing.T) {
+	input := []byte(indexedHeader + "\x0a\x00\x00\x00\x03\x00\x00\x00NNBAAA\x00\x00\x00\x00")
+	expected := []byte("BANANA")
+
+	runIStreamTest(t, func(input io.Reader, output io.Writer) error {
+		return IBWTStreamWithOptions(input, output, StreamOptions{})
+	}, input, expected)
+}
+
+func TestIBWTStreamWithOptionsRejectsRawStream(t *testing.T) {
+	input := []byte("\x08\x00\x00\x00\x03ANNB\x02AA")
+
+	err := IBWTStreamWithOptions(bytes.NewReader(input), io.Discard, StreamOptions{})
+	assert.ErrorIs(t, err, formatlib.ErrBadMagic)
+}
+
+func TestIBWTStreamWithOptionsRejectsOtherStages(t *testing.T) {
+	var input bytes.Buffer
+	header := formatlib.Header{
+		Stages:    []formatlib.Stage{formatlib.StageBWT, formatlib.StageMTF},
+		BlockSize: 256,
+	}
+	assert.NoError(t, formatlib.WriteHeader(&input, header))
+	assert.NoError(t, formatlib.WriteEnd(&input))
+
+	err := IBWTStreamWithOptions(&input, io.Discard, StreamOptions{})
+	assert.ErrorIs(t, err, formatlib.ErrStageMismatch)
+}
+
+func TestIBWTStreamWithOptionsTruncated(t *testing.T) {
+	input := []byte(indexedHeader + "\x0a\x00\x00\x00\x03\x00\x00\x00NNBAAA")
+
+	err := IBWTStreamWithOptions(bytes.NewReader(input), io.Discard, StreamOptions{})
+	assert.ErrorIs(t, err, formatlib.ErrTruncated)
+}
+
+func TestBWTStreamIndexedRoundTripBinary(t *testing.T) {
+	input := make([]byte, 3000)
+	rand.New(rand.NewSource(4)).Read(input)
+	opts := StreamOptions{BlockSize: 1024, Transform: TransformIndexed}
+
+	var encoded bytes.Buffer
+	err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, opts)
+	assert.NoError(t, err)
+
+	var decoded bytes.Buffer
+	err = IBWTStreamWithOptions(&encoded, &decoded, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded.Bytes())
+}
+
+// checksummedIliad encodes four 1024 byte blocks of the Iliad with checksums.
+// Block i's payload starts at 14+i*1036+8, after its size and checksum.
+func checksummedIliad(t *testing.T) ([]byte, []byte) {
+	input := readIliad(t, 4*1024)
+	opts := StreamOptions{BlockSize: 1024, Transform: TransformIndexed, Checksum: true}
+
+	var encoded bytes.Buffer
+	err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, opts)
+	assert.NoError(t, err)
+
+	return input, encoded.Bytes()
+}
+
+func TestIBWTStreamChecksum(t *testing.T) {
+	input, encoded := checksummedIliad(t)
+
+	var decoded bytes.Buffer
+	err := IBWTStreamWithOptions(bytes.NewReader(encoded), &decoded, StreamOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded.Bytes())
+}
+
+func TestIBWTStreamChecksumFlippedByte(t *testing.T) {
+	_, encoded := checksummedIliad(t)
+	encoded[14+2*1036+8+100] ^= 0x20
+
+	err := IBWTStreamWithOptions(bytes.NewReader(encoded), io.Discard, StreamOptions{})
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, formatlib.ErrChecksum)
+	assert.Equal(t, 2, corruption.Block)
+	assert.Equal(t, int64(2048), corruption.Offset)
+}
+
+func TestIBWTStreamChecksumBadPrimary(t *testing.T) {
+	_, encoded := checksummedIliad(t)
+	encoded[14+1036+8+3] = 0xff
+
+	err := IBWTStreamWithOptions(bytes.NewReader(encoded), io.Discard, StreamOptions{Concurrency: 4})
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 1, corruption.Block)
+	assert.Equal(t, int64(1024), corruption.Offset)
+}
+
+func TestIBWTStreamChecksumTrailer(t *testing.T) {
+	_, encoded := checksummedIliad(t)
+	encoded[len(encoded)-1] ^= 0x01
+
+	err := IBWTStreamWithOptions(bytes.NewReader(encoded), io.Discard, StreamOptions{})
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, formatlib.ErrChecksum)
+	assert.Equal(t, 4, corruption.Block)
+	assert.Equal(t, int64(4096), corruption.Offset)
+}
+
+func TestIBWTStreamCorruptSentinel(t *testing.T) {
+	input := []byte("\x08\x00\x00\x00\x03ANNB\x02AA\x08\x00\x00\x00\x03ANNB\x01AA")
+
+	err := IBWTStream(bytes.NewReader(input), io.Discard)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 1, corruption.Block)
+	assert.Equal(t, int64(6), corruption.Offset)
+}
+
+func TestSuffixArray(t *testing.T) {
+	random := rand.New(rand.NewSource(16))
+	input := make([]byte, 2000)
+	for i := range input {
+		input[i] = "ab\x00"[random.Intn(3)]
+	}
+
+	expected := make([]int32, len(input))
+	for i := range expected {
+		expected[i] = int32(i)
+	}
+
+	slices.SortFunc(expected, func(a, b int32) int {
+		return bytes.Compare(input[a:], input[b:])
+	})
+
+	assert.Equal(t, expected, SuffixArray(input))
+	assert.Equal(t, []int32{5, 3, 1, 0, 4, 2}, SuffixArray([]byte("BANANA")))
+}
+
+func TestBWTStreamSentinelRejectsBinary(t *testing.T) {
+	err := BWTStream(bytes.NewReader([]byte("A\x02B")), io.Discard, 256)
+	assert.Error(t, err)
+}
+
+func TestBWTStreamConcurrencyDeterministic(t *testing.T) {
+	input := readIliad(t, 200*1024)
+
+	var expected []byte
+	for _, concurrency := range []int{1, 2, 3, 8, 0} {
+		opts := StreamOptions{BlockSize: 16 * 1024, Transform: TransformIndexed, Concurrency: concurrency}
+
+		var output bytes.Buffer
+		err := BWTStreamWithOptions(bytes.NewReader(input), &output, opts)
+		assert.NoError(t, err)
+
+		if expected == nil {
+			expected = output.Bytes()
+		}
+		assert.Equal(t, expected, output.Bytes(), "concurrency %v", concurrency)
+	}
+
+	var decoded bytes.Buffer
+	err := IBWTStreamWithOptions(bytes.NewReader(expected), &decoded, StreamOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded.Bytes())
+}
+
+func TestBWTStreamConcurrencyError(t *testing.T) {
+	input := append(bytes.Repeat([]byte("A"), 10*256), 0x02)
+
+	err := BWTStreamWithOptions(bytes.NewReader(input), io.Discard, StreamOptions{BlockSize: 256, Concurrency: 4})
+	assert.Error(t, err)
+}
+
+func BenchmarkBWTStreamConcurrency(b *testing.B) {
+	input := readIliad(b, 0)
+	for _, concurrency := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("%v", concurrency), func(b *testing.B) {
+			opts := StreamOptions{BlockSize: 128 * 1024, Transform: TransformIndexed, Concurrency: concurrency}
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if err := BWTStreamWithOptions(bytes.NewReader(input), io.Discard, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIBWTStreamConcurrency(t *testing.T) {
+	input := readIliad(t, 200*1024)
+
+	var encoded bytes.Buffer
+	err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, StreamOptions{BlockSize: 16 * 1024})
+	assert.NoError(t, err)
+
+	for _, opts := range []StreamOptions{
+		{Concurrency: 1},
+		{Concurrency: 2},
+		{Concurrency: 4, ReadAhead: 16},
+		{Concurrency: 16, ReadAhead: 2},
+		{},
+	} {
+		var decoded bytes.Buffer
+		err := IBWTStreamWithOptions(bytes.NewReader(encoded.Bytes()), &decoded, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, input, decoded.Bytes(), "options %+v", opts)
+	}
+}
+
+func TestIBWTStreamConcurrencyError(t *testing.T) {
+	input := readIliad(t, 64*1024)
+
+	var encoded bytes.Buffer
+	err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, StreamOptions{BlockSize: 4 * 1024})
+	assert.NoError(t, err)
+
+	// Corrupt the sentinels of a block in the middle of the stream.
+	corrupted := bytes.ReplaceAll(encoded.Bytes(), []byte{0x03}, []byte{0x04})
+
+	err = IBWTStreamWithOptions(bytes.NewReader(corrupted), io.Discard, StreamOptions{Concurrency: 4})
+	assert.Error(t, err)
+}
+
+func BenchmarkIBWTStreamConcurrency(b *testing.B) {
+	input := readIliad(b, 0)
+
+	var encoded bytes.Buffer
+	opts := StreamOptions{BlockSize: 128 * 1024, Transform: TransformIndexed}
+	if err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, opts); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("%v", concurrency), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				err := IBWTStreamWithOptions(bytes.NewReader(encoded.Bytes()), io.Discard, StreamOptions{Concurrency: concurrency})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// bwtsComparator is the bijective BWT computed by sorting the rotations of
+// every Lyndon factor, comparing their infinite repetitions directly.
+func bwtsComparator(input []byte) []byte {
+	factors := lyndonFactors(input)
+
+	type rotation struct {
+		factor []byte
+		offset int
+	}
+
+	var rotations []rotation
+	for i := 0; i+1 < len(factors); i++ {
+		factor := input[factors[i]:factors[i+1]]
+		for offset := range factor {
+			rotations = append(rotations, rotation{factor, offset})
+		}
+	}
+
+	slices.SortFunc(rotations, func(a, b rotation) int {
+		for i := 0; i < len(a.factor)+len(b.factor); i++ {
+			x := a.factor[(a.offset+i)%len(a.factor)]
+			y := b.factor[(b.offset+i)%len(b.factor)]
+			if x != y {
+				return int(x) - int(y)
+			}
+		}
+
+		return 0
+	})
+
+	output := make([]byte, 0, len(input))
+	for _, r := range rotations {
+		output = append(output, r.factor[(r.offset+len(r.factor)-1)%len(r.factor)])
+	}
+
+	return output
+}
+
+func TestLyndonFactors(t *testing.T) {
+	assert.Equal(t, []int{0, 1, 3, 5, 6}, lyndonFactors([]byte("banana")))
+	assert.Equal(t, []int{0, 1, 2, 3}, lyndonFactors([]byte("aaa")))
+	assert.Equal(t, []int{0, 6}, lyndonFactors([]byte("abcabd")))
+	assert.Equal(t, []int{0}, lyndonFactors(nil))
+}
+
+func TestBWTSBasic(t *testing.T) {
+	// The factors of "banana" are b, an, an and a.
+	output := BWTS([]byte("banana"))
+	assert.Equal(t, []byte("annbaa"), output)
+	assert.Equal(t, []byte("banana"), IBWTS(output))
+}
+
+func TestBWTSEmpty(t *testing.T) {
+	assert.Equal(t, []byte{}, BWTS(nil))
+	assert.Equal(t, []byte{}, IBWTS(nil))
+}
+
+func TestBWTSMatchesComparator(t *testing.T) {
+	rng := rand.New(rand.NewSource(18))
+	inputs := [][]byte{
+		[]byte("\x02\x03\x02\x03"),
+		[]byte(strings.Repeat("AB", 64)),
+		bytes.Repeat([]byte{0x00}, 100),
+		bytes.Repeat([]byte{0xff, 0x03, 0x02}, 50),
+		[]byte("zyxwvutsrqponmlkjihgfedcba"),
+		readIliad(t, 2000),
+	}
+	for size := 1; size < 400; size += 17 {
+		block := make([]byte, size)
+		rng.Read(block)
+		inputs = append(inputs, block, randomBlock(rng, size, 3))
+	}
+
+	for _, input := range inputs {
+		output := BWTS(input)
+		assert.Equal(t, bwtsComparator(input), output)
+		assert.Equal(t, len(input), len(output))
+		assert.Equal(t, input, IBWTS(output))
+	}
+}
+
+func TestIBWTSIsBijective(t *testing.T) {
+	// Every string is the BWTS of exactly one string, so decoding any bytes
+	// and encoding the result gives them back.
+	rng := rand.New(rand.NewSource(19))
+	for size := 1; size < 200; size += 7 {
+		block := randomBlock(rng, size, 4)
+		assert.Equal(t, block, BWTS(IBWTS(block)))
+	}
+}
+
+func TestBWTSIliad(t *testing.T) {
+	input := readIliad(t, 0)
+
+	assert.Equal(t, input, IBWTS(BWTS(input)))
+}
+
+func TestBWTStreamBijectiveRoundTrip(t *testing.T) {
+	for _, input := range [][]byte{readIliad(t, 100*1024), bytes.Repeat([]byte("\x02\x03\x00\xff"), 2000)} {
+		opts := StreamOptions{BlockSize: 4096, Transform: TransformBijective, Checksum: true}
+
+		var encoded bytes.Buffer
+		err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, opts)
+		assert.NoError(t, err)
+
+		header, err := formatlib.ReadHeader(bytes.NewReader(encoded.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, byte(TransformBijective), header.Transform)
+
+		var decoded bytes.Buffer
+		err = IBWTStreamWithOptions(&encoded, &decoded, StreamOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, input, decoded.Bytes())
+	}
+}
+
+func TestBWTStreamRLE1RoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		readIliad(t, 100*1024),
+		bytes.Repeat([]byte("A"), 100*1024),
+		append(bytes.Repeat([]byte("\x02\x02\x02\x02\x03"), 2000), make([]byte, 5000)...),
+	}
+
+	for _, input := range inputs {
+		for _, transform := range []Transform{TransformIndexed, TransformBijective} {
+			opts := StreamOptions{BlockSize: 4096, Transform: transform, Checksum: true, RLE1: true}
+
+			var encoded bytes.Buffer
+			err := BWTStreamWithOptions(bytes.NewReader(input), &encoded, opts)
+			assert.NoError(t, err)
+
+			header, err := formatlib.ReadHeader(bytes.NewReader(encoded.Bytes()))
+			assert.NoError(t, err)
+			assert.Equal(t, "rle1|bwt", header.StagesString())
+
+			var decoded bytes.Buffer
+			err = IBWTStreamWithOptions(&encoded, &decoded, StreamOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, input, decoded.Bytes())
+		}
+	}
+}
+
+func TestBWTStreamRLE1ShrinksRuns(t *testing.T) {
+	input := bytes.Repeat([]byte("A"), 100*1024)
+	opts := StreamOptions{BlockSize: 4096, Transform: TransformIndexed}
+
+	var plain, rle1 bytes.Buffer
+	assert.NoError(t, BWTStreamWithOptions(bytes.NewReader(input), &plain, opts))
+	opts.RLE1 = true
+	assert.NoError(t, BWTStreamWithOptions(bytes.NewReader(input), &rle1, opts))
+	assert.Less(t, rle1.Len(), plain.Len()/10)
+}
+
+func TestBWTStreamRLE1RejectsSentinel(t *testing.T) {
+	opts := StreamOptions{BlockSize: 4096, RLE1: true}
+
+	err := BWTStreamWithOptions(bytes.NewReader([]byte("BANANA")), io.Discard, opts)
+	assert.Error(t, err)
+}
+
+func BenchmarkBWTS(b *testing.B) {
+	benchmarkBWT(b, []int{1024, 16 * 1024, 128 * 1024}, BWTS)
+}
@@ -0,0 +1,187 @@
+package bwtlib
+
+// lyndonFactors returns the start of each factor of the Lyndon factorisation
+// of input, found by Duval's algorithm, followed by len(input). The factors
+// are Lyndon words in non-increasing order.
+func lyndonFactors(input []byte) []int {
+	var starts []int
+	for i := 0; i < len(input); {
+		j, k := i+1, i
+		for j < len(input) && input[k] <= input[j] {
+			if input[k] < input[j] {
+				k = i
+			} else {
+				k++
+			}
+			j++
+		}
+
+		for i <= k {
+			starts = append(starts, i)
+			i += j - k
+		}
+	}
+
+	return append(starts, len(input))
+}
+
+// BWTS computes the bijective Burrows-Wheeler transform of Gil and Scott. The
+// input is split into its Lyndon factorisation, and the output is the last
+// column of the rotations of every factor, sorted by their infinite
+// repetitions. Unlike BWT and BWTIndexed it needs neither sentinels nor a
+// primary index, so the output is the same size as the input and any input
+// can be transformed.
+func BWTS(input []byte) []byte {
+	n := len(input)
+	output := make([]byte, n)
+	if n == 0 {
+		return output
+	}
+
+	// start and size give the Lyndon factor holding each position.
+	start := make([]int32, n)
+	size := make([]int32, n)
+	longest := 0
+	factors := lyndonFactors(input)
+	for i := 0; i+1 < len(factors); i++ {
+		for p := factors[i]; p < factors[i+1]; p++ {
+			start[p] = int32(factors[i])
+			size[p] = int32(factors[i+1] - factors[i])
+		}
+		longest = max(longest, factors[i+1]-factors[i])
+	}
+
+	// rotate returns the position length bytes after p in its factor's
+	// infinite repetition.
+	rotate := func(p int32, length int) int32 {
+		return start[p] + int32((int(p-start[p])+length)%int(size[p]))
+	}
+
+	// Prefix doubling: after each round rank orders the positions by the
+	// first 2*length bytes of their repetitions, and order lists the
+	// positions in that order. Two repetitions with periods of at most
+	// longest bytes are equal if their first 2*longest-1 bytes are, so equal
+	// rotations of equal factors may be left in either order.
+	rank := make([]int32, n)
+	for p, c := range input {
+		rank[p] = int32(c)
+	}
+
+	order := make([]int32, n)
+	byNext := make([]int32, n)
+	nextRank := make([]int32, n)
+	shifted := make([]int32, n)
+	counts := make([]int32, max(n, 256)+1)
+	classes := 256
+	for length := 1; ; length *= 2 {
+		for p := range shifted {
+			shifted[p] = rotate(int32(p), length)
+		}
+
+		// Sort by the rank of the rotation length bytes on, then stably by
+		// the rank of the rotation itself.
+		countingSort(byNext, nil, rank, shifted, counts[:classes+1])
+		countingSort(order, byNext, rank, nil, counts[:classes+1])
+
+		nextRank[order[0]] = 0
+		classes = 1
+		for i := 1; i < n; i++ {
+			p, q := order[i-1], order[i]
+			if rank[p] != rank[q] || rank[shifted[p]] != rank[shifted[q]] {
+				classes++
+			}
+			nextRank[q] = int32(classes - 1)
+		}
+		rank, nextRank = nextRank, rank
+
+		if classes == n || 2*length >= 2*longest-1 {
+			break
+		}
+	}
+
+	for i, p := range order {
+		output[i] = input[rotate(p, int(size[p])-1)]
+	}
+
+	return output
+}
+
+// countingSort writes positions to sorted in increasing order of
+// rank[key[p]], keeping the order of input, which is every position in order
+// if nil. key may be nil to sort by rank[p]. counts must have room for every
+// rank plus one.
+func countingSort(sorted []int32, input []int32, rank []int32, key []int32, counts []int32) {
+	for i := range counts {
+		counts[i] = 0
+	}
+
+	keyRank := rank
+	if key != nil {
+		keyRank = make([]int32, len(key))
+		for p, k := range key {
+			keyRank[p] = rank[k]
+		}
+	}
+
+	for _, r := range keyRank {
+		counts[r+1]++
+	}
+
+	for i := 1; i < len(counts); i++ {
+		counts[i] += counts[i-1]
+	}
+
+	for i := range sorted {
+		p := int32(i)
+		if input != nil {
+			p = input[i]
+		}
+
+		r := keyRank[p]
+		sorted[counts[r]] = p
+		counts[r]++
+	}
+}
+
+// IBWTS reverses BWTS.
+func IBWTS(bwt []byte) []byte {
+	var inv Inverter
+
+	return inv.invertBijective(bwt)
+}
+
+// invertBijective reverses BWTS. Each cycle of the LF-mapping spells one
+// Lyndon factor, and the smallest row not yet visited starts the smallest
+// factor remaining, which is the last of them in the original. The returned
+// slice is only valid until the next call.
+func (inv *Inverter) invertBijective(bwt []byte) []byte {
+	if len(bwt) == 0 {
+		return []byte{}
+	}
+
+	next := inv.nextRows(bwt)
+	output := inv.output[:len(bwt)]
+
+	visited := make([]uint64, (len(bwt)+63)/64)
+	end := len(bwt)
+	for row := range bwt {
+		if visited[row/64]&(1<<(row%64)) != 0 {
+			continue
+		}
+
+		size := 0
+		for x := uint32(row); visited[x/64]&(1<<(x%64)) == 0; x = next[x] {
+			visited[x/64] |= 1 << (x % 64)
+			size++
+		}
+
+		end -= size
+		x := uint32(row)
+		for i := end; i < end+size; i++ {
+			x = next[x]
+			output[i] = bwt[x]
+		}
+	}
+
+	return output
+}
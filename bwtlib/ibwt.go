@@ -5,129 +5,243 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"sort"
+	"sync"
 
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/parallellib"
 	"golang.org/x/exp/slices"
 )
 
-// IBWT will compress a byte array and output the full bytearray.
-func IBWT(bwt []byte) ([]byte, error) {
-	if !slices.Contains(bwt, 0x02) || !slices.Contains(bwt, 0x03) {
-		return nil, errors.New("Need EOF character in input")
-	}
-
-	sortedBwt := append([]byte{}, bwt...)
-	sort.Slice(
-		sortedBwt,
-		func(i, j int) bool {
-			return sortedBwt[i] < sortedBwt[j]
-		},
-	)
-	lShift := make([]int, len(bwt))
-	lShiftUsed := make([]bool, len(bwt))
-
-	for i := range sortedBwt {
-		for j := range bwt {
-			if lShiftUsed[j] == true {
-				continue
-			}
-
-			if sortedBwt[i] == bwt[j] {
-				lShift[i] = j
-				lShiftUsed[j] = true
-				break
-			}
-		}
+// Inverter holds the scratch space for inverting BWT blocks so that it can be
+// reused across the blocks of a stream. The zero value is ready to use.
+type Inverter struct {
+	next   []uint32
+	output []byte
+}
+
+// nextRows returns, for the BWT bwt, the mapping from each row to the row
+// starting one character later, growing the scratch space if needed.
+func (inv *Inverter) nextRows(bwt []byte) []uint32 {
+	if cap(inv.next) < len(bwt) {
+		inv.next = make([]uint32, len(bwt))
+		inv.output = make([]byte, len(bwt))
 	}
+	next := inv.next[:len(bwt)]
 
-	original := make([]byte, 0, len(bwt))
+	// Match the i'th occurrence of a character in the first column with its
+	// i'th occurrence in the last column.
+	var counts [256]uint32
+	for _, c := range bwt {
+		counts[c]++
+	}
 
-	x := 0
-	for x = range bwt {
-		if bwt[x] == 0x03 {
-			break
-		}
+	sum := uint32(0)
+	for c := range counts {
+		sum, counts[c] = sum+counts[c], sum
 	}
 
-	for range bwt {
-		x = lShift[x]
-		original = append(original, bwt[x])
+	for i, c := range bwt {
+		next[counts[c]] = uint32(i)
+		counts[c]++
 	}
 
-	return original[1 : len(original)-1], nil
+	return next
 }
 
-// readBlockSize will read and decode the block size from the input buffer. A
-// block size of 0 indicates that the buffer has finished.
-func readBlockSize(input io.Reader) (int, error) {
-	blockSizeBuffer := make([]byte, 4)
-	n, err := io.ReadAtLeast(input, blockSizeBuffer, 4)
+// invert reverses the BWT of bwt by following the LF-mapping from the row
+// primary, which must be the row holding the original rotation. The returned
+// slice is only valid until the next call.
+func (inv *Inverter) invert(bwt []byte, primary int) []byte {
+	next := inv.nextRows(bwt)
+	output := inv.output[:len(bwt)]
+
+	x := uint32(primary)
+	for i := range output {
+		x = next[x]
+		output[i] = bwt[x]
+	}
 
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			return 0, nil
-		}
+	return output
+}
 
-		if errors.Is(err, io.ErrUnexpectedEOF) {
-			return 0, errors.New("malformed block size")
-		}
+// sentinelRow finds the row of a sentinel BWT holding the original string,
+// which is the row that ends in 0x03 and so starts with 0x02.
+func sentinelRow(bwt []byte) (int, error) {
+	if !slices.Contains(bwt, 0x02) || !slices.Contains(bwt, 0x03) {
+		return 0, errors.New("Need EOF character in input")
+	}
 
-		return 0, err
+	return slices.Index(bwt, 0x03), nil
+}
+
+// IBWT will decompress a byte array and output the full bytearray.
+func IBWT(bwt []byte) ([]byte, error) {
+	primary, err := sentinelRow(bwt)
+	if err != nil {
+		return nil, err
 	}
 
-	if n == 0 {
-		return 0, nil
+	var inv Inverter
+	original := inv.invert(bwt, primary)
+
+	return original[1 : len(original)-1], nil
+}
+
+// IBWTIndexed will reverse BWTIndexed, using the primary index to find the row
+// holding the original string.
+func IBWTIndexed(bwt []byte, primary int) ([]byte, error) {
+	var inv Inverter
+
+	return inv.Invert(bwt, primary)
+}
+
+// Invert reverses BWTIndexed like IBWTIndexed, reusing the Inverter's scratch
+// space. The returned slice is only valid until the next call.
+func (inv *Inverter) Invert(bwt []byte, primary int) ([]byte, error) {
+	if len(bwt) == 0 {
+		return []byte{}, nil
 	}
 
-	if n != 4 {
-		return 0, errors.New("malformed block size")
+	if primary < 0 || primary >= len(bwt) {
+		return nil, fmt.Errorf("primary index %v out of range for block of %v bytes", primary, len(bwt))
 	}
 
-	return int(binary.LittleEndian.Uint32(blockSizeBuffer)), nil
+	return inv.invert(bwt, primary), nil
 }
 
-// IBWTStream performs a BWT operation on a byte stream.
-func IBWTStream(input io.Reader, output io.Writer) error {
-	defaultBlockSize := 32 * 1024
-	block := make([]byte, 0, defaultBlockSize)
-	for {
-		blockSize, err := readBlockSize(input)
+// DecodeBlock reverses EncodeBlock. The returned slice is only valid until the
+// next call.
+func (inv *Inverter) DecodeBlock(block []byte, transform Transform) ([]byte, error) {
+	switch transform {
+	case TransformSentinel:
+		primary, err := sentinelRow(block)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if blockSize == 0 {
-			break
+		original := inv.invert(block, primary)
+
+		return original[1 : len(original)-1], nil
+	case TransformIndexed:
+		if len(block) < 4 {
+			return nil, fmt.Errorf("malformed block of %v bytes, expected a primary index", len(block))
 		}
 
-		block = block[:blockSize]
-		n, err := io.ReadAtLeast(input, block, blockSize)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-				return fmt.Errorf("malformed block of %v bytes, expected %v", n, blockSize)
-			}
+		primary := int(binary.LittleEndian.Uint32(block))
+
+		return inv.Invert(block[4:], primary)
+	case TransformBijective:
+		return inv.invertBijective(block), nil
+	default:
+		return nil, fmt.Errorf("unknown transform %v", transform)
+	}
+}
+
+// IBWTStream performs a BWT operation on a byte stream. Blocks are decoded on
+// runtime.GOMAXPROCS goroutines.
+func IBWTStream(input io.Reader, output io.Writer) error {
+	return ibwtBlocks(output, formatlib.NewRawBlockReader(input), TransformSentinel, false, 0, StreamOptions{})
+}
+
+// IBWTStreamWithOptions reverses BWTStreamWithOptions. The transform, block
+// size and whether RLE1 was applied are read from the container header, while
+// Concurrency and ReadAhead control how many blocks are decoded at once. If
+// the container has checksums, a block that does not match its checksum
+// returns a *formatlib.CorruptionError.
+func IBWTStreamWithOptions(input io.Reader, output io.Writer, opts StreamOptions) error {
+	reader, err := formatlib.NewBlockReader(input)
+	if err != nil {
+		return err
+	}
 
+	header := reader.Header
+	rle1 := header.ExpectStages(formatlib.StageRLE1, formatlib.StageBWT) == nil
+	if !rle1 {
+		if err := header.ExpectStages(formatlib.StageBWT); err != nil {
 			return err
 		}
+	}
+
+	return ibwtBlocks(output, reader, Transform(header.Transform), rle1, header.BlockSize, opts)
+}
+
+// decodedBlock is a block decoded by an Inverter, which must not be reused
+// until the block has been written. Decoding errors are held until the block
+// is emitted, when its offset in the output is known.
+type decodedBlock struct {
+	formatlib.Block
+	original []byte
+	inv      *Inverter
+	err      error
+}
 
-		if n != blockSize {
-			return fmt.Errorf("malformed block of %v bytes, expected %v", n, blockSize)
+// ibwtBlocks reads blocks from reader until the end of stream, decodes them
+// concurrently and writes them to output in order, undoing RLE1 after the BWT
+// if rle1 is set. A maxBlockSize above 0 rejects decoded blocks larger than
+// it. Errors decoding or verifying a block are returned as a
+// *formatlib.CorruptionError.
+func ibwtBlocks(
+	output io.Writer,
+	reader *formatlib.BlockReader,
+	transform Transform,
+	rle1 bool,
+	maxBlockSize int,
+	opts StreamOptions,
+) error {
+	workers := parallellib.Workers(opts.Concurrency)
+	window := max(opts.ReadAhead, workers)
+	buffers := make(chan []byte, window)
+	inverters := sync.Pool{New: func() any { return &Inverter{} }}
+
+	next := func() (formatlib.Block, error) {
+		var buffer []byte
+		select {
+		case buffer = <-buffers:
+		default:
 		}
 
-		originalBlock, err := IBWT(block)
-		if err != nil {
-			return err
+		return reader.Next(buffer)
+	}
+
+	work := func(block formatlib.Block) (decodedBlock, error) {
+		inv := inverters.Get().(*Inverter)
+		originalBlock, err := inv.DecodeBlock(block.Data, transform)
+		if err == nil && rle1 {
+			originalBlock, err = compresslib.DecodeRLE1(originalBlock)
 		}
 
-		n, err = output.Write(originalBlock)
-		if err != nil {
-			return err
+		select {
+		case buffers <- block.Data:
+		default:
+		}
+
+		if err == nil && maxBlockSize > 0 && len(originalBlock) > maxBlockSize {
+			err = fmt.Errorf("malformed block of %v bytes, expected at most %v", len(originalBlock), maxBlockSize)
 		}
 
-		if n == 0 {
-			return fmt.Errorf("failed to write to output")
+		return decodedBlock{Block: block, original: originalBlock, inv: inv, err: err}, nil
+	}
+
+	emit := func(decoded decodedBlock) error {
+		defer inverters.Put(decoded.inv)
+
+		if decoded.err != nil {
+			return reader.Corrupt(decoded.Block, decoded.err)
 		}
+
+		if err := reader.Verify(decoded.Block, decoded.original); err != nil {
+			return err
+		}
+
+		_, err := output.Write(decoded.original)
+
+		return err
+	}
+
+	if err := parallellib.OrderedWindow(workers, window, next, work, emit); err != nil {
+		return err
 	}
 
-	return nil
+	return reader.Finish()
 }
@@ -0,0 +1,200 @@
+package bwtlib
+
+// suffixArray returns the suffix array of text using the SA-IS algorithm. Every
+// symbol in text must be less than alphabetSize. The end of text is treated as
+// a virtual sentinel that sorts before every symbol.
+func suffixArray(text []int32, alphabetSize int) []int32 {
+	sa := make([]int32, len(text))
+	sais(text, sa, alphabetSize)
+
+	return sa
+}
+
+// SuffixArray returns the suffix array of input, in which a suffix sorts before
+// any longer suffix that it prefixes.
+func SuffixArray(input []byte) []int32 {
+	text := make([]int32, len(input))
+	for i, c := range input {
+		text[i] = int32(c)
+	}
+
+	return suffixArray(text, 256)
+}
+
+// bucketBounds fills buckets with the start (or end) offset of each symbol's
+// bucket in the suffix array.
+func bucketBounds(text []int32, buckets []int32, end bool) {
+	for i := range buckets {
+		buckets[i] = 0
+	}
+
+	for _, c := range text {
+		buckets[c]++
+	}
+
+	sum := int32(0)
+	for i := range buckets {
+		sum += buckets[i]
+		if end {
+			buckets[i] = sum
+		} else {
+			buckets[i] = sum - buckets[i]
+		}
+	}
+}
+
+// induceSort induces the order of the L-type suffixes from the sorted LMS
+// suffixes already placed in sa, followed by the order of the S-type suffixes.
+func induceSort(text []int32, sa []int32, sType []bool, buckets []int32) {
+	n := len(text)
+
+	bucketBounds(text, buckets, false)
+
+	// The virtual sentinel is the smallest suffix, and the suffix before it is
+	// always L-type.
+	last := text[n-1]
+	sa[buckets[last]] = int32(n - 1)
+	buckets[last]++
+
+	for i := 0; i < n; i++ {
+		j := sa[i] - 1
+		if j >= 0 && !sType[j] {
+			sa[buckets[text[j]]] = j
+			buckets[text[j]]++
+		}
+	}
+
+	bucketBounds(text, buckets, true)
+	for i := n - 1; i >= 0; i-- {
+		j := sa[i] - 1
+		if j >= 0 && sType[j] {
+			buckets[text[j]]--
+			sa[buckets[text[j]]] = j
+		}
+	}
+}
+
+// sais writes the suffix array of text into sa, which must be the same length.
+func sais(text []int32, sa []int32, alphabetSize int) {
+	n := len(text)
+	switch n {
+	case 0:
+		return
+	case 1:
+		sa[0] = 0
+		return
+	}
+
+	sType := make([]bool, n)
+	for i := n - 2; i >= 0; i-- {
+		sType[i] = text[i] < text[i+1] || (text[i] == text[i+1] && sType[i+1])
+	}
+
+	isLMS := func(i int) bool {
+		return i > 0 && i < n && sType[i] && !sType[i-1]
+	}
+
+	buckets := make([]int32, alphabetSize)
+
+	// Sort the LMS substrings by placing them at the ends of their buckets and
+	// inducing the rest.
+	for i := range sa {
+		sa[i] = -1
+	}
+
+	bucketBounds(text, buckets, true)
+	for i := n - 1; i > 0; i-- {
+		if isLMS(i) {
+			buckets[text[i]]--
+			sa[buckets[text[i]]] = int32(i)
+		}
+	}
+
+	induceSort(text, sa, sType, buckets)
+
+	// Gather the sorted LMS substrings at the front of sa.
+	m := 0
+	for i := 0; i < n; i++ {
+		if isLMS(int(sa[i])) {
+			sa[m] = sa[i]
+			m++
+		}
+	}
+
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+
+	// Name each LMS substring by its rank, giving equal substrings the same
+	// name. LMS positions are at least two apart so pos/2 is a unique slot.
+	names := 0
+	prev := -1
+	for i := 0; i < m; i++ {
+		pos := int(sa[i])
+		diff := prev == -1
+		for d := 0; !diff; d++ {
+			if pos+d == n || prev+d == n || text[pos+d] != text[prev+d] || sType[pos+d] != sType[prev+d] {
+				diff = true
+				break
+			}
+
+			if d > 0 && isLMS(pos+d) {
+				break
+			}
+		}
+
+		if diff {
+			names++
+			prev = pos
+		}
+
+		sa[m+pos/2] = int32(names - 1)
+	}
+
+	j := n - 1
+	for i := n - 1; i >= m; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+
+	// Sort the LMS suffixes, recursing if the names are not yet unique.
+	reduced := sa[n-m:]
+	reducedSA := sa[:m]
+	if names < m {
+		sais(reduced, reducedSA, names)
+	} else {
+		for i := 0; i < m; i++ {
+			reducedSA[reduced[i]] = int32(i)
+		}
+	}
+
+	j = 0
+	for i := 1; i < n; i++ {
+		if isLMS(i) {
+			reduced[j] = int32(i)
+			j++
+		}
+	}
+
+	for i := 0; i < m; i++ {
+		reducedSA[i] = reduced[reducedSA[i]]
+	}
+
+	for i := m; i < n; i++ {
+		sa[i] = -1
+	}
+
+	// Place the sorted LMS suffixes at the ends of their buckets and induce the
+	// final order.
+	bucketBounds(text, buckets, true)
+	for i := m - 1; i >= 0; i-- {
+		pos := sa[i]
+		sa[i] = -1
+		buckets[text[pos]]--
+		sa[buckets[text[pos]]] = pos
+	}
+
+	induceSort(text, sa, sType, buckets)
+}
@@ -0,0 +1,57 @@
+package bzip2lib
+
+// Compression levels, which select a block size of level times 100,000 bytes.
+const (
+	MinLevel     = 1
+	MaxLevel     = 9
+	DefaultLevel = 9
+)
+
+const (
+	fileMagic  = "BZh"
+	blockMagic = 0x314159265359
+	endMagic   = 0x177245385090
+
+	// runA and runB code runs of zero MTF ranks in bijective base 2, with
+	// runA worth 1 and runB worth 2 at each position.
+	runA = 0
+	runB = 1
+
+	// maxRun is the longest run RLE1 codes as four bytes and a count.
+	maxRun = 4 + 251
+)
+
+// crcTable holds the MSB-first CRC32 used by bzip2, which unlike hash/crc32
+// does not reflect its input.
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+// updateCRC adds n copies of c to crc. Block CRCs start as 0xffffffff and are
+// inverted once the block is complete.
+func updateCRC(crc uint32, c byte, n int) uint32 {
+	for ; n > 0; n-- {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^c]
+	}
+
+	return crc
+}
+
+// combineCRC folds a block CRC into the stream CRC.
+func combineCRC(stream uint32, block uint32) uint32 {
+	return (stream<<1 | stream>>31) ^ block
+}
@@ -0,0 +1,302 @@
+package bzip2lib
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"git.neds.sh/jack.massey/bwt/formatlib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const iliadPath = "../testfiles/iliad.mb.txt"
+
+// The reference fixtures were made from referenceText by bzip2 1.0.8. The
+// first is two blocks at -1. The concatenated one holds the first half at
+// -1, an empty stream and the second half at -9. The last is the first with
+// a bit of its first block CRC flipped.
+const (
+	referencePath             = "../testfiles/reference.bz2"
+	referenceConcatenatedPath = "../testfiles/reference-concatenated.bz2"
+	referenceBadCRCPath       = "../testfiles/reference-badcrc.bz2"
+)
+
+func compress(t *testing.T, input []byte, level int) []byte {
+	var output bytes.Buffer
+	writer, err := NewWriterLevel(&output, level)
+	assert.NoError(t, err)
+
+	_, err = writer.Write(input)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	return output.Bytes()
+}
+
+func stdlibDecompress(t *testing.T, input []byte) []byte {
+	output, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(input)))
+	assert.NoError(t, err)
+
+	return output
+}
+
+func TestWriterEmpty(t *testing.T) {
+	compressed := compress(t, nil, DefaultLevel)
+	assert.Equal(t, []byte("BZh9\x17\x72\x45\x38\x50\x90\x00\x00\x00\x00"), compressed)
+	assert.Equal(t, []byte{}, stdlibDecompress(t, compressed))
+}
+
+func TestWriterBasic(t *testing.T) {
+	input := []byte("BANANA")
+	assert.Equal(t, input, stdlibDecompress(t, compress(t, input, DefaultLevel)))
+}
+
+func TestWriterSingleByte(t *testing.T) {
+	input := []byte("A")
+	assert.Equal(t, input, stdlibDecompress(t, compress(t, input, DefaultLevel)))
+}
+
+func TestWriterRuns(t *testing.T) {
+	var input []byte
+	for _, length := range []int{1, 3, 4, 5, 254, 255, 256, 259, 260, 1000} {
+		input = append(input, bytes.Repeat([]byte{byte(length)}, length)...)
+		input = append(input, bytes.Repeat([]byte("x"), length)...)
+	}
+
+	assert.Equal(t, input, stdlibDecompress(t, compress(t, input, DefaultLevel)))
+}
+
+func TestWriterIliad(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	compressed := compress(t, input, DefaultLevel)
+	assert.Less(t, len(compressed), len(input)/3)
+	assert.Equal(t, input, stdlibDecompress(t, compressed))
+}
+
+func TestWriterMultipleBlocks(t *testing.T) {
+	input := make([]byte, 350000)
+	random := rand.New(rand.NewSource(12))
+	random.Read(input[:200000])
+	for i := 200000; i < len(input); i++ {
+		input[i] = byte(random.Intn(4))
+	}
+
+	assert.Equal(t, input, stdlibDecompress(t, compress(t, input, 1)))
+}
+
+func TestWriterLongRunsAcrossBlocks(t *testing.T) {
+	input := bytes.Repeat([]byte("Z"), 1000000)
+	assert.Equal(t, input, stdlibDecompress(t, compress(t, input, 1)))
+}
+
+func TestWriterSmallWrites(t *testing.T) {
+	input := bytes.Repeat([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES\n"), 100)
+
+	var output bytes.Buffer
+	writer := NewWriter(&output)
+	for _, c := range input {
+		_, err := writer.Write([]byte{c})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+
+	assert.Equal(t, input, stdlibDecompress(t, output.Bytes()))
+}
+
+func TestWriterInvalidLevel(t *testing.T) {
+	_, err := NewWriterLevel(io.Discard, 0)
+	assert.Error(t, err)
+
+	_, err = NewWriterLevel(io.Discard, 10)
+	assert.Error(t, err)
+}
+
+func TestWriterClosed(t *testing.T) {
+	writer := NewWriter(io.Discard)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, writer.Close())
+
+	_, err := writer.Write([]byte("A"))
+	assert.Error(t, err)
+}
+
+func TestRunSymbols(t *testing.T) {
+	// Runs of 1, 2, 3 and 4 zeros, each followed by rank 1.
+	ranks := []byte{0, 1, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+	expected := []int{runA, 2, runB, 2, runA, runA, 2, runB, runA, 2, 3}
+	assert.Equal(t, expected, runSymbols(ranks, 2))
+}
+
+func BenchmarkWriterIliad(b *testing.B) {
+	input, err := os.ReadFile(iliadPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer := NewWriter(io.Discard)
+		if _, err := writer.Write(input); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func decompress(t *testing.T, input []byte) []byte {
+	reader, err := NewReader(bytes.NewReader(input))
+	assert.NoError(t, err)
+
+	output, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+
+	return output
+}
+
+func TestReaderMatchesStdlib(t *testing.T) {
+	iliad, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	binary := make([]byte, 250000)
+	rand.New(rand.NewSource(13)).Read(binary)
+
+	inputs := [][]byte{
+		{},
+		[]byte("A"),
+		[]byte("BANANA"),
+		bytes.Repeat([]byte("Z"), 1000000),
+		binary,
+		iliad,
+	}
+
+	for _, input := range inputs {
+		compressed := compress(t, input, 2)
+		decoded := decompress(t, compressed)
+		assert.Equal(t, stdlibDecompress(t, compressed), decoded)
+		assert.Equal(t, input, decoded)
+	}
+}
+
+func TestReaderConcatenatedStreams(t *testing.T) {
+	first := compress(t, []byte("SIX.MIXED.PIXIES"), DefaultLevel)
+	second := compress(t, []byte(".SIFT.SIXTY.PIXIE.DUST.BOXES"), 1)
+	compressed := append(append([]byte{}, first...), second...)
+
+	assert.Equal(t, stdlibDecompress(t, compressed), decompress(t, compressed))
+}
+
+// referenceText returns the input of the reference fixtures, which has runs
+// long enough for RLE1 and every byte value.
+func referenceText() []byte {
+	var text bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&text, "%05d SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES\n", i)
+	}
+
+	text.Write(bytes.Repeat([]byte("Z"), 5000))
+	for c := 0; c < 256; c++ {
+		text.WriteByte(byte(c))
+	}
+
+	return text.Bytes()
+}
+
+func TestReaderReferenceFixtures(t *testing.T) {
+	expected := referenceText()
+	for _, path := range []string{referencePath, referenceConcatenatedPath} {
+		compressed, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decompress(t, compressed), path)
+	}
+}
+
+func TestReaderReferenceBadCRC(t *testing.T) {
+	compressed, err := os.ReadFile(referenceBadCRCPath)
+	assert.NoError(t, err)
+
+	reader, err := NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, formatlib.ErrChecksum)
+	assert.Equal(t, 0, corruption.Block)
+}
+
+func TestReaderBadMagic(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("BWTZ\x01\x00")))
+	assert.ErrorIs(t, err, ErrNotBzip2)
+
+	_, err = NewReader(bytes.NewReader([]byte("BZh0")))
+	assert.ErrorIs(t, err, ErrNotBzip2)
+}
+
+func TestReaderBlockCRC(t *testing.T) {
+	input := bytes.Repeat([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES\n"), 100)
+	compressed := compress(t, input, DefaultLevel)
+
+	// The block CRC follows the 4 byte header and 6 byte block magic.
+	compressed[10] ^= 0x01
+
+	reader, err := NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, formatlib.ErrChecksum)
+	assert.Equal(t, 0, corruption.Block)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	compressed := compress(t, []byte("BANANA"), DefaultLevel)
+
+	reader, err := NewReader(bytes.NewReader(compressed[:len(compressed)-6]))
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, formatlib.ErrTruncated)
+}
+
+func BenchmarkReaderIliad(b *testing.B) {
+	input, err := os.ReadFile(iliadPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	writer := NewWriter(&compressed)
+	if _, err := writer.Write(input); err != nil {
+		b.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader, err := NewReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
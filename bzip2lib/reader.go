@@ -0,0 +1,313 @@
+package bzip2lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/bitlib"
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/huffmanlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+)
+
+// ErrNotBzip2 is returned when the input does not start with a bzip2 header.
+var ErrNotBzip2 = errors.New("not a bzip2 stream: bad magic number")
+
+// Reader decompresses a .bz2 stream, including streams made of several
+// concatenated bzip2 streams. Blocks that cannot be decoded or do not match
+// their CRC return a *formatlib.CorruptionError.
+type Reader struct {
+	r         *bufio.Reader
+	bits      *bitlib.Reader
+	maxBlock  int
+	streamCRC uint32
+	index     int
+	offset    int64
+	inv       bwtlib.Inverter
+	pending   []byte
+	err       error
+}
+
+// NewReader reads the bzip2 header from r and returns a Reader that
+// decompresses the rest of the stream.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: bufio.NewReader(r)}
+	if err := z.readHeader(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+// readHeader reads the magic number and level that start each stream.
+func (z *Reader) readHeader() error {
+	header := make([]byte, len(fileMagic)+1)
+	if _, err := io.ReadFull(z.r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrNotBzip2
+		}
+
+		return err
+	}
+
+	level := int(header[len(fileMagic)] - '0')
+	if string(header[:len(fileMagic)]) != fileMagic || level < MinLevel || level > MaxLevel {
+		return ErrNotBzip2
+	}
+
+	z.bits = bitlib.NewReader(z.r)
+	z.maxBlock = level * 100000
+	z.streamCRC = 0
+
+	return nil
+}
+
+// Read decompresses into p, decoding the next block when the current one has
+// been consumed.
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.pending, z.err = z.nextBlock()
+	}
+
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+
+	return n, nil
+}
+
+// Close releases the Reader. It does not close the underlying reader.
+func (z *Reader) Close() error {
+	if errors.Is(z.err, io.EOF) {
+		return nil
+	}
+
+	return z.err
+}
+
+// corrupt wraps an error decoding the current block in a
+// *formatlib.CorruptionError.
+func (z *Reader) corrupt(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = formatlib.ErrTruncated
+	}
+
+	return &formatlib.CorruptionError{Block: z.index, Offset: z.offset, Err: err}
+}
+
+// nextBlock decodes the next block. At the end of a stream it checks the
+// stream CRC and moves on to the next concatenated stream, if any.
+func (z *Reader) nextBlock() ([]byte, error) {
+	for {
+		high, err := z.bits.ReadBits(24)
+		if err != nil {
+			return nil, z.corrupt(err)
+		}
+
+		low, err := z.bits.ReadBits(24)
+		if err != nil {
+			return nil, z.corrupt(err)
+		}
+
+		switch magic := high<<24 | low; magic {
+		case blockMagic:
+			return z.readBlock()
+		case endMagic:
+		default:
+			return nil, z.corrupt(fmt.Errorf("bad block magic %#012x", magic))
+		}
+
+		expected, err := z.bits.ReadBits(32)
+		if err != nil {
+			return nil, z.corrupt(err)
+		}
+
+		if uint32(expected) != z.streamCRC {
+			return nil, z.corrupt(crcMismatch(uint32(expected), z.streamCRC))
+		}
+
+		// Streams end on a byte boundary, and another may follow.
+		z.bits.Align()
+		if _, err := z.r.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+
+			return nil, err
+		}
+
+		if err := z.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func crcMismatch(expected, actual uint32) error {
+	return fmt.Errorf("%w: expected %#08x, got %#08x", formatlib.ErrChecksum, expected, actual)
+}
+
+// readBlock decodes a block after its magic number, reversing encodeBlock and
+// then RLE1.
+func (z *Reader) readBlock() ([]byte, error) {
+	expected, err := z.bits.ReadBits(32)
+	if err != nil {
+		return nil, z.corrupt(err)
+	}
+
+	randomised, err := z.bits.ReadBit()
+	if err != nil {
+		return nil, z.corrupt(err)
+	}
+
+	if randomised {
+		return nil, z.corrupt(errors.New("randomised blocks are not supported"))
+	}
+
+	primary, err := z.bits.ReadBits(24)
+	if err != nil {
+		return nil, z.corrupt(err)
+	}
+
+	ranks, err := z.readRanks()
+	if err != nil {
+		return nil, z.corrupt(err)
+	}
+
+	bwtBlock := mtflib.DecodeBlock(nil, ranks.ranks)
+	for i, c := range bwtBlock {
+		bwtBlock[i] = ranks.alphabet[c]
+	}
+
+	block, err := z.inv.Invert(bwtBlock, int(primary))
+	if err != nil {
+		return nil, z.corrupt(err)
+	}
+
+	original, crc := undoRLE1(block)
+	if crc != uint32(expected) {
+		return nil, z.corrupt(crcMismatch(uint32(expected), crc))
+	}
+
+	z.streamCRC = combineCRC(z.streamCRC, crc)
+	z.index++
+	z.offset += int64(len(original))
+
+	return original, nil
+}
+
+// blockRanks holds the MTF ranks of a block along with the bytes in use,
+// which the ranks index once move to front decoded.
+type blockRanks struct {
+	alphabet []byte
+	ranks    []byte
+}
+
+// readRanks reads the Huffman tables and symbols of a block and expands the
+// runs of runA and runB into MTF ranks.
+func (z *Reader) readRanks() (blockRanks, error) {
+	alphabet, err := huffmanlib.ReadInUse(z.bits)
+	if err != nil {
+		return blockRanks{}, err
+	}
+
+	tables, err := z.bits.ReadBits(3)
+	if err != nil {
+		return blockRanks{}, err
+	}
+
+	if tables < 2 {
+		return blockRanks{}, fmt.Errorf("invalid table count %v", tables)
+	}
+
+	selectorCount, err := z.bits.ReadBits(15)
+	if err != nil {
+		return blockRanks{}, err
+	}
+
+	if selectorCount == 0 {
+		return blockRanks{}, errors.New("no table selectors")
+	}
+
+	endOfBlock := len(alphabet) + 1
+	decoders, selectors, err := huffmanlib.ReadTables(z.bits, int(tables), int(selectorCount), endOfBlock+1)
+	if err != nil {
+		return blockRanks{}, err
+	}
+
+	ranks := make([]byte, 0, z.maxBlock)
+	run := 0
+	runWeight := 1
+	for i := 0; ; i++ {
+		if i/huffmanlib.GroupSize >= len(selectors) {
+			return blockRanks{}, errors.New("block has more symbols than table selectors")
+		}
+
+		symbol, err := decoders[selectors[i/huffmanlib.GroupSize]].Decode(z.bits)
+		if err != nil {
+			return blockRanks{}, err
+		}
+
+		if symbol == runA || symbol == runB {
+			run += (symbol + 1) * runWeight
+			runWeight <<= 1
+			if run > z.maxBlock-len(ranks) {
+				return blockRanks{}, fmt.Errorf("block larger than %v bytes", z.maxBlock)
+			}
+
+			continue
+		}
+
+		for ; run > 0; run-- {
+			ranks = append(ranks, 0)
+		}
+		runWeight = 1
+
+		if symbol == endOfBlock {
+			break
+		}
+
+		if len(ranks) == z.maxBlock {
+			return blockRanks{}, fmt.Errorf("block larger than %v bytes", z.maxBlock)
+		}
+
+		ranks = append(ranks, byte(symbol-1))
+	}
+
+	return blockRanks{alphabet: alphabet, ranks: ranks}, nil
+}
+
+// undoRLE1 reverses RLE1 and returns the original block along with its CRC.
+func undoRLE1(block []byte) ([]byte, uint32) {
+	original := make([]byte, 0, len(block))
+	crc := uint32(0xffffffff)
+	repeats := 0
+	for i := 0; i < len(block); i++ {
+		c := block[i]
+		original = append(original, c)
+		crc = updateCRC(crc, c, 1)
+
+		if i > 0 && c == block[i-1] {
+			repeats++
+		} else {
+			repeats = 1
+		}
+
+		if repeats == 4 && i+1 < len(block) {
+			i++
+			count := int(block[i])
+			for j := 0; j < count; j++ {
+				original = append(original, c)
+			}
+			crc = updateCRC(crc, c, count)
+			repeats = 0
+		}
+	}
+
+	return original, ^crc
+}
@@ -0,0 +1,258 @@
+package bzip2lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/bitlib"
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/huffmanlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+)
+
+// Writer compresses data written to it into a .bz2 stream that bzip2 and
+// compress/bzip2 can read.
+type Writer struct {
+	w         *bufio.Writer
+	bits      *bitlib.Writer
+	maxBlock  int
+	block     []byte
+	blockCRC  uint32
+	streamCRC uint32
+	runByte   byte
+	runLength int
+	closed    bool
+	err       error
+}
+
+// NewWriter returns a Writer that compresses to w at DefaultLevel.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterLevel(w, DefaultLevel)
+
+	return z
+}
+
+// NewWriterLevel returns a Writer that compresses to w with blocks of level
+// times 100,000 bytes. Callers must Close the Writer to flush the final block
+// and end of stream marker.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, fmt.Errorf("invalid bzip2 level %v", level)
+	}
+
+	// bzip2 leaves room for the largest RLE1 run at the end of a block.
+	maxBlock := level*100000 - 19
+
+	z := &Writer{
+		w:        bufio.NewWriter(w),
+		maxBlock: maxBlock,
+		block:    make([]byte, 0, maxBlock),
+		blockCRC: 0xffffffff,
+	}
+	z.bits = bitlib.NewWriter(z.w)
+	for _, c := range []byte(fileMagic) {
+		z.bits.WriteBits(8, uint64(c))
+	}
+	z.bits.WriteBits(8, uint64('0'+level))
+
+	return z, nil
+}
+
+// Write compresses p, writing out each block as it fills.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	if z.closed {
+		return 0, errors.New("write to closed bzip2lib.Writer")
+	}
+
+	for i, c := range p {
+		if z.runLength > 0 && c == z.runByte && z.runLength < maxRun {
+			z.runLength++
+			continue
+		}
+
+		if z.err = z.flushRun(); z.err != nil {
+			return i, z.err
+		}
+
+		z.runByte = c
+		z.runLength = 1
+	}
+
+	return len(p), nil
+}
+
+// Close writes any buffered data and the end of stream marker. It does not
+// close the underlying writer.
+func (z *Writer) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+
+	if z.err = z.flushRun(); z.err != nil {
+		return z.err
+	}
+
+	if z.err = z.writeBlock(); z.err != nil {
+		return z.err
+	}
+
+	z.bits.WriteBits(24, endMagic>>24)
+	z.bits.WriteBits(24, endMagic&0xffffff)
+	z.bits.WriteBits(32, uint64(z.streamCRC))
+	if z.err = z.bits.Flush(); z.err != nil {
+		return z.err
+	}
+
+	z.err = z.w.Flush()
+
+	return z.err
+}
+
+// flushRun adds the pending run to the block with RLE1, which writes runs of
+// four or more bytes as four bytes and a count of the remaining repeats. The
+// block is written out first if the run does not fit.
+func (z *Writer) flushRun() error {
+	if z.runLength == 0 {
+		return nil
+	}
+
+	size := min(z.runLength, 4)
+	if z.runLength >= 4 {
+		size++
+	}
+
+	if len(z.block)+size > z.maxBlock {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	z.blockCRC = updateCRC(z.blockCRC, z.runByte, z.runLength)
+	for i := 0; i < min(z.runLength, 4); i++ {
+		z.block = append(z.block, z.runByte)
+	}
+
+	if z.runLength >= 4 {
+		z.block = append(z.block, byte(z.runLength-4))
+	}
+	z.runLength = 0
+
+	return nil
+}
+
+// writeBlock compresses and writes the buffered block, if any.
+func (z *Writer) writeBlock() error {
+	if len(z.block) == 0 {
+		return nil
+	}
+
+	crc := ^z.blockCRC
+	z.streamCRC = combineCRC(z.streamCRC, crc)
+
+	if err := encodeBlock(z.bits, z.block, crc); err != nil {
+		return err
+	}
+
+	z.block = z.block[:0]
+	z.blockCRC = 0xffffffff
+
+	return nil
+}
+
+// encodeBlock writes a block of RLE1 coded data to bits. The block is
+// transformed with the BWT, mapped onto the bytes in use, move to front coded
+// and then Huffman coded with runs of zero ranks written as runA and runB.
+func encodeBlock(bits *bitlib.Writer, block []byte, crc uint32) error {
+	bwtBlock, primary := bwtlib.BWTIndexed(block)
+
+	var inUse [256]bool
+	for _, c := range block {
+		inUse[c] = true
+	}
+
+	// mtflib starts from the identity order, so once the block is mapped onto
+	// the bytes in use its ranks match those bzip2 computes.
+	var dense [256]byte
+	used := 0
+	for c := range inUse {
+		if inUse[c] {
+			dense[c] = byte(used)
+			used++
+		}
+	}
+
+	for i, c := range bwtBlock {
+		bwtBlock[i] = dense[c]
+	}
+
+	symbols := runSymbols(mtflib.EncodeBlock(nil, bwtBlock), used)
+	lengths, selectors := huffmanlib.Tables(symbols, used+2)
+
+	bits.WriteBits(24, blockMagic>>24)
+	bits.WriteBits(24, blockMagic&0xffffff)
+	bits.WriteBits(32, uint64(crc))
+	// bzip2 0.9.5 and later never randomise blocks.
+	bits.WriteBit(false)
+	bits.WriteBits(24, uint64(primary))
+	huffmanlib.WriteInUse(bits, &inUse)
+	bits.WriteBits(3, uint64(len(lengths)))
+	bits.WriteBits(15, uint64(len(selectors)))
+	huffmanlib.WriteTables(bits, lengths, selectors)
+
+	codes := make([][]uint32, len(lengths))
+	for t := range codes {
+		codes[t] = huffmanlib.CanonicalCodes(lengths[t])
+	}
+
+	for i, symbol := range symbols {
+		t := selectors[i/huffmanlib.GroupSize]
+		bits.WriteBits(uint(lengths[t][symbol]), uint64(codes[t][symbol]))
+	}
+
+	return nil
+}
+
+// runSymbols converts MTF ranks into bzip2 symbols. Runs of zero ranks are
+// written with runA and runB, other ranks are shifted up by one and the block
+// ends with the symbol after the highest rank.
+func runSymbols(ranks []byte, used int) []int {
+	symbols := make([]int, 0, len(ranks)+1)
+	zeros := 0
+	for _, rank := range ranks {
+		if rank == 0 {
+			zeros++
+			continue
+		}
+
+		symbols = appendRun(symbols, zeros)
+		zeros = 0
+		symbols = append(symbols, int(rank)+1)
+	}
+
+	symbols = appendRun(symbols, zeros)
+
+	return append(symbols, used+1)
+}
+
+// appendRun appends a run of zero ranks written in bijective base 2, least
+// significant digit first.
+func appendRun(symbols []int, run int) []int {
+	for run > 0 {
+		if run&1 == 1 {
+			symbols = append(symbols, runA)
+			run = (run - 1) / 2
+		} else {
+			symbols = append(symbols, runB)
+			run = (run - 2) / 2
+		}
+	}
+
+	return symbols
+}
@@ -0,0 +1,269 @@
+package compresslib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Params are the parameters of a run length coding.
+type Params struct {
+	Mode           Mode
+	MinRun         int
+	RunLengthBytes int
+}
+
+// AutoCandidates lists the parameters CompressAuto chooses between.
+var AutoCandidates = []Params{
+	{Mode: ModeFixed, MinRun: 4, RunLengthBytes: 1},
+	{Mode: ModeFixed, MinRun: 3, RunLengthBytes: 1},
+	{Mode: ModeFixed, MinRun: 2, RunLengthBytes: 1},
+	{Mode: ModeFixed, MinRun: 4, RunLengthBytes: 2},
+	{Mode: ModeFixed, MinRun: 3, RunLengthBytes: 2},
+	{Mode: ModeFixed, MinRun: 2, RunLengthBytes: 2},
+	{Mode: ModeVarint, MinRun: 4},
+	{Mode: ModeVarint, MinRun: 3},
+	{Mode: ModeVarint, MinRun: 2},
+	{Mode: ModeZeroRun},
+}
+
+// autoHeaderSize is the size of the parameters written before each block by
+// CompressAuto: the mode, minRun and runLengthBytes.
+const autoHeaderSize = 3
+
+// maxParamMinRun is the largest MinRun that fits in the byte headers store it
+// in.
+const maxParamMinRun = 255
+
+// Validate checks that data compressed with p can be decompressed, as they
+// may have been configured by a caller or read from a corrupt block. Runs
+// shorter than 2 bytes cannot be told apart from single bytes, so MinRun must
+// be at least 2, and it is stored in a byte, so it must be at most
+// maxParamMinRun. RunLengthBytes must be at most 7 so that the longest run a
+// count can describe fits in an int.
+func (p Params) Validate() error {
+	switch p.Mode {
+	case ModeFixed:
+		if p.MinRun < 2 || p.MinRun > maxParamMinRun || p.RunLengthBytes < 1 || p.RunLengthBytes > 7 {
+			return fmt.Errorf("invalid fixed rle parameters %v and %v", p.MinRun, p.RunLengthBytes)
+		}
+	case ModeVarint:
+		if p.MinRun < 2 || p.MinRun > maxParamMinRun {
+			return fmt.Errorf("invalid varint rle parameter %v", p.MinRun)
+		}
+	case ModeZeroRun:
+	default:
+		return fmt.Errorf("%w: %v", ErrUnknownMode, byte(p.Mode))
+	}
+
+	return nil
+}
+
+// runSize returns the number of bytes p codes a run of runLength copies of
+// runChar in.
+func (p Params) runSize(runChar byte, runLength int) int {
+	switch p.Mode {
+	case ModeFixed:
+		// Compress splits runs too long for their count.
+		maxRunLength := getMaxRunLength(p.MinRun, p.RunLengthBytes)
+		if maxRunLength < math.MaxInt {
+			maxRunLength--
+		}
+
+		full, rest := runLength/maxRunLength, runLength%maxRunLength
+		size := full * (p.MinRun + p.RunLengthBytes)
+		if rest < p.MinRun {
+			return size + rest
+		}
+
+		return size + p.MinRun + p.RunLengthBytes
+	case ModeVarint:
+		if runLength < p.MinRun {
+			return runLength
+		}
+
+		return p.MinRun + varintSize(runLength-p.MinRun)
+	default:
+		if runChar == 0 {
+			// A run of n zeros has floor(log2(n+1)) bijective digits.
+			return bits.Len(uint(runLength)+1) - 1
+		}
+
+		if runChar >= zeroRunEscape-1 {
+			return 2 * runLength
+		}
+
+		return runLength
+	}
+}
+
+// varintSize returns the number of bytes x takes as a varint.
+func varintSize(x int) int {
+	return max(1, (bits.Len(uint(x))+6)/7)
+}
+
+// ChooseParams returns the candidate from AutoCandidates that codes block in
+// the fewest bytes, along with that number of bytes. The sizes are worked out
+// from the runs in block rather than by compressing it with each candidate.
+func ChooseParams(block []byte) (Params, int) {
+	sizes := make([]int, len(AutoCandidates))
+	for i := 0; i < len(block); {
+		j := i + 1
+		for j < len(block) && block[j] == block[i] {
+			j++
+		}
+
+		for k, p := range AutoCandidates {
+			sizes[k] += p.runSize(block[i], j-i)
+		}
+		i = j
+	}
+
+	best := 0
+	for k, size := range sizes {
+		if size < sizes[best] {
+			best = k
+		}
+	}
+
+	return AutoCandidates[best], sizes[best]
+}
+
+// autoSampleSize is the number of bytes at the start of its input that
+// CompressAuto chooses the parameters from.
+const autoSampleSize = 1 << 20
+
+// appendHeader appends the parameters as CompressAuto writes them to dst.
+func (p Params) appendHeader(dst []byte) []byte {
+	return append(dst, byte(p.Mode), byte(p.MinRun), byte(p.RunLengthBytes))
+}
+
+// encoder returns the blockEncoder for p, which must be valid and not
+// ModeAuto.
+func (p Params) encoder() blockEncoder {
+	switch p.Mode {
+	case ModeZeroRun:
+		return &zeroRunEncoder{}
+	case ModeVarint:
+		return &varintEncoder{minRun: p.MinRun}
+	default:
+		return newFixedEncoder(p.MinRun, p.RunLengthBytes)
+	}
+}
+
+// decoder returns the blockDecoder for p, which must be valid and not
+// ModeAuto.
+func (p Params) decoder() blockDecoder {
+	switch p.Mode {
+	case ModeZeroRun:
+		return &zeroRunDecoder{}
+	case ModeVarint:
+		return &varintDecoder{minRun: p.MinRun}
+	default:
+		return &fixedDecoder{minRun: p.MinRun, runLengthBytes: p.RunLengthBytes}
+	}
+}
+
+// autoDecoder is the blockDecoder for DecompressAuto, which reads the
+// parameters before decoding with them.
+type autoDecoder struct {
+	header  []byte
+	decoder blockDecoder
+}
+
+func (d *autoDecoder) decode(dst, src []byte, limit int) ([]byte, int, error) {
+	i := 0
+	for d.decoder == nil && i < len(src) {
+		d.header = append(d.header, src[i])
+		i++
+		if len(d.header) < autoHeaderSize {
+			continue
+		}
+
+		p := Params{Mode: Mode(d.header[0]), MinRun: int(d.header[1]), RunLengthBytes: int(d.header[2])}
+		if err := p.Validate(); err != nil {
+			return dst, i, err
+		}
+		d.decoder = p.decoder()
+	}
+
+	if d.decoder == nil {
+		return dst, i, nil
+	}
+
+	dst, n, err := d.decoder.decode(dst, src[i:], limit)
+
+	return dst, i + n, err
+}
+
+func (d *autoDecoder) finish() error {
+	if d.decoder != nil {
+		return d.decoder.finish()
+	}
+
+	if len(d.header) > 0 {
+		return errors.New("expected rle parameters, got eof")
+	}
+
+	return nil
+}
+
+// EncodeAutoBlock appends the coding of src to dst as CompressAuto writes it,
+// choosing the parameters from all of src, and returns the extended slice.
+func EncodeAutoBlock(dst, src []byte) []byte {
+	if len(src) == 0 {
+		return dst
+	}
+
+	p, _ := ChooseParams(src)
+
+	return encodeBlock(p.encoder(), p.appendHeader(dst), src)
+}
+
+// DecodeAutoBlock reverses EncodeAutoBlock, appending to dst. On error it
+// returns dst extended with the bytes decoded so far.
+func DecodeAutoBlock(dst, src []byte) ([]byte, error) {
+	return decodeBlock(&autoDecoder{}, dst, src, math.MaxInt)
+}
+
+// CompressAuto will compress a byte stream with whichever of AutoCandidates
+// codes it in the fewest bytes, writing the parameters chosen first so that
+// DecompressAuto need not be given them. The choice is made from the first
+// autoSampleSize bytes of input, and the rest is streamed with the same
+// parameters.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func CompressAuto(input io.ByteReader, output io.Writer) (int, int, error) {
+	sample := make([]byte, autoSampleSize)
+	n, readErr := readChunk(input, sample)
+	if readErr != nil && !errors.Is(readErr, io.EOF) {
+		return n, 0, readErr
+	}
+
+	if n == 0 {
+		return 0, 0, nil
+	}
+
+	p, _ := ChooseParams(sample[:n])
+	e := p.encoder()
+	encoded := e.encode(p.appendHeader(nil), sample[:n])
+	if readErr != nil {
+		encoded = e.flush(encoded)
+	}
+
+	outBytes, err := output.Write(encoded)
+	if err != nil || readErr != nil {
+		return n, outBytes, err
+	}
+
+	inBytes, m, err := encodeStream(input, output, e)
+
+	return n + inBytes, outBytes + m, err
+}
+
+// DecompressAuto will decompress the input stream written by CompressAuto
+// with the parameters it starts with, and write to the output.
+func DecompressAuto(input io.ByteReader, output io.Writer) (int, int, error) {
+	return decodeStream(input, output, &autoDecoder{})
+}
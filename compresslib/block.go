@@ -0,0 +1,209 @@
+package compresslib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/exp/slices"
+)
+
+// streamChunkSize is the number of bytes the stream functions read, and at
+// most the number of bytes they decode, at a time.
+const streamChunkSize = 64 * 1024
+
+// blockEncoder codes a stream of blocks, carrying any run left open at the end
+// of one block over to the next.
+type blockEncoder interface {
+	// encode appends the coding of src to dst, keeping the last run until the
+	// next call or flush.
+	encode(dst, src []byte) []byte
+	// flush appends the coding of the run kept by encode to dst.
+	flush(dst []byte) []byte
+}
+
+// blockDecoder reverses a blockEncoder, carrying any code left unfinished at
+// the end of one block over to the next.
+type blockDecoder interface {
+	// decode appends the bytes coded by src to dst, stopping once it has
+	// appended limit bytes, and returns the extended slice and the number of
+	// bytes of src it used. On error it returns dst extended with the bytes
+	// decoded so far.
+	decode(dst, src []byte, limit int) ([]byte, int, error)
+	// finish checks that the input did not end part way through a code, once
+	// it has all been passed to decode. Any run still to be appended is
+	// appended by further calls to decode.
+	finish() error
+}
+
+// pendingRun is a run a blockDecoder has read the length of but not yet
+// appended, as a run coded in a few bytes may be longer than limit.
+type pendingRun struct {
+	c byte
+	n int
+}
+
+// appendTo appends up to limit bytes of the run to dst.
+func (r *pendingRun) appendTo(dst []byte, limit int) []byte {
+	n := min(r.n, limit)
+	r.n -= n
+
+	return appendRepeat(dst, r.c, n)
+}
+
+// appendRepeat appends n copies of c to dst.
+func appendRepeat(dst []byte, c byte, n int) []byte {
+	start := len(dst)
+	dst = slices.Grow(dst, n)[:start+n]
+	for i := start; i < len(dst); i++ {
+		dst[i] = c
+	}
+
+	return dst
+}
+
+// encodeBlock appends the coding of src with e to dst.
+func encodeBlock(e blockEncoder, dst, src []byte) []byte {
+	return e.flush(e.encode(dst, src))
+}
+
+// decodeBlock appends the bytes coded by src with d to dst, returning an
+// error once it has decoded more than maxSize bytes.
+func decodeBlock(d blockDecoder, dst, src []byte, maxSize int) ([]byte, error) {
+	// Decoding one byte past maxSize tells a block that is too large from
+	// one that fills it exactly.
+	limit := maxSize
+	if limit < math.MaxInt {
+		limit++
+	}
+
+	start := len(dst)
+	dst, _, err := d.decode(dst, src, limit)
+	if err == nil && len(dst)-start < limit {
+		err = d.finish()
+		if err == nil {
+			dst, _, err = d.decode(dst, nil, limit-(len(dst)-start))
+		}
+	}
+
+	if err == nil && len(dst)-start > maxSize {
+		err = fmt.Errorf("decoded block exceeds the maximum of %v bytes", maxSize)
+	}
+
+	return dst, err
+}
+
+// readChunk reads from input until chunk is full, returning the number of
+// bytes read. It returns io.EOF once input is exhausted. Inputs that also
+// implement io.Reader are read a chunk at a time.
+func readChunk(input io.ByteReader, chunk []byte) (int, error) {
+	if r, ok := input.(io.Reader); ok {
+		n, err := io.ReadFull(r, chunk)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+
+		return n, err
+	}
+
+	for i := range chunk {
+		x, err := input.ReadByte()
+		if err != nil {
+			return i, err
+		}
+
+		chunk[i] = x
+	}
+
+	return len(chunk), nil
+}
+
+// encodeStream reads input a chunk at a time, codes it with e and writes it
+// to output.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func encodeStream(input io.ByteReader, output io.Writer, e blockEncoder) (int, int, error) {
+	chunk := make([]byte, streamChunkSize)
+	var encoded []byte
+
+	inBytes := 0
+	outBytes := 0
+	for {
+		n, readErr := readChunk(input, chunk)
+		inBytes += n
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return inBytes, outBytes, readErr
+		}
+
+		encoded = e.encode(encoded[:0], chunk[:n])
+		if readErr != nil {
+			encoded = e.flush(encoded)
+		}
+
+		n, err := output.Write(encoded)
+		outBytes += n
+		if err != nil || readErr != nil {
+			return inBytes, outBytes, err
+		}
+	}
+}
+
+// decodeStream reads input a chunk at a time, decodes it with d and writes
+// it to output.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func decodeStream(input io.ByteReader, output io.Writer, d blockDecoder) (int, int, error) {
+	chunk := make([]byte, streamChunkSize)
+	var decoded []byte
+
+	inBytes := 0
+	outBytes := 0
+	for {
+		n, readErr := readChunk(input, chunk)
+		inBytes += n
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return inBytes, outBytes, readErr
+		}
+
+		var err error
+		decoded, n, err = writeDecoded(output, d, chunk[:n], decoded)
+		outBytes += n
+		if err != nil {
+			return inBytes, outBytes, err
+		}
+
+		if readErr == nil {
+			continue
+		}
+
+		if err := d.finish(); err != nil {
+			return inBytes, outBytes, err
+		}
+
+		_, n, err = writeDecoded(output, d, nil, decoded)
+		outBytes += n
+
+		return inBytes, outBytes, err
+	}
+}
+
+// writeDecoded decodes src with d into buffer and writes it to output, at
+// most streamChunkSize bytes at a time, so that a long run coded in a few
+// bytes is not held in memory at once. It returns buffer for reuse.
+func writeDecoded(output io.Writer, d blockDecoder, src []byte, buffer []byte) ([]byte, int, error) {
+	written := 0
+	for {
+		decoded, used, err := d.decode(buffer[:0], src, streamChunkSize)
+		buffer = decoded
+		src = src[used:]
+
+		n, writeErr := output.Write(decoded)
+		written += n
+		if writeErr != nil {
+			return buffer, written, writeErr
+		}
+
+		if err != nil || len(src) == 0 && len(decoded) < streamChunkSize {
+			return buffer, written, err
+		}
+	}
+}
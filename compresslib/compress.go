@@ -1,147 +1,173 @@
 package compresslib
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 )
 
-func encodeRunLength(runLength int, runLengthBytes int) []byte {
-	runLengthBuffer := make([]byte, 8)
-	binary.LittleEndian.PutUint64(runLengthBuffer, uint64(runLength))
-
-	return runLengthBuffer[:runLengthBytes]
-}
-
+// getMaxRunLength returns the length of the first run too long for a count of
+// runLengthBytes, or math.MaxInt if every run fits.
 func getMaxRunLength(minRun int, runLengthBytes int) int {
+	if runLengthBytes >= 7 {
+		return math.MaxInt
+	}
+
 	return 1<<(8*runLengthBytes) + minRun
 }
 
-func encodeRun(runLength int, runChar byte, minRun int, runLengthBytes int) []byte {
+// appendRun appends a run of runLength copies of runChar, as minRun copies
+// followed by the rest of the run length in runLengthBytes if it is long
+// enough.
+func appendRun(dst []byte, runLength int, runChar byte, minRun int, runLengthBytes int) []byte {
 	if runLength < minRun {
-		return bytes.Repeat([]byte{runChar}, runLength)
+		return appendRepeat(dst, runChar, runLength)
 	}
 
-	return append(bytes.Repeat([]byte{runChar}, minRun), encodeRunLength(runLength-minRun, runLengthBytes)...)
+	var runLengthBuffer [8]byte
+	binary.LittleEndian.PutUint64(runLengthBuffer[:], uint64(runLength-minRun))
+	dst = appendRepeat(dst, runChar, minRun)
+
+	return append(dst, runLengthBuffer[:runLengthBytes]...)
 }
 
-// Compress will compress a byte stream and output to another byte stream.
-// Returns the number of bytes read, the number of bytes output and any errors.
-func Compress(input io.ByteReader, output io.Writer, minRun int, runLengthBytes int) (int, int, error) {
-	maxRunLength := getMaxRunLength(minRun, runLengthBytes)
+// fixedEncoder is the blockEncoder for Compress.
+type fixedEncoder struct {
+	minRun         int
+	runLengthBytes int
+	splitLength    int
+	runChar        byte
+	runLength      int
+}
 
-	inBytes := 0
-	outBytes := 0
-	runChar := byte(0)
-	runLength := 0
-	for {
-		readByte, err := input.ReadByte()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+func newFixedEncoder(minRun int, runLengthBytes int) *fixedEncoder {
+	return &fixedEncoder{
+		minRun:         minRun,
+		runLengthBytes: runLengthBytes,
+		// Runs are split before they get too long for their count, but
+		// always hold at least one byte so that encode makes progress.
+		splitLength: max(getMaxRunLength(minRun, runLengthBytes)-1, 1),
+	}
+}
 
-			return inBytes, outBytes, err
-		}
-		inBytes++
-
-		if readByte != runChar || runLength >= maxRunLength-1 {
-			if runLength > 0 {
-				encodedRun := encodeRun(runLength, runChar, minRun, runLengthBytes)
-				n, err := output.Write(encodedRun)
-				outBytes += n
-				if err != nil {
-					return inBytes, outBytes, err
-				}
-			}
-			runLength = 0
-			runChar = readByte
+func (e *fixedEncoder) encode(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		if e.runLength == 0 {
+			e.runChar = src[i]
+		} else if src[i] != e.runChar || e.runLength >= e.splitLength {
+			dst = e.flush(dst)
+			continue
 		}
 
-		runLength++
-	}
-
-	if runLength > 0 {
-		encodedRun := encodeRun(runLength, runChar, minRun, runLengthBytes)
-		n, err := output.Write(encodedRun)
-		outBytes += n
-		if err != nil {
-			return inBytes, outBytes, err
+		for i < len(src) && src[i] == e.runChar && e.runLength < e.splitLength {
+			i++
+			e.runLength++
 		}
 	}
 
-	return inBytes, outBytes, nil
+	return dst
 }
 
-func readRunLength(input io.ByteReader, runLengthBytes int) (int, error) {
-	runLengthBinary := make([]byte, 8)
-
-	for i := 0; i < runLengthBytes; i++ {
-		runLengthBinaryByte, err := input.ReadByte()
-		if err != nil {
-			return 0, err
-		}
-
-		runLengthBinary[i] = runLengthBinaryByte
+func (e *fixedEncoder) flush(dst []byte) []byte {
+	if e.runLength > 0 {
+		dst = appendRun(dst, e.runLength, e.runChar, e.minRun, e.runLengthBytes)
+		e.runLength = 0
 	}
 
-	runLength := binary.LittleEndian.Uint64(runLengthBinary)
+	return dst
+}
 
-	return int(runLength), nil
+// fixedDecoder is the blockDecoder for Decompress.
+type fixedDecoder struct {
+	minRun         int
+	runLengthBytes int
+	runChar        byte
+	runLength      int
+	counting       bool
+	count          [8]byte
+	countBytes     int
+	run            pendingRun
 }
 
-// Decompress will decompress the input stream and write to the output.
-func Decompress(input io.ByteReader, output io.Writer, minRun int, runLengthBytes int) (int, int, error) {
+func (d *fixedDecoder) decode(dst, src []byte, limit int) ([]byte, int, error) {
+	start := len(dst)
+	i := 0
+	for {
+		dst = d.run.appendTo(dst, limit-(len(dst)-start))
+		if d.run.n > 0 || i == len(src) || len(dst)-start >= limit {
+			return dst, i, nil
+		}
 
-	inBytes := 0
-	outBytes := 0
-	runChar := byte(0x00)
-	runLength := 0
+		if !d.counting {
+			readChar := src[i]
+			i++
+			dst = append(dst, readChar)
 
-	for {
-		readChar, err := input.ReadByte()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+			if readChar != d.runChar {
+				d.runLength = 1
+				d.runChar = readChar
+				continue
 			}
 
-			return inBytes, outBytes, err
-		}
-		inBytes++
-		n, err := output.Write([]byte{readChar})
-		outBytes += n
-		if err != nil {
-			return inBytes, outBytes, err
+			d.runLength++
+			if d.runLength < d.minRun {
+				continue
+			}
+			d.counting = true
 		}
 
-		if readChar != runChar {
-			runLength = 1
-			runChar = readChar
+		n := copy(d.count[d.countBytes:d.runLengthBytes], src[i:])
+		i += n
+		d.countBytes += n
+		if d.countBytes < d.runLengthBytes {
 			continue
 		}
 
-		runLength++
-		if runLength >= minRun {
-			repeatedRunLength, err := readRunLength(input, runLengthBytes)
-			inBytes += runLengthBytes
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					return inBytes, outBytes, errors.New("expected encoded run length, got eof")
-				}
+		repeatedRunLength := binary.LittleEndian.Uint64(d.count[:])
+		if repeatedRunLength > maxDecodedRunLength {
+			return dst, i, errors.New("encoded run length too long")
+		}
 
-				return inBytes, outBytes, err
-			}
+		d.run = pendingRun{c: d.runChar, n: int(repeatedRunLength)}
+		d.runLength = 0
+		d.runChar = 0x00
+		d.counting = false
+		d.count = [8]byte{}
+		d.countBytes = 0
+	}
+}
 
-			n, err := output.Write(bytes.Repeat([]byte{runChar}, repeatedRunLength))
-			outBytes += n
-			if err != nil {
-				return inBytes, outBytes, err
-			}
-			runLength = 0
-			runChar = 0x00
-		}
+func (d *fixedDecoder) finish() error {
+	if d.counting {
+		return errors.New("expected encoded run length, got eof")
 	}
 
-	return inBytes, outBytes, nil
+	return nil
+}
+
+// EncodeBlock appends the run length coding of src to dst, as Compress writes
+// it, and returns the extended slice. dst must not overlap src, as the output
+// can be longer than the input.
+func EncodeBlock(dst, src []byte, minRun int, runLengthBytes int) []byte {
+	return encodeBlock(newFixedEncoder(minRun, runLengthBytes), dst, src)
+}
+
+// DecodeBlock reverses EncodeBlock with the same parameters, appending to
+// dst. On error it returns dst extended with the bytes decoded so far.
+func DecodeBlock(dst, src []byte, minRun int, runLengthBytes int) ([]byte, error) {
+	return decodeBlock(&fixedDecoder{minRun: minRun, runLengthBytes: runLengthBytes}, dst, src, math.MaxInt)
+}
+
+// Compress will compress a byte stream and output to another byte stream.
+// It is EncodeBlock applied to streamChunkSize bytes at a time.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func Compress(input io.ByteReader, output io.Writer, minRun int, runLengthBytes int) (int, int, error) {
+	return encodeStream(input, output, newFixedEncoder(minRun, runLengthBytes))
+}
+
+// Decompress will decompress the input stream and write to the output. Like
+// Compress, it works streamChunkSize bytes at a time.
+func Decompress(input io.ByteReader, output io.Writer, minRun int, runLengthBytes int) (int, int, error) {
+	return decodeStream(input, output, &fixedDecoder{minRun: minRun, runLengthBytes: runLengthBytes})
 }
@@ -2,7 +2,11 @@ package compresslib
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"math"
+	"math/rand"
+	"os"
 	"strings"
 	"testing"
 
@@ -189,3 +193,626 @@ func TestDecompress22Empty(t *testing.T) {
 	expected := []byte{}
 	runStreamTest(t, Compress, input, expected, 2, 2)
 }
+
+// zeroRunStreamFunc adapts a zero run coder to StreamFunc, which it ignores
+// the parameters of.
+func zeroRunStreamFunc(f func(io.ByteReader, io.Writer) (int, int, error)) StreamFunc {
+	return func(input io.ByteReader, output io.Writer, _ int, _ int) (int, int, error) {
+		return f(input, output)
+	}
+}
+
+func TestCompressZeroRunsBasic(t *testing.T) {
+	// A run of 3 zeros is 1+2*1, a single zero is 1, and 0xfe and 0xff are
+	// escaped.
+	input := []byte("\x00\x00\x00A\x00\xfe\xff")
+	expected := []byte("\x00\x00B\x00\xff\x00\xff\x01")
+	runStreamTest(t, zeroRunStreamFunc(CompressZeroRuns), input, expected, 0, 0)
+	runStreamTest(t, zeroRunStreamFunc(DecompressZeroRuns), expected, input, 0, 0)
+}
+
+func TestCompressZeroRunsRunLengths(t *testing.T) {
+	cases := []struct {
+		run      int
+		expected []byte
+	}{
+		{1, []byte{RunA}},
+		{2, []byte{RunB}},
+		{3, []byte{RunA, RunA}},
+		{4, []byte{RunB, RunA}},
+		{5, []byte{RunA, RunB}},
+		{6, []byte{RunB, RunB}},
+		{7, []byte{RunA, RunA, RunA}},
+	}
+
+	for _, c := range cases {
+		input := append(make([]byte, c.run), 0x01)
+		expected := append(c.expected, 0x02)
+		runStreamTest(t, zeroRunStreamFunc(CompressZeroRuns), input, expected, 0, 0)
+		runStreamTest(t, zeroRunStreamFunc(DecompressZeroRuns), expected, input, 0, 0)
+	}
+}
+
+func TestCompressZeroRunsLongRun(t *testing.T) {
+	// A run is never split, and takes about log2 of its length in bytes.
+	input := make([]byte, 1<<20+12345)
+
+	var compressed bytes.Buffer
+	_, _, err := CompressZeroRuns(bytes.NewReader(input), &compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, compressed.Len())
+
+	var decompressed bytes.Buffer
+	inBytes, outBytes, err := DecompressZeroRuns(bytes.NewReader(compressed.Bytes()), &decompressed)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, inBytes)
+	assert.Equal(t, len(input), outBytes)
+	assert.Equal(t, input, decompressed.Bytes())
+}
+
+func TestCompressZeroRunsAllBytes(t *testing.T) {
+	var input []byte
+	for i := 0; i < 256; i++ {
+		input = append(input, byte(i), 0, 0, byte(i), byte(i))
+	}
+
+	var compressed bytes.Buffer
+	_, _, err := CompressZeroRuns(bytes.NewReader(input), &compressed)
+	assert.NoError(t, err)
+
+	var decompressed bytes.Buffer
+	_, _, err = DecompressZeroRuns(bytes.NewReader(compressed.Bytes()), &decompressed)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decompressed.Bytes())
+}
+
+func TestCompressZeroRunsEmpty(t *testing.T) {
+	runStreamTest(t, zeroRunStreamFunc(CompressZeroRuns), []byte{}, []byte{}, 0, 0)
+	runStreamTest(t, zeroRunStreamFunc(DecompressZeroRuns), []byte{}, []byte{}, 0, 0)
+}
+
+func TestDecompressZeroRunsMalformed(t *testing.T) {
+	for _, input := range [][]byte{
+		[]byte("A\xff"),
+		[]byte("A\xff\x02"),
+		bytes.Repeat([]byte{RunB}, 32),
+	} {
+		_, _, err := DecompressZeroRuns(bytes.NewReader(input), io.Discard)
+		assert.Error(t, err)
+	}
+}
+
+// varintStreamFunc adapts CompressVarint and DecompressVarint to StreamFunc,
+// which ignores runLengthBytes.
+func varintStreamFunc(f func(io.ByteReader, io.Writer, int) (int, int, error)) StreamFunc {
+	return func(input io.ByteReader, output io.Writer, minRun int, _ int) (int, int, error) {
+		return f(input, output, minRun)
+	}
+}
+
+func TestCompressVarintBasic(t *testing.T) {
+	input := []byte("Test    !!")
+	expected := []byte("Test  \x02!!\x00")
+	runStreamTest(t, varintStreamFunc(CompressVarint), input, expected, 2, 0)
+	runStreamTest(t, varintStreamFunc(DecompressVarint), expected, input, 2, 0)
+}
+
+func TestCompressVarintLongRun(t *testing.T) {
+	// 300 extra Bs take two bytes rather than splitting the run.
+	input := []byte("A" + strings.Repeat("B", 302) + "C")
+	expected := []byte("ABB\xac\x02C")
+	runStreamTest(t, varintStreamFunc(CompressVarint), input, expected, 2, 0)
+	runStreamTest(t, varintStreamFunc(DecompressVarint), expected, input, 2, 0)
+}
+
+func TestCompressVarintVeryLongRun(t *testing.T) {
+	input := bytes.Repeat([]byte{'x'}, 1<<21+4)
+	expected := []byte("xxxx\x80\x80\x80\x01")
+	runStreamTest(t, varintStreamFunc(CompressVarint), input, expected, 4, 0)
+	runStreamTest(t, varintStreamFunc(DecompressVarint), expected, input, 4, 0)
+}
+
+func TestCompressVarintMinRun(t *testing.T) {
+	input := []byte("ABBBCCCCD")
+	for minRun := 1; minRun <= 5; minRun++ {
+		var compressed bytes.Buffer
+		_, _, err := CompressVarint(bytes.NewReader(input), &compressed, minRun)
+		assert.NoError(t, err)
+
+		var decompressed bytes.Buffer
+		_, _, err = DecompressVarint(bytes.NewReader(compressed.Bytes()), &decompressed, minRun)
+		assert.NoError(t, err)
+		assert.Equal(t, input, decompressed.Bytes())
+	}
+}
+
+func TestCompressVarintEmpty(t *testing.T) {
+	runStreamTest(t, varintStreamFunc(CompressVarint), []byte{}, []byte{}, 2, 0)
+	runStreamTest(t, varintStreamFunc(DecompressVarint), []byte{}, []byte{}, 2, 0)
+}
+
+func TestDecompressVarintMalformed(t *testing.T) {
+	for _, input := range [][]byte{
+		[]byte("AA"),
+		[]byte("AA\x80"),
+		[]byte("AA\xff\xff\xff\xff\xff\x01"),
+		append([]byte("AA"), bytes.Repeat([]byte{0x80}, 20)...),
+	} {
+		_, _, err := DecompressVarint(bytes.NewReader(input), io.Discard, 2)
+		assert.Error(t, err)
+	}
+}
+
+func TestCompressWithMode(t *testing.T) {
+	input := append([]byte("AAAAAAAA\x00\x00\x00\xffB"), make([]byte, 1000)...)
+	for _, mode := range Modes {
+		var compressed bytes.Buffer
+		inBytes, outBytes, err := CompressWithMode(bytes.NewReader(input), &compressed, mode, 4, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, len(input), inBytes)
+		assert.Equal(t, compressed.Len(), outBytes)
+
+		var decompressed bytes.Buffer
+		inBytes, outBytes, err = DecompressWithMode(bytes.NewReader(compressed.Bytes()), &decompressed, mode, 4, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, compressed.Len(), inBytes)
+		assert.Equal(t, len(input), outBytes)
+		assert.Equal(t, input, decompressed.Bytes(), mode.String())
+	}
+
+	_, _, err := CompressWithMode(bytes.NewReader(input), io.Discard, Mode(len(Modes)), 4, 1)
+	assert.ErrorIs(t, err, ErrUnknownMode)
+
+	_, _, err = DecompressWithMode(bytes.NewReader(input), io.Discard, Mode(0xff), 4, 1)
+	assert.ErrorIs(t, err, ErrUnknownMode)
+}
+
+func TestBlockWithModeMatchesStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(25))
+	input := mtfLikeBlock(rng, 50000)
+	input = append(input, make([]byte, 200000)...)
+	input = append(input, strings.Repeat("\xfe\xff", 1000)...)
+	input = append(input, strings.Repeat("B", 300000)...)
+
+	for _, mode := range Modes {
+		var expected bytes.Buffer
+		_, _, err := CompressWithMode(byteReader{bytes.NewReader(input)}, &expected, mode, 3, 2)
+		assert.NoError(t, err)
+
+		encoded, err := EncodeBlockWithMode([]byte("prefix"), input, mode, 3, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Bytes(), encoded[6:], mode.String())
+
+		decoded, err := DecodeBlockWithMode([]byte("prefix"), encoded[6:], mode, 3, 2, math.MaxInt)
+		assert.NoError(t, err)
+		assert.Equal(t, "prefix", string(decoded[:6]))
+		assert.Equal(t, input, decoded[6:], mode.String())
+
+		var decompressed bytes.Buffer
+		inBytes, outBytes, err := DecompressWithMode(byteReader{bytes.NewReader(encoded[6:])}, &decompressed, mode, 3, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, len(encoded)-6, inBytes)
+		assert.Equal(t, len(input), outBytes)
+		assert.Equal(t, input, decompressed.Bytes(), mode.String())
+
+		// Zero run codings can be cut short between any two codes.
+		if mode != ModeZeroRun {
+			_, err = DecodeBlockWithMode(nil, encoded[6:len(encoded)-1], mode, 3, 2, math.MaxInt)
+			assert.Error(t, err, mode.String())
+		}
+	}
+
+	_, err := DecodeZeroRunBlock(nil, []byte{zeroRunEscape})
+	assert.Error(t, err)
+
+	_, err = EncodeBlockWithMode(nil, input, Mode(len(Modes)), 3, 2)
+	assert.ErrorIs(t, err, ErrUnknownMode)
+
+	_, err = DecodeBlockWithMode(nil, input, Mode(0xff), 3, 2, math.MaxInt)
+	assert.ErrorIs(t, err, ErrUnknownMode)
+}
+
+func TestDecodeBlockWithModeMaxSize(t *testing.T) {
+	// The fixed and varint codings end with a count of 0 once the block is
+	// full.
+	input := append(make([]byte, 1000), "BBB"...)
+	for _, mode := range Modes {
+		encoded, err := EncodeBlockWithMode(nil, input, mode, 3, 2)
+		assert.NoError(t, err)
+
+		decoded, err := DecodeBlockWithMode([]byte("prefix"), encoded, mode, 3, 2, len(input))
+		assert.NoError(t, err, mode.String())
+		assert.Equal(t, input, decoded[6:], mode.String())
+
+		_, err = DecodeBlockWithMode(nil, encoded, mode, 3, 2, len(input)-1)
+		assert.ErrorContains(t, err, "exceeds the maximum", mode.String())
+	}
+
+	// 30 bytes code a run of 2 GiB of zeros, which is rejected once it
+	// passes maxSize rather than allocated.
+	decoded, err := DecodeBlockWithMode(nil, bytes.Repeat([]byte{RunB}, 30), ModeZeroRun, 0, 0, 1<<20)
+	assert.ErrorContains(t, err, "exceeds the maximum")
+	assert.Equal(t, 1<<20+1, len(decoded))
+}
+
+// sizeWriter records the size of each write.
+type sizeWriter struct {
+	sizes []int
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+
+	return len(p), nil
+}
+
+func TestDecompressLongRunsInChunks(t *testing.T) {
+	for _, mode := range []Mode{ModeFixed, ModeZeroRun, ModeVarint} {
+		encoded, err := EncodeBlockWithMode(nil, make([]byte, 1000000), mode, 4, 4)
+		assert.NoError(t, err)
+
+		var output sizeWriter
+		_, outBytes, err := DecompressWithMode(bytes.NewReader(encoded), &output, mode, 4, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000000, outBytes)
+		for _, size := range output.sizes {
+			assert.True(t, size <= streamChunkSize, mode.String())
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range Modes {
+		parsed, err := ParseMode(mode.String())
+		assert.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	_, err := ParseMode("rle")
+	assert.ErrorIs(t, err, ErrUnknownMode)
+}
+
+// mtfLikeBlock returns a block of mostly short runs of zeros between small
+// bytes, with a few long runs and high bytes, like the output of mtflib.
+func mtfLikeBlock(rng *rand.Rand, size int) []byte {
+	block := make([]byte, 0, size)
+	for len(block) < size {
+		switch r := rng.Intn(100); {
+		case r < 50:
+			block = append(block, make([]byte, rng.Intn(8))...)
+		case r < 52:
+			block = append(block, bytes.Repeat([]byte{byte(rng.Intn(3))}, rng.Intn(2000))...)
+		case r < 55:
+			block = append(block, byte(rng.Intn(256)))
+		default:
+			block = append(block, byte(1+rng.Intn(8)))
+		}
+	}
+
+	return block[:size]
+}
+
+func TestChooseParamsSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(23))
+	inputs := [][]byte{
+		[]byte("Test    !!"),
+		make([]byte, 70000),
+		bytes.Repeat([]byte{0xff}, 600),
+		mtfLikeBlock(rng, 10000),
+		mtfLikeBlock(rng, 100000),
+	}
+
+	for _, input := range inputs {
+		best := math.MaxInt
+		for _, p := range AutoCandidates {
+			var compressed bytes.Buffer
+			_, _, err := CompressWithMode(bytes.NewReader(input), &compressed, p.Mode, p.MinRun, p.RunLengthBytes)
+			assert.NoError(t, err)
+
+			size := 0
+			for i := 0; i < len(input); {
+				j := i + 1
+				for j < len(input) && input[j] == input[i] {
+					j++
+				}
+				size += p.runSize(input[i], j-i)
+				i = j
+			}
+
+			assert.Equal(t, compressed.Len(), size, p)
+			best = min(best, size)
+		}
+
+		_, size := ChooseParams(input)
+		assert.Equal(t, best, size)
+	}
+}
+
+func TestChooseParams(t *testing.T) {
+	// Each pair of zeros takes a byte, where the other modes take two.
+	p, size := ChooseParams(bytes.Repeat([]byte{0, 0, 1}, 100))
+	assert.Equal(t, Params{Mode: ModeZeroRun}, p)
+	assert.Equal(t, 200, size)
+
+	p, size = ChooseParams(make([]byte, 1000))
+	assert.Equal(t, Params{Mode: ModeFixed, MinRun: 2, RunLengthBytes: 2}, p)
+	assert.Equal(t, 4, size)
+
+	p, size = ChooseParams([]byte("A" + strings.Repeat("B", 1000) + "C"))
+	assert.Equal(t, Params{Mode: ModeFixed, MinRun: 2, RunLengthBytes: 2}, p)
+	assert.Equal(t, 6, size)
+
+	// Ties go to the earliest candidate.
+	p, size = ChooseParams([]byte("abcdefg"))
+	assert.Equal(t, AutoCandidates[0], p)
+	assert.Equal(t, 7, size)
+}
+
+func TestCompressAuto(t *testing.T) {
+	rng := rand.New(rand.NewSource(24))
+	inputs := [][]byte{
+		{0x00},
+		{0xff},
+		[]byte("Test    !!"),
+		make([]byte, 70000),
+		[]byte("A" + strings.Repeat("B", 100000) + "C"),
+		mtfLikeBlock(rng, 50000),
+	}
+
+	for _, input := range inputs {
+		var compressed bytes.Buffer
+		inBytes, outBytes, err := CompressAuto(bytes.NewReader(input), &compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, len(input), inBytes)
+		assert.Equal(t, compressed.Len(), outBytes)
+
+		p, size := ChooseParams(input)
+		assert.Equal(t, []byte{byte(p.Mode), byte(p.MinRun), byte(p.RunLengthBytes)}, compressed.Bytes()[:3])
+		assert.Equal(t, 3+size, compressed.Len())
+
+		var decompressed bytes.Buffer
+		inBytes, outBytes, err = DecompressAuto(bytes.NewReader(compressed.Bytes()), &decompressed)
+		assert.NoError(t, err)
+		assert.Equal(t, compressed.Len(), inBytes)
+		assert.Equal(t, len(input), outBytes)
+		assert.Equal(t, input, decompressed.Bytes())
+	}
+}
+
+func TestCompressAutoSample(t *testing.T) {
+	// The runs after the sample would be coded better with a varint, but the
+	// parameters are chosen from the sample alone.
+	input := append([]byte(strings.Repeat("ABCD", autoSampleSize/4)), make([]byte, 1000000)...)
+
+	var compressed bytes.Buffer
+	inBytes, _, err := CompressAuto(byteReader{bytes.NewReader(input)}, &compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, len(input), inBytes)
+
+	p, _ := ChooseParams(input[:autoSampleSize])
+	assert.Equal(t, []byte{byte(p.Mode), byte(p.MinRun), byte(p.RunLengthBytes)}, compressed.Bytes()[:3])
+
+	var decompressed bytes.Buffer
+	_, _, err = DecompressAuto(bytes.NewReader(compressed.Bytes()), &decompressed)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decompressed.Bytes())
+}
+
+func TestCompressAutoEmpty(t *testing.T) {
+	runStreamTest(t, zeroRunStreamFunc(CompressAuto), []byte{}, []byte{}, 0, 0)
+	runStreamTest(t, zeroRunStreamFunc(DecompressAuto), []byte{}, []byte{}, 0, 0)
+}
+
+func TestDecompressAutoMalformed(t *testing.T) {
+	for _, input := range [][]byte{
+		{byte(ModeFixed)},
+		{byte(ModeFixed), 4},
+		{byte(ModeFixed), 0, 1, 'A'},
+		{byte(ModeFixed), 1, 1, 'A'},
+		{byte(ModeFixed), 4, 9, 'A'},
+		{byte(ModeVarint), 0, 0, 'A'},
+		{byte(ModeVarint), 1, 0, 'A'},
+		{byte(ModeAuto), 0, 0, 'A'},
+		{0x7f, 0, 0, 'A'},
+	} {
+		_, _, err := DecompressAuto(bytes.NewReader(input), io.Discard)
+		assert.Error(t, err)
+	}
+}
+
+func TestParamsValidate(t *testing.T) {
+	for _, p := range AutoCandidates {
+		assert.NoError(t, p.Validate())
+	}
+
+	assert.NoError(t, Params{Mode: ModeFixed, MinRun: 255, RunLengthBytes: 7}.Validate())
+	assert.NoError(t, Params{Mode: ModeVarint, MinRun: 255}.Validate())
+
+	for _, p := range []Params{
+		{Mode: ModeFixed, MinRun: 1, RunLengthBytes: 1},
+		{Mode: ModeFixed, MinRun: 256, RunLengthBytes: 1},
+		{Mode: ModeFixed, MinRun: 4, RunLengthBytes: 0},
+		{Mode: ModeFixed, MinRun: 4, RunLengthBytes: 8},
+		{Mode: ModeVarint, MinRun: 1},
+		{Mode: ModeVarint, MinRun: 300},
+		{Mode: ModeAuto},
+	} {
+		assert.Error(t, p.Validate(), p)
+	}
+}
+
+func TestEncodeRLE1(t *testing.T) {
+	assert.Equal(t, []byte("AAAA\x00BBBB\x03CAAAA\xffAAAA\x01"), EncodeRLE1([]byte("AAAABBBBBBBC"+strings.Repeat("A", 264))))
+	assert.Equal(t, []byte{}, EncodeRLE1(nil))
+
+	input := append([]byte("Test    !!"), make([]byte, 10000)...)
+	decoded, err := DecodeRLE1(EncodeRLE1(input))
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded)
+}
+
+func TestDecodeRLE1Truncated(t *testing.T) {
+	_, err := DecodeRLE1([]byte("AAAA"))
+	assert.Error(t, err)
+}
+
+func TestEncodeBlockMatchesStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(25))
+	input := append(mtfLikeBlock(rng, 50000), make([]byte, 70000)...)
+	for _, p := range AutoCandidates {
+		if p.Mode != ModeFixed {
+			continue
+		}
+
+		var expected bytes.Buffer
+		_, _, err := Compress(bytes.NewReader(input), &expected, p.MinRun, p.RunLengthBytes)
+		assert.NoError(t, err)
+
+		encoded := EncodeBlock([]byte("prefix"), input, p.MinRun, p.RunLengthBytes)
+		assert.Equal(t, "prefix", string(encoded[:6]))
+		assert.Equal(t, expected.Bytes(), encoded[6:])
+
+		decoded, err := DecodeBlock([]byte("prefix"), encoded[6:], p.MinRun, p.RunLengthBytes)
+		assert.NoError(t, err)
+		assert.Equal(t, "prefix", string(decoded[:6]))
+		assert.Equal(t, input, decoded[6:])
+	}
+}
+
+func TestDecodeBlockTruncated(t *testing.T) {
+	decoded, err := DecodeBlock(nil, []byte("ABB\xffBB"), 2, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []byte("A"+strings.Repeat("B", 259)), decoded)
+
+	_, _, err = Decompress(bytes.NewReader([]byte("ABB")), io.Discard, 2, 1)
+	assert.Error(t, err)
+}
+
+func TestDecompressChunkBoundary(t *testing.T) {
+	// Move the run length of the final run across the end of the first chunk.
+	for pad := 0; pad < 4; pad++ {
+		input := []byte(strings.Repeat("AB", streamChunkSize/2)[pad:] + strings.Repeat("C", 300))
+		encoded := EncodeBlock(nil, input, 2, 2)
+
+		var decompressed bytes.Buffer
+		inBytes, outBytes, err := Decompress(byteReader{bytes.NewReader(encoded)}, &decompressed, 2, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, len(encoded), inBytes)
+		assert.Equal(t, len(input), outBytes)
+		assert.Equal(t, input, decompressed.Bytes())
+	}
+}
+
+// failingReader returns err once reader is exhausted.
+type failingReader struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func (r failingReader) ReadByte() (byte, error) {
+	readByte, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, r.err
+	}
+
+	return readByte, nil
+}
+
+func TestDecompressStreams(t *testing.T) {
+	input := []byte(strings.Repeat("AB", streamChunkSize))
+	readErr := errors.New("read failed")
+
+	var decompressed bytes.Buffer
+	_, _, err := Decompress(failingReader{bytes.NewReader(input), readErr}, &decompressed, 2, 1)
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, input, decompressed.Bytes())
+}
+
+func TestEncodeBlockLongCounts(t *testing.T) {
+	input := []byte("ab" + strings.Repeat("c", 100000))
+	for runLengthBytes := 1; runLengthBytes <= 8; runLengthBytes++ {
+		decoded, err := DecodeBlock(nil, EncodeBlock(nil, input, 2, runLengthBytes), 2, runLengthBytes)
+		assert.NoError(t, err)
+		assert.Equal(t, input, decoded)
+	}
+
+	// Parameters Validate rejects must still terminate.
+	assert.Equal(t, []byte("a\x00b\x00"), EncodeBlock(nil, []byte("ab"), 1, 1))
+	assert.Len(t, EncodeBlock(nil, []byte("ab"), 1, 8), 18)
+	assert.Len(t, EncodeBlock(nil, []byte("ab"), 0, 0), 0)
+
+	_, _, err := Compress(bytes.NewReader([]byte("ab")), io.Discard, 1, 8)
+	assert.NoError(t, err)
+}
+
+func TestDecodeBlockRunTooLong(t *testing.T) {
+	_, err := DecodeBlock(nil, []byte("AA\xff\xff\xff\xff\xff\xff\xff\xff"), 2, 8)
+	assert.Error(t, err)
+}
+
+// byteReader hides every method of a bytes.Reader other than ReadByte.
+type byteReader struct {
+	io.ByteReader
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input = append(input, make([]byte, 100000)...)
+	encoded := EncodeBlock(nil, input, 4, 1)
+	output := make([]byte, 0, len(input))
+
+	b.Run("Block", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if output, err = DecodeBlock(output[:0], encoded, 4, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Stream", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Decompress(bytes.NewReader(encoded), bytes.NewBuffer(output[:0]), 4, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ByteStream", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Decompress(byteReader{bytes.NewReader(encoded)}, bytes.NewBuffer(output[:0]), 4, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCompress(b *testing.B) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input = append(input, make([]byte, 100000)...)
+	output := make([]byte, 0, len(input))
+
+	b.Run("Block", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			output = EncodeBlock(output[:0], input, 4, 1)
+		}
+	})
+
+	b.Run("Stream", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Compress(bytes.NewReader(input), bytes.NewBuffer(output[:0]), 4, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package compresslib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnknownMode is returned for a Mode this package does not implement,
+// such as one read from a newer container.
+var ErrUnknownMode = errors.New("unknown rle mode")
+
+// Mode selects how runs are coded.
+type Mode byte
+
+const (
+	// ModeFixed codes runs with Compress, as minRun bytes followed by a
+	// runLengthBytes count.
+	ModeFixed Mode = iota
+	// ModeZeroRun codes runs of zeros with CompressZeroRuns, ignoring minRun
+	// and runLengthBytes.
+	ModeZeroRun
+	// ModeVarint codes runs with CompressVarint, as minRun bytes followed by
+	// a varint count, ignoring runLengthBytes.
+	ModeVarint
+	// ModeAuto codes each block with EncodeAutoBlock, which chooses the mode
+	// and parameters for the block and writes them before it, ignoring
+	// minRun and runLengthBytes.
+	ModeAuto
+)
+
+// Modes lists every Mode, in order.
+var Modes = []Mode{ModeFixed, ModeZeroRun, ModeVarint, ModeAuto}
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFixed:
+		return "fixed"
+	case ModeZeroRun:
+		return "zero"
+	case ModeVarint:
+		return "varint"
+	case ModeAuto:
+		return "auto"
+	default:
+		return fmt.Sprintf("mode(%d)", byte(m))
+	}
+}
+
+// ParseMode returns the Mode with the given String.
+func ParseMode(name string) (Mode, error) {
+	for _, m := range Modes {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w %q", ErrUnknownMode, name)
+}
+
+// CompressWithMode will compress a byte stream with the given mode, passing
+// on the parameters it uses.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func CompressWithMode(input io.ByteReader, output io.Writer, mode Mode, minRun int, runLengthBytes int) (int, int, error) {
+	switch mode {
+	case ModeFixed:
+		return Compress(input, output, minRun, runLengthBytes)
+	case ModeZeroRun:
+		return CompressZeroRuns(input, output)
+	case ModeVarint:
+		return CompressVarint(input, output, minRun)
+	case ModeAuto:
+		return CompressAuto(input, output)
+	default:
+		return 0, 0, fmt.Errorf("%w: %v", ErrUnknownMode, byte(mode))
+	}
+}
+
+// DecompressWithMode reverses CompressWithMode with the same mode and
+// parameters.
+func DecompressWithMode(input io.ByteReader, output io.Writer, mode Mode, minRun int, runLengthBytes int) (int, int, error) {
+	switch mode {
+	case ModeFixed:
+		return Decompress(input, output, minRun, runLengthBytes)
+	case ModeZeroRun:
+		return DecompressZeroRuns(input, output)
+	case ModeVarint:
+		return DecompressVarint(input, output, minRun)
+	case ModeAuto:
+		return DecompressAuto(input, output)
+	default:
+		return 0, 0, fmt.Errorf("%w: %v", ErrUnknownMode, byte(mode))
+	}
+}
+
+// EncodeBlockWithMode appends the coding of src with the given mode to dst, as
+// CompressWithMode writes it, and returns the extended slice.
+func EncodeBlockWithMode(dst, src []byte, mode Mode, minRun int, runLengthBytes int) ([]byte, error) {
+	switch mode {
+	case ModeFixed:
+		return EncodeBlock(dst, src, minRun, runLengthBytes), nil
+	case ModeZeroRun:
+		return EncodeZeroRunBlock(dst, src), nil
+	case ModeVarint:
+		return EncodeVarintBlock(dst, src, minRun), nil
+	case ModeAuto:
+		return EncodeAutoBlock(dst, src), nil
+	default:
+		return dst, fmt.Errorf("%w: %v", ErrUnknownMode, byte(mode))
+	}
+}
+
+// DecodeBlockWithMode reverses EncodeBlockWithMode with the same mode and
+// parameters, appending to dst. A few bytes of src can code a very long run,
+// so it returns an error rather than append more than maxSize bytes.
+func DecodeBlockWithMode(dst, src []byte, mode Mode, minRun int, runLengthBytes int, maxSize int) ([]byte, error) {
+	var d blockDecoder
+	switch mode {
+	case ModeFixed:
+		d = &fixedDecoder{minRun: minRun, runLengthBytes: runLengthBytes}
+	case ModeZeroRun:
+		d = &zeroRunDecoder{}
+	case ModeVarint:
+		d = &varintDecoder{minRun: minRun}
+	case ModeAuto:
+		d = &autoDecoder{}
+	default:
+		return dst, fmt.Errorf("%w: %v", ErrUnknownMode, byte(mode))
+	}
+
+	return decodeBlock(d, dst, src, maxSize)
+}
@@ -0,0 +1,21 @@
+package compresslib
+
+// RLE1MinRun and RLE1RunLengthBytes are the parameters of the run length
+// encoding bzip2 applies before the BWT, which codes runs of 4 or more bytes
+// as 4 bytes and a 1 byte count.
+const (
+	RLE1MinRun         = 4
+	RLE1RunLengthBytes = 1
+)
+
+// EncodeRLE1 compresses block with the RLE1 parameters. Applied before the
+// BWT, it shortens the long runs that are slow to sort, at a cost of a byte
+// for each run of exactly 4 bytes.
+func EncodeRLE1(block []byte) []byte {
+	return EncodeBlock(make([]byte, 0, len(block)), block, RLE1MinRun, RLE1RunLengthBytes)
+}
+
+// DecodeRLE1 reverses EncodeRLE1.
+func DecodeRLE1(block []byte) ([]byte, error) {
+	return DecodeBlock(make([]byte, 0, len(block)), block, RLE1MinRun, RLE1RunLengthBytes)
+}
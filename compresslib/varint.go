@@ -0,0 +1,146 @@
+package compresslib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// maxDecodedRunLength bounds the run lengths read by DecodeBlock and
+// DecodeVarintBlock, which is longer than any block.
+const maxDecodedRunLength = 1 << 32
+
+// appendVarintRun appends a run of runChar as appendRun does, but with the
+// run length beyond minRun as an unsigned LEB128 varint, so that runs are
+// never split and a short run's length takes a single byte.
+func appendVarintRun(dst []byte, runLength int, runChar byte, minRun int) []byte {
+	if runLength < minRun {
+		return appendRepeat(dst, runChar, runLength)
+	}
+
+	return binary.AppendUvarint(appendRepeat(dst, runChar, minRun), uint64(runLength-minRun))
+}
+
+// varintEncoder is the blockEncoder for CompressVarint.
+type varintEncoder struct {
+	minRun    int
+	runChar   byte
+	runLength int
+}
+
+func (e *varintEncoder) encode(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		if e.runLength > 0 && src[i] != e.runChar {
+			dst = e.flush(dst)
+		}
+
+		e.runChar = src[i]
+		for i < len(src) && src[i] == e.runChar {
+			i++
+			e.runLength++
+		}
+	}
+
+	return dst
+}
+
+func (e *varintEncoder) flush(dst []byte) []byte {
+	if e.runLength > 0 {
+		dst = appendVarintRun(dst, e.runLength, e.runChar, e.minRun)
+		e.runLength = 0
+	}
+
+	return dst
+}
+
+// varintDecoder is the blockDecoder for DecompressVarint.
+type varintDecoder struct {
+	minRun     int
+	runChar    byte
+	runLength  int
+	counting   bool
+	count      uint64
+	countBytes int
+	run        pendingRun
+}
+
+func (d *varintDecoder) decode(dst, src []byte, limit int) ([]byte, int, error) {
+	start := len(dst)
+	i := 0
+	for {
+		dst = d.run.appendTo(dst, limit-(len(dst)-start))
+		if d.run.n > 0 || i == len(src) || len(dst)-start >= limit {
+			return dst, i, nil
+		}
+
+		readByte := src[i]
+		i++
+		if !d.counting {
+			dst = append(dst, readByte)
+			if readByte != d.runChar || d.runLength == 0 {
+				d.runLength = 1
+				d.runChar = readByte
+			} else {
+				d.runLength++
+			}
+
+			d.counting = d.runLength >= d.minRun
+			continue
+		}
+
+		d.count |= uint64(readByte&0x7f) << (7 * d.countBytes)
+		d.countBytes++
+		if d.count > maxDecodedRunLength {
+			return dst, i, errors.New("encoded run length too long")
+		}
+
+		if readByte&0x80 != 0 {
+			if d.countBytes == binary.MaxVarintLen64 {
+				return dst, i, errors.New("encoded run length too long")
+			}
+
+			continue
+		}
+
+		d.run = pendingRun{c: d.runChar, n: int(d.count)}
+		d.runLength = 0
+		d.counting = false
+		d.count = 0
+		d.countBytes = 0
+	}
+}
+
+func (d *varintDecoder) finish() error {
+	if d.counting {
+		return errors.New("expected encoded run length, got eof")
+	}
+
+	return nil
+}
+
+// EncodeVarintBlock appends the coding of src to dst as CompressVarint writes
+// it, and returns the extended slice.
+func EncodeVarintBlock(dst, src []byte, minRun int) []byte {
+	return encodeBlock(&varintEncoder{minRun: minRun}, dst, src)
+}
+
+// DecodeVarintBlock reverses EncodeVarintBlock with the same minRun,
+// appending to dst. On error it returns dst extended with the bytes decoded
+// so far.
+func DecodeVarintBlock(dst, src []byte, minRun int) ([]byte, error) {
+	return decodeBlock(&varintDecoder{minRun: minRun}, dst, src, math.MaxInt)
+}
+
+// CompressVarint will compress a byte stream as Compress does, but writing
+// the length of each run as a varint.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func CompressVarint(input io.ByteReader, output io.Writer, minRun int) (int, int, error) {
+	return encodeStream(input, output, &varintEncoder{minRun: minRun})
+}
+
+// DecompressVarint will decompress the input stream written by
+// CompressVarint and write to the output.
+func DecompressVarint(input io.ByteReader, output io.Writer, minRun int) (int, int, error) {
+	return decodeStream(input, output, &varintDecoder{minRun: minRun})
+}
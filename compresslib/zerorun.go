@@ -0,0 +1,174 @@
+package compresslib
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	// RunA and RunB code runs of zero bytes in bijective base 2, least
+	// significant digit first, with RunA worth 1 and RunB worth 2 at each
+	// position, as bzip2 codes runs of zero MTF ranks.
+	RunA = 0x00
+	RunB = 0x01
+
+	// zeroRunEscape is followed by 0x00 or 0x01 for the bytes 0xfe and 0xff,
+	// which other bytes shifted up by one would not leave room for.
+	zeroRunEscape = 0xff
+
+	// maxZeroRunDigits bounds the digits of a run, allowing runs of over
+	// 2^31 zeros, which is longer than any block.
+	maxZeroRunDigits = 31
+)
+
+// appendZeroRun appends a run of zero bytes in bijective base 2.
+func appendZeroRun(output []byte, run int) []byte {
+	for run > 0 {
+		if run&1 == 1 {
+			output = append(output, RunA)
+			run = (run - 1) / 2
+		} else {
+			output = append(output, RunB)
+			run = (run - 2) / 2
+		}
+	}
+
+	return output
+}
+
+// appendZeroRunByte appends a non-zero byte shifted up by one to make room
+// for RunA and RunB.
+func appendZeroRunByte(output []byte, c byte) []byte {
+	if c >= zeroRunEscape-1 {
+		return append(output, zeroRunEscape, c-(zeroRunEscape-1))
+	}
+
+	return append(output, c+1)
+}
+
+// zeroRunEncoder is the blockEncoder for CompressZeroRuns.
+type zeroRunEncoder struct {
+	run int
+}
+
+func (e *zeroRunEncoder) encode(dst, src []byte) []byte {
+	for _, c := range src {
+		if c == 0 {
+			e.run++
+			continue
+		}
+
+		dst = appendZeroRunByte(e.flush(dst), c)
+	}
+
+	return dst
+}
+
+func (e *zeroRunEncoder) flush(dst []byte) []byte {
+	dst = appendZeroRun(dst, e.run)
+	e.run = 0
+
+	return dst
+}
+
+// zeroRunDecoder is the blockDecoder for DecompressZeroRuns.
+type zeroRunDecoder struct {
+	zeros   int
+	digits  int
+	escaped bool
+	run     pendingRun
+}
+
+func (d *zeroRunDecoder) decode(dst, src []byte, limit int) ([]byte, int, error) {
+	start := len(dst)
+	i := 0
+	for {
+		dst = d.run.appendTo(dst, limit-(len(dst)-start))
+		if d.run.n > 0 || i == len(src) || len(dst)-start >= limit {
+			return dst, i, nil
+		}
+
+		readByte := src[i]
+		if d.escaped {
+			i++
+			if readByte > 1 {
+				return dst, i, errors.New("malformed escaped byte")
+			}
+
+			dst = append(dst, zeroRunEscape-1+readByte)
+			d.escaped = false
+			continue
+		}
+
+		if readByte == RunA || readByte == RunB {
+			i++
+			if d.digits == maxZeroRunDigits {
+				return dst, i, errors.New("zero run too long")
+			}
+
+			d.zeros += int(readByte-RunA+1) << d.digits
+			d.digits++
+			continue
+		}
+
+		// The zeros before the byte are appended first.
+		if d.digits > 0 {
+			d.endRun()
+			continue
+		}
+
+		i++
+		if readByte == zeroRunEscape {
+			d.escaped = true
+			continue
+		}
+
+		dst = append(dst, readByte-1)
+	}
+}
+
+// endRun leaves the zeros read so far to be appended.
+func (d *zeroRunDecoder) endRun() {
+	d.run = pendingRun{c: 0, n: d.zeros}
+	d.zeros = 0
+	d.digits = 0
+}
+
+func (d *zeroRunDecoder) finish() error {
+	if d.escaped {
+		return errors.New("expected escaped byte, got eof")
+	}
+
+	d.endRun()
+
+	return nil
+}
+
+// EncodeZeroRunBlock appends the coding of src to dst as CompressZeroRuns
+// writes it, and returns the extended slice.
+func EncodeZeroRunBlock(dst, src []byte) []byte {
+	return encodeBlock(&zeroRunEncoder{}, dst, src)
+}
+
+// DecodeZeroRunBlock reverses EncodeZeroRunBlock, appending to dst. On error
+// it returns dst extended with the bytes decoded so far.
+func DecodeZeroRunBlock(dst, src []byte) ([]byte, error) {
+	return decodeBlock(&zeroRunDecoder{}, dst, src, math.MaxInt)
+}
+
+// CompressZeroRuns will compress a byte stream by coding its runs of zero
+// bytes with RunA and RunB, which suits the output of mtflib where most
+// runs are of zeros. A run of n zeros takes about log2(n) bytes, so unlike
+// Compress it never splits a run, and a single zero takes one byte. Other
+// bytes are shifted up by one, with 0xfe and 0xff taking two bytes.
+// Returns the number of bytes read, the number of bytes output and any errors.
+func CompressZeroRuns(input io.ByteReader, output io.Writer) (int, int, error) {
+	return encodeStream(input, output, &zeroRunEncoder{})
+}
+
+// DecompressZeroRuns will decompress the input stream written by
+// CompressZeroRuns and write to the output.
+func DecompressZeroRuns(input io.ByteReader, output io.Writer) (int, int, error) {
+	return decodeStream(input, output, &zeroRunDecoder{})
+}
@@ -0,0 +1,214 @@
+// Package distancelib implements distance coding and inversion frequencies,
+// which replace the move to front transform after the BWT. Rather than the
+// recency rank of every symbol, both code the gaps between the occurrences of
+// each symbol, which are small in the runs the BWT produces.
+//
+// The gaps are written as unsigned varints, so small gaps take a byte each.
+package distancelib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+// ErrMalformed is wrapped by the errors returned for blocks that were not
+// produced by this package.
+var ErrMalformed = errors.New("malformed distance coded block")
+
+// malformed wraps err in ErrMalformed.
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %v", ErrMalformed, fmt.Sprintf(format, args...))
+}
+
+// appendInUse appends a 32 byte bitmap of the bytes with non-zero counts.
+func appendInUse(output []byte, counts *[256]int) []byte {
+	var inUse [32]byte
+	for c, count := range counts {
+		if count > 0 {
+			inUse[c/8] |= 1 << (c % 8)
+		}
+	}
+
+	return append(output, inUse[:]...)
+}
+
+// readInUse reverses appendInUse, returning the bytes in use in order and the
+// rest of block.
+func readInUse(block []byte) ([]byte, []byte, error) {
+	if len(block) < 32 {
+		return nil, nil, malformed("missing bitmap of bytes in use")
+	}
+
+	var symbols []byte
+	for c := 0; c < 256; c++ {
+		if block[c/8]&(1<<(c%8)) != 0 {
+			symbols = append(symbols, byte(c))
+		}
+	}
+
+	return symbols, block[32:], nil
+}
+
+// uvarint reads an unsigned varint from the start of block, returning it and
+// the rest of block.
+func uvarint(block []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(block)
+	if n <= 0 {
+		return 0, nil, malformed("truncated varint")
+	}
+
+	return x, block[n:], nil
+}
+
+// DistanceCode applies Binder's distance coding to block. The output holds
+// the block size, the bytes in use and the position of the first occurrence
+// of each. Then, for each position in turn, it holds the distance to the next
+// occurrence of the same byte, or 0 if there is none. Only the positions
+// whose bytes are not yet known to the decoder are counted, so every
+// position is known by the time it is reached, and a run codes as 1s.
+func DistanceCode(block []byte) []byte {
+	var counts [256]int
+	first := [256]int{}
+	for i := len(block) - 1; i >= 0; i-- {
+		counts[block[i]]++
+		first[block[i]] = i
+	}
+
+	output := binary.AppendUvarint(nil, uint64(len(block)))
+	output = appendInUse(output, &counts)
+
+	known := make([]bool, len(block))
+	for c, count := range counts {
+		if count > 0 {
+			output = binary.AppendUvarint(output, uint64(first[c]))
+			known[first[c]] = true
+		}
+	}
+
+	// next holds the position of the next occurrence of each byte after the
+	// current position.
+	next := make([]int, len(block))
+	last := [256]int{}
+	for c := range last {
+		last[c] = -1
+	}
+	for i := len(block) - 1; i >= 0; i-- {
+		next[i] = last[block[i]]
+		last[block[i]] = i
+	}
+
+	for i := range block {
+		if next[i] < 0 {
+			output = append(output, 0)
+			continue
+		}
+
+		distance := 0
+		for j := i + 1; j <= next[i]; j++ {
+			if !known[j] {
+				distance++
+			}
+		}
+
+		known[next[i]] = true
+		output = binary.AppendUvarint(output, uint64(distance))
+	}
+
+	return output
+}
+
+// DecodeDistances reverses DistanceCode, rejecting blocks of more than
+// maxSize bytes.
+func DecodeDistances(coded []byte, maxSize int) ([]byte, error) {
+	n, coded, err := uvarint(coded)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every position takes at least a byte.
+	if n > uint64(len(coded)) {
+		return nil, malformed("%v bytes in %v", n, len(coded))
+	}
+
+	if n > uint64(maxSize) {
+		return nil, malformed("%v bytes exceeds the maximum of %v", n, maxSize)
+	}
+
+	symbols, coded, err := readInUse(coded)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]byte, n)
+	known := make([]bool, n)
+	for _, c := range symbols {
+		var position uint64
+		if position, coded, err = uvarint(coded); err != nil {
+			return nil, err
+		}
+
+		if position >= n || known[position] {
+			return nil, malformed("first occurrence of %#x at %v", c, position)
+		}
+
+		output[position] = c
+		known[position] = true
+	}
+
+	for i := range output {
+		if !known[i] {
+			return nil, malformed("nothing occurs at %v", i)
+		}
+
+		var distance uint64
+		if distance, coded, err = uvarint(coded); err != nil {
+			return nil, err
+		}
+
+		if distance == 0 {
+			continue
+		}
+
+		// Find the distance'th position after i that is not yet known.
+		j := i
+		for ; distance > 0; distance-- {
+			j++
+			for j < len(output) && known[j] {
+				j++
+			}
+
+			if j >= len(output) {
+				return nil, malformed("distance past the end of the block at %v", i)
+			}
+		}
+
+		output[j] = output[i]
+		known[j] = true
+	}
+
+	if len(coded) > 0 {
+		return nil, malformed("%v trailing bytes", len(coded))
+	}
+
+	return output, nil
+}
+
+// DistanceStream reads a container, such as one written by
+// bwtlib.BWTStreamWithOptions, and writes it with every block distance
+// coded, keeping the block boundaries.
+func DistanceStream(input io.Reader, output io.Writer) error {
+	return formatlib.Push(input, output, formatlib.StageDistance, nil, func(_ formatlib.Header, block []byte) ([]byte, error) {
+		return DistanceCode(block), nil
+	})
+}
+
+// IDistanceStream reverses DistanceStream.
+func IDistanceStream(input io.Reader, output io.Writer) error {
+	return formatlib.Pop(input, output, formatlib.StageDistance, func(header formatlib.Header, block []byte) ([]byte, error) {
+		return DecodeDistances(block, header.MaxStageSize())
+	})
+}
@@ -0,0 +1,263 @@
+package distancelib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"testing/quick"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const iliadPath = "../testfiles/iliad.mb.txt"
+
+// maxTestSize is the maxSize the tests decode with.
+const maxTestSize = 1 << 24
+
+// transforms lists each transform with its inverse.
+var transforms = []struct {
+	name    string
+	encode  func([]byte) []byte
+	decode  func([]byte, int) ([]byte, error)
+	stream  func(*bytes.Buffer, *bytes.Buffer) error
+	istream func(*bytes.Buffer, *bytes.Buffer) error
+	stage   formatlib.Stage
+}{
+	{
+		name:    "dc",
+		encode:  DistanceCode,
+		decode:  DecodeDistances,
+		stream:  func(in, out *bytes.Buffer) error { return DistanceStream(in, out) },
+		istream: func(in, out *bytes.Buffer) error { return IDistanceStream(in, out) },
+		stage:   formatlib.StageDistance,
+	},
+	{
+		name:    "if",
+		encode:  InversionFrequencies,
+		decode:  DecodeInversions,
+		stream:  func(in, out *bytes.Buffer) error { return InversionStream(in, out) },
+		istream: func(in, out *bytes.Buffer) error { return IInversionStream(in, out) },
+		stage:   formatlib.StageInversion,
+	},
+}
+
+// inUse returns the bitmap of bytes in use for symbols.
+func inUse(symbols string) []byte {
+	bitmap := make([]byte, 32)
+	for _, c := range []byte(symbols) {
+		bitmap[c/8] |= 1 << (c % 8)
+	}
+
+	return bitmap
+}
+
+func TestDistanceCodeBasic(t *testing.T) {
+	// The first a and b are at 0 and 2. The a at 0 is followed by the a at 1,
+	// and the a at 1 by the a at 4, skipping the known b at 2. The b at 2 is
+	// followed by the b at 3, and nothing follows the rest.
+	expected := append([]byte{5}, inUse("ab")...)
+	expected = append(expected, 0, 2, 1, 2, 1, 0, 0)
+
+	assert.Equal(t, expected, DistanceCode([]byte("aabba")))
+
+	decoded, err := DecodeDistances(expected, maxTestSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aabba"), decoded)
+}
+
+func TestInversionFrequenciesBasic(t *testing.T) {
+	// a occurs 3 times and b twice. There are no bs before the first two as
+	// and two before the last, and the bs fill the rest.
+	expected := append(inUse("ab"), 3, 2, 0, 0, 2)
+
+	assert.Equal(t, expected, InversionFrequencies([]byte("aabba")))
+
+	decoded, err := DecodeInversions(expected, maxTestSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aabba"), decoded)
+}
+
+func TestInversionFrequenciesOrder(t *testing.T) {
+	// The gaps of c come before those of b, so that the decoder can insert
+	// them first. There are two ds before the c, and no larger bytes before
+	// the first b and three before the second.
+	expected := append(inUse("bcd"), 2, 1, 2, 2, 0, 3)
+
+	assert.Equal(t, expected, InversionFrequencies([]byte("bddcb")))
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(20))
+	inputs := [][]byte{
+		{},
+		{0x00},
+		{0xff},
+		bytes.Repeat([]byte{'a'}, 1000),
+		[]byte("abracadabra"),
+		bytes.Repeat([]byte("\x00\xff"), 300),
+	}
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(255 - i)
+	}
+	inputs = append(inputs, all)
+
+	for size := 1; size < 2000; size *= 3 {
+		block := make([]byte, size)
+		rng.Read(block)
+		inputs = append(inputs, block)
+
+		block = make([]byte, size)
+		for i := range block {
+			block[i] = byte(rng.Intn(4))
+		}
+		inputs = append(inputs, block)
+	}
+
+	for _, transform := range transforms {
+		for _, input := range inputs {
+			decoded, err := transform.decode(transform.encode(input), maxTestSize)
+			assert.NoError(t, err, transform.name)
+			assert.Equal(t, input, decoded, transform.name)
+		}
+	}
+}
+
+func TestRoundTripQuick(t *testing.T) {
+	for _, transform := range transforms {
+		identity := func(input []byte) bool {
+			decoded, err := transform.decode(transform.encode(input), maxTestSize)
+
+			return err == nil && bytes.Equal(input, decoded)
+		}
+
+		assert.NoError(t, quick.Check(identity, &quick.Config{MaxCount: 300}), transform.name)
+	}
+}
+
+func TestRoundTripIliad(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	block, err := bwtlib.BWT(input[:128*1024])
+	assert.NoError(t, err)
+
+	for _, transform := range transforms {
+		coded := transform.encode(block)
+		// Most gaps in the BWT of text are small, so most take a byte.
+		assert.Less(t, len(coded), len(block)*11/10, transform.name)
+
+		decoded, err := transform.decode(coded, maxTestSize)
+		assert.NoError(t, err, transform.name)
+		assert.Equal(t, block, decoded, transform.name)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	input := []byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES")
+	for _, transform := range transforms {
+		coded := transform.encode(input)
+
+		// Every truncation is missing at least one varint.
+		for n := 0; n < len(coded); n++ {
+			_, err := transform.decode(coded[:n], maxTestSize)
+			assert.ErrorIs(t, err, ErrMalformed, transform.name)
+		}
+
+		_, err := transform.decode(append(coded, 0), maxTestSize)
+		assert.ErrorIs(t, err, ErrMalformed, transform.name)
+	}
+
+	// A first occurrence past the end of the block.
+	_, err := DecodeDistances(append(append([]byte{2}, inUse("a")...), 2, 1, 0), maxTestSize)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// A distance past the end of the block.
+	_, err = DecodeDistances(append(append([]byte{2}, inUse("a")...), 0, 2, 0), maxTestSize)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// A gap past the end of the block.
+	_, err = DecodeInversions(append(inUse("ab"), 1, 1, 2), maxTestSize)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// An implausible number of the largest byte.
+	_, err = DecodeInversions(append(inUse("a"), 0xff, 0xff, 0xff, 0xff, 0x7f), maxTestSize)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestDecodeMaxSize(t *testing.T) {
+	input := []byte("abracadabra")
+	for _, transform := range transforms {
+		coded := transform.encode(input)
+
+		decoded, err := transform.decode(coded, len(input))
+		assert.NoError(t, err, transform.name)
+		assert.Equal(t, input, decoded, transform.name)
+
+		_, err = transform.decode(coded, len(input)-1)
+		assert.ErrorIs(t, err, ErrMalformed, transform.name)
+	}
+
+	// A 37 byte block claiming a GiB of its only byte is rejected by a
+	// container of 16 byte blocks rather than allocated.
+	coded := binary.AppendUvarint(inUse("a"), 1<<30)
+
+	var stream bytes.Buffer
+	writer, err := formatlib.NewBlockWriter(&stream, formatlib.Header{Stages: []formatlib.Stage{formatlib.StageBWT, formatlib.StageInversion}, BlockSize: 16})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock(coded, 0))
+	assert.NoError(t, writer.Close())
+
+	err = IInversionStream(&stream, io.Discard)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestDecodeRandom(t *testing.T) {
+	// Random input must be rejected or decoded without panicking.
+	rng := rand.New(rand.NewSource(21))
+	for i := 0; i < 1000; i++ {
+		coded := make([]byte, rng.Intn(64))
+		rng.Read(coded)
+		if len(coded) > 0 {
+			coded[0] %= 16
+		}
+
+		for _, transform := range transforms {
+			_, _ = transform.decode(coded, maxTestSize)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+	input = input[:32*1024]
+
+	var transformed bytes.Buffer
+	err = bwtlib.BWTStreamWithOptions(bytes.NewReader(input), &transformed, bwtlib.StreamOptions{BlockSize: 4096, Transform: bwtlib.TransformIndexed, Checksum: true})
+	assert.NoError(t, err)
+	bwtStream := transformed.Bytes()
+
+	for _, transform := range transforms {
+		var coded bytes.Buffer
+		assert.NoError(t, transform.stream(bytes.NewBuffer(bwtStream), &coded))
+
+		header, err := formatlib.ReadHeader(bytes.NewReader(coded.Bytes()))
+		assert.NoError(t, err)
+		assert.NoError(t, header.ExpectStages(formatlib.StageBWT, transform.stage))
+
+		var decoded bytes.Buffer
+		assert.NoError(t, transform.istream(&coded, &decoded))
+		assert.Equal(t, bwtStream, decoded.Bytes(), transform.name)
+
+		var output bytes.Buffer
+		assert.NoError(t, bwtlib.IBWTStreamWithOptions(&decoded, &output, bwtlib.StreamOptions{}))
+		assert.Equal(t, input, output.Bytes(), transform.name)
+	}
+}
@@ -0,0 +1,142 @@
+package distancelib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+// InversionFrequencies applies the inversion frequencies transform of Arnavut
+// and Magliveras to block. The output holds the bytes in use and the number
+// of occurrences of each. Then, for each byte in decreasing order, it holds
+// the number of larger bytes before each of its occurrences since the
+// previous one, which is the order the decoder inserts them in. The
+// occurrences of the largest byte fill the remaining positions, so they are
+// not coded.
+func InversionFrequencies(block []byte) []byte {
+	var counts [256]int
+	for _, c := range block {
+		counts[c]++
+	}
+
+	output := appendInUse(nil, &counts)
+	var symbols []byte
+	for c, count := range counts {
+		if count > 0 {
+			output = binary.AppendUvarint(output, uint64(count))
+			symbols = append(symbols, byte(c))
+		}
+	}
+
+	// The gaps are found from the smallest byte up, removing each byte from
+	// the remaining text once it is coded so that the remaining bytes are
+	// all larger than the next.
+	gaps := make([][]byte, len(symbols))
+	remaining := append([]byte{}, block...)
+	for i := 0; i+1 < len(symbols); i++ {
+		gap := 0
+		kept := remaining[:0]
+		for _, c := range remaining {
+			if c == symbols[i] {
+				gaps[i] = binary.AppendUvarint(gaps[i], uint64(gap))
+				gap = 0
+				continue
+			}
+
+			gap++
+			kept = append(kept, c)
+		}
+		remaining = kept
+	}
+
+	for i := len(gaps) - 1; i >= 0; i-- {
+		output = append(output, gaps[i]...)
+	}
+
+	return output
+}
+
+// DecodeInversions reverses InversionFrequencies. The occurrences of the
+// largest byte are not coded, so the size of a block is not bounded by its
+// coded size, and blocks of more than maxSize bytes are rejected.
+func DecodeInversions(coded []byte, maxSize int) ([]byte, error) {
+	symbols, coded, err := readInUse(coded)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int, len(symbols))
+	n := 0
+	for i := range symbols {
+		var count uint64
+		if count, coded, err = uvarint(coded); err != nil {
+			return nil, err
+		}
+
+		if count == 0 || count > uint64(maxSize-n) {
+			return nil, malformed("%v occurrences of %#x", count, symbols[i])
+		}
+
+		counts[i] = int(count)
+		n += counts[i]
+	}
+
+	if len(symbols) == 0 {
+		if len(coded) > 0 {
+			return nil, malformed("%v trailing bytes", len(coded))
+		}
+
+		return []byte{}, nil
+	}
+
+	// Insert each byte among the larger ones, from the largest down.
+	last := len(symbols) - 1
+	output := append(make([]byte, 0, n), bytes.Repeat(symbols[last:], counts[last])...)
+	scratch := make([]byte, 0, n)
+
+	for i := last - 1; i >= 0; i-- {
+		merged := scratch[:0]
+		next := 0
+		for j := 0; j < counts[i]; j++ {
+			var gap uint64
+			if gap, coded, err = uvarint(coded); err != nil {
+				return nil, err
+			}
+
+			if gap > uint64(len(output)-next) {
+				return nil, malformed("gap of %v past the end of the block", gap)
+			}
+
+			merged = append(merged, output[next:next+int(gap)]...)
+			merged = append(merged, symbols[i])
+			next += int(gap)
+		}
+
+		merged = append(merged, output[next:]...)
+		output, scratch = merged, output
+	}
+
+	if len(coded) > 0 {
+		return nil, malformed("%v trailing bytes", len(coded))
+	}
+
+	return output, nil
+}
+
+// InversionStream reads a container, such as one written by
+// bwtlib.BWTStreamWithOptions, and writes it with the inversion frequencies
+// of every block, keeping the block boundaries.
+func InversionStream(input io.Reader, output io.Writer) error {
+	return formatlib.Push(input, output, formatlib.StageInversion, nil, func(_ formatlib.Header, block []byte) ([]byte, error) {
+		return InversionFrequencies(block), nil
+	})
+}
+
+// IInversionStream reverses InversionStream.
+func IInversionStream(input io.Reader, output io.Writer) error {
+	return formatlib.Pop(input, output, formatlib.StageInversion, func(header formatlib.Header, block []byte) ([]byte, error) {
+		return DecodeInversions(block, header.MaxStageSize())
+	})
+}
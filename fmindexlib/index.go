@@ -0,0 +1,429 @@
+package fmindexlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+)
+
+// DefaultSampleRate is the default distance between the text positions whose
+// suffix array entries are kept.
+const DefaultSampleRate = 32
+
+// occStep is the number of BWT rows between occurrence checkpoints.
+const occStep = 128
+
+// ErrMalformedSamples is returned by FromBWT when the samples do not match
+// the BWT.
+var ErrMalformedSamples = errors.New("malformed FM-index samples")
+
+// Index is an FM-index over a block of text. It holds the BWT of the text
+// terminated by a virtual sentinel, or of its rotations when built by
+// FromBWT, checkpointed occurrence counts for rank queries and a sampled
+// suffix array for locating matches and extracting text.
+type Index struct {
+	n          int
+	sampleRate int
+
+	// bwt has a row for each suffix of the text plus the empty suffix. The
+	// sentinel row, which precedes the whole text, holds 0 in bwt and is
+	// skipped by rank. An index built by FromBWT instead has a row for each
+	// rotation of the text and no sentinel row, so sentinel is -1.
+	bwt      []byte
+	sentinel int
+
+	// c holds the first row of the suffixes starting with each byte.
+	c [256]int
+	// occ holds the count of each byte in bwt before every occStep'th row.
+	occ []uint32
+
+	// positions holds the row of every sampleRate'th text position, and last
+	// holds the row whose BWT byte is the last byte of the text.
+	positions []int32
+	last      int
+
+	// sampled marks the rows whose text position is a multiple of the sample
+	// rate, and samples holds those positions in row order. sampledRanks holds
+	// the number of sampled rows before each word of sampled.
+	sampled      []uint64
+	sampledRanks []uint32
+	samples      []int32
+}
+
+// New builds an Index over text, keeping the suffix array entry of every
+// sampleRate'th text position. Values of sampleRate below 1 use
+// DefaultSampleRate. Larger sample rates save memory but slow down Locate.
+func New(text []byte, sampleRate int) *Index {
+	if sampleRate < 1 {
+		sampleRate = DefaultSampleRate
+	}
+
+	n := len(text)
+	x := &Index{
+		n:          n,
+		sampleRate: sampleRate,
+		bwt:        make([]byte, n+1),
+		positions:  make([]int32, (n+sampleRate-1)/sampleRate),
+	}
+
+	sa := bwtlib.SuffixArray(text)
+	for row := 0; row <= n; row++ {
+		// The empty suffix sorts first.
+		position := n
+		if row > 0 {
+			position = int(sa[row-1])
+		}
+
+		if position == 0 {
+			x.sentinel = row
+		} else {
+			x.bwt[row] = text[position-1]
+		}
+
+		if position < n && position%sampleRate == 0 {
+			x.positions[position/sampleRate] = int32(row)
+		}
+	}
+
+	x.build()
+
+	return x
+}
+
+// Samples walks bwt, the BWT of a block from bwtlib.BWTIndexed with the given
+// primary index, and returns the row of every sampleRate'th position of the
+// block encoded for FromBWT. Values of sampleRate below 1 use
+// DefaultSampleRate. It returns nil if the block is periodic, as the rows of
+// its equal rotations cannot be told apart.
+func Samples(bwt []byte, primary int, sampleRate int) []byte {
+	if sampleRate < 1 {
+		sampleRate = DefaultSampleRate
+	}
+
+	n := len(bwt)
+	var starts [256]int
+	for _, c := range bwt {
+		starts[c]++
+	}
+
+	sum := 0
+	for c, count := range starts {
+		starts[c] = sum
+		sum += count
+	}
+
+	// next maps the row of each position to the row of the following one.
+	next := make([]int32, n)
+	for row, c := range bwt {
+		next[starts[c]] = int32(row)
+		starts[c]++
+	}
+
+	samples := make([]byte, 0, 4+4*((n+sampleRate-1)/sampleRate))
+	samples = binary.LittleEndian.AppendUint32(samples, uint32(sampleRate))
+	row := primary
+	for position := 0; position < n; position++ {
+		if position > 0 && row == primary {
+			return nil
+		}
+
+		if position%sampleRate == 0 {
+			samples = binary.LittleEndian.AppendUint32(samples, uint32(row))
+		}
+		row = int(next[row])
+	}
+
+	return samples
+}
+
+// FromBWT builds an Index over a block from its BWT and primary index, as
+// returned by bwtlib.BWTIndexed, and the samples returned by Samples, without
+// decoding the block. The Index keeps bwt, which must not be modified.
+func FromBWT(bwt []byte, primary int, samples []byte) (*Index, error) {
+	n := len(bwt)
+	if len(samples) < 4 || (n > 0 && (primary < 0 || primary >= n)) {
+		return nil, ErrMalformedSamples
+	}
+
+	sampleRate := int(binary.LittleEndian.Uint32(samples))
+	if sampleRate < 1 {
+		return nil, ErrMalformedSamples
+	}
+
+	count := (n + sampleRate - 1) / sampleRate
+	if len(samples) != 4+4*count {
+		return nil, fmt.Errorf("%w: %v bytes for %v samples", ErrMalformedSamples, len(samples), count)
+	}
+
+	x := &Index{
+		n:          n,
+		sampleRate: sampleRate,
+		bwt:        bwt,
+		sentinel:   -1,
+		positions:  make([]int32, count),
+	}
+
+	seen := make([]uint64, (n+63)/64)
+	for i := range x.positions {
+		row := int(binary.LittleEndian.Uint32(samples[4+4*i:]))
+		if row >= n || seen[row/64]&(1<<(row%64)) != 0 {
+			return nil, fmt.Errorf("%w: sample %v has row %v", ErrMalformedSamples, i, row)
+		}
+
+		seen[row/64] |= 1 << (row % 64)
+		x.positions[i] = int32(row)
+	}
+
+	if count > 0 && int(x.positions[0]) != primary {
+		return nil, fmt.Errorf("%w: primary index %v, expected %v", ErrMalformedSamples, x.positions[0], primary)
+	}
+
+	x.build()
+
+	return x, nil
+}
+
+// build fills in the rank and sample structures from bwt and positions.
+func (x *Index) build() {
+	x.sampled = make([]uint64, (len(x.bwt)+63)/64)
+	for _, row := range x.positions {
+		x.sampled[row/64] |= 1 << (row % 64)
+	}
+
+	x.sampledRanks = make([]uint32, len(x.sampled))
+	total := uint32(0)
+	for i, word := range x.sampled {
+		x.sampledRanks[i] = total
+		total += uint32(bits.OnesCount64(word))
+	}
+
+	x.samples = make([]int32, len(x.positions))
+	for i, row := range x.positions {
+		x.samples[x.sampleIndex(int(row))] = int32(i * x.sampleRate)
+	}
+
+	var counts [256]uint32
+	x.occ = make([]uint32, 0, (len(x.bwt)/occStep+1)*256)
+	for row, c := range x.bwt {
+		if row%occStep == 0 {
+			x.occ = append(x.occ, counts[:]...)
+		}
+
+		if row != x.sentinel {
+			counts[c]++
+		}
+	}
+
+	// rank also needs a checkpoint for the row after the last.
+	if len(x.bwt)%occStep == 0 {
+		x.occ = append(x.occ, counts[:]...)
+	}
+
+	// Row 0 is the empty suffix, so the suffixes starting with each byte
+	// follow it in byte order. Rotations have no empty suffix.
+	sum := 1
+	x.last = 0
+	if x.sentinel < 0 {
+		sum = 0
+		if len(x.positions) > 0 {
+			x.last = int(x.positions[0])
+		}
+	}
+
+	for c := range x.c {
+		x.c[c] = sum
+		sum += int(counts[c])
+	}
+}
+
+// Len returns the length of the indexed text.
+func (x *Index) Len() int {
+	return x.n
+}
+
+// rank returns the number of occurrences of c in the BWT before row.
+func (x *Index) rank(c byte, row int) int {
+	checkpoint := row / occStep
+	start := checkpoint * occStep
+	count := int(x.occ[checkpoint*256+int(c)]) + bytes.Count(x.bwt[start:row], []byte{c})
+	if c == 0 && start <= x.sentinel && x.sentinel < row {
+		count--
+	}
+
+	return count
+}
+
+// lf maps a row to the row of the suffix one byte earlier in the text.
+func (x *Index) lf(row int) int {
+	c := x.bwt[row]
+
+	return x.c[c] + x.rank(c, row)
+}
+
+// rows returns the range of rows whose suffixes start with pattern, found by
+// backward search.
+func (x *Index) rows(pattern []byte) (int, int) {
+	lo, hi := 0, len(x.bwt)
+	for i := len(pattern) - 1; i >= 0 && lo < hi; i-- {
+		c := pattern[i]
+		lo = x.c[c] + x.rank(c, lo)
+		hi = x.c[c] + x.rank(c, hi)
+	}
+
+	return lo, hi
+}
+
+// search calls fn with each range of rows whose suffixes start with pattern,
+// narrowing lo and hi by backward search. With fold, ASCII letters in pattern
+// match either case, so each letter may split a range in two.
+func (x *Index) search(pattern []byte, lo, hi int, fold bool, fn func(lo, hi int)) {
+	if lo >= hi {
+		return
+	}
+
+	if len(pattern) == 0 {
+		fn(lo, hi)
+		return
+	}
+
+	c := pattern[len(pattern)-1]
+	rest := pattern[:len(pattern)-1]
+	x.search(rest, x.c[c]+x.rank(c, lo), x.c[c]+x.rank(c, hi), fold, fn)
+
+	if other := swapCase(c); fold && other != c {
+		x.search(rest, x.c[other]+x.rank(other, lo), x.c[other]+x.rank(other, hi), fold, fn)
+	}
+}
+
+// swapCase returns the other case of an ASCII letter, or c itself.
+func swapCase(c byte) byte {
+	switch {
+	case 'a' <= c && c <= 'z':
+		return c - 'a' + 'A'
+	case 'A' <= c && c <= 'Z':
+		return c - 'A' + 'a'
+	default:
+		return c
+	}
+}
+
+// Count returns the number of occurrences of pattern in the text, including
+// overlapping ones. An empty pattern occurs at every position.
+func (x *Index) Count(pattern []byte) int {
+	if len(pattern) == 0 {
+		return x.n + 1
+	}
+
+	if x.sentinel < 0 && len(pattern) > x.n {
+		return 0
+	}
+
+	lo, hi := x.rows(pattern)
+
+	return hi - lo - x.wrapped(pattern)
+}
+
+// wrapped returns the number of matches of pattern that wrap around from the
+// end of the text to its start, which backward search over rotations finds.
+func (x *Index) wrapped(pattern []byte) int {
+	if x.sentinel >= 0 || len(pattern) < 2 {
+		return 0
+	}
+
+	m := len(pattern)
+	window := append(x.Extract(x.n-m+1, x.n), x.Extract(0, m-1)...)
+	count := 0
+	for i := 0; i+m <= len(window); i++ {
+		if bytes.Equal(window[i:i+m], pattern) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Locate returns the offset of every occurrence of pattern in the text, in
+// increasing order.
+func (x *Index) Locate(pattern []byte) []int {
+	return x.locate(pattern, false)
+}
+
+// LocateFold is like Locate, but ASCII letters in pattern match either case.
+func (x *Index) LocateFold(pattern []byte) []int {
+	return x.locate(pattern, true)
+}
+
+func (x *Index) locate(pattern []byte, fold bool) []int {
+	if len(pattern) == 0 {
+		return nil
+	}
+
+	positions := []int{}
+	x.search(pattern, 0, len(x.bwt), fold, func(lo, hi int) {
+		for row := lo; row < hi; row++ {
+			// Matches over rotations may wrap around the end of the text.
+			if position := x.position(row); position >= 0 && position+len(pattern) <= x.n {
+				positions = append(positions, position)
+			}
+		}
+	})
+
+	sort.Ints(positions)
+
+	return positions
+}
+
+// position returns the text position of a row by walking back through the
+// text to the nearest sampled position. It returns -1 if there is no sampled
+// position within the sample rate, which only happens with corrupt samples.
+func (x *Index) position(row int) int {
+	for steps := 0; steps < x.sampleRate; steps++ {
+		if x.isSampled(row) {
+			return int(x.samples[x.sampleIndex(row)]) + steps
+		}
+		row = x.lf(row)
+	}
+
+	return -1
+}
+
+// Extract returns text[start:end], decoded by walking back from the nearest
+// sampled position at or after end. It panics unless
+// 0 <= start <= end <= Len().
+func (x *Index) Extract(start, end int) []byte {
+	if start < 0 || start > end || end > x.n {
+		panic(fmt.Sprintf("fmindexlib: Extract range [%v:%v] out of range with length %v", start, end, x.n))
+	}
+
+	position := (end + x.sampleRate - 1) / x.sampleRate * x.sampleRate
+	row := x.last
+	if position < x.n {
+		row = int(x.positions[position/x.sampleRate])
+	} else {
+		position = x.n
+	}
+
+	text := make([]byte, position-start)
+	for i := len(text) - 1; i >= 0; i-- {
+		text[i] = x.bwt[row]
+		row = x.lf(row)
+	}
+
+	return text[:end-start]
+}
+
+func (x *Index) isSampled(row int) bool {
+	return x.sampled[row/64]&(1<<(row%64)) != 0
+}
+
+// sampleIndex returns the index in samples of a sampled row.
+func (x *Index) sampleIndex(row int) int {
+	below := x.sampled[row/64] & (1<<(row%64) - 1)
+
+	return int(x.sampledRanks[row/64]) + bits.OnesCount64(below)
+}
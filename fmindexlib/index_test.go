@@ -0,0 +1,215 @@
+package fmindexlib
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const iliadPath = "../testfiles/iliad.mb.txt"
+
+// naiveLocate finds every occurrence of pattern, including overlapping ones.
+func naiveLocate(text []byte, pattern []byte) []int {
+	positions := []int{}
+	for i := 0; i+len(pattern) <= len(text); i++ {
+		if bytes.Equal(text[i:i+len(pattern)], pattern) {
+			positions = append(positions, i)
+		}
+	}
+
+	return positions
+}
+
+func TestIndexBasic(t *testing.T) {
+	x := New([]byte("BANANA"), 1)
+
+	assert.Equal(t, 6, x.Len())
+	assert.Equal(t, 3, x.Count([]byte("A")))
+	assert.Equal(t, 2, x.Count([]byte("ANA")))
+	assert.Equal(t, 1, x.Count([]byte("BANANA")))
+	assert.Equal(t, 0, x.Count([]byte("NAB")))
+	assert.Equal(t, 0, x.Count([]byte("BANANAS")))
+	assert.Equal(t, 7, x.Count([]byte{}))
+
+	assert.Equal(t, []int{1, 3}, x.Locate([]byte("ANA")))
+	assert.Equal(t, []int{0}, x.Locate([]byte("BAN")))
+	assert.Equal(t, []int{}, x.Locate([]byte("X")))
+}
+
+func TestIndexEmpty(t *testing.T) {
+	x := New(nil, 0)
+
+	assert.Equal(t, 0, x.Count([]byte("A")))
+	assert.Equal(t, []int{}, x.Locate([]byte("A")))
+}
+
+func TestIndexCheckpointBoundary(t *testing.T) {
+	// With the sentinel the BWT has exactly one occurrence checkpoint's worth
+	// of rows, so searching ranks the row after the last.
+	text := bytes.Repeat([]byte("ab"), occStep/2)
+	x := New(text[1:], 0)
+
+	assert.Equal(t, occStep/2-1, x.Count([]byte("ab")))
+	assert.Equal(t, occStep/2, fromBWT(t, append(text[1:], 'c'), 0).Count([]byte("b")))
+}
+
+func TestIndexRandom(t *testing.T) {
+	random := rand.New(rand.NewSource(16))
+	text := make([]byte, 5000)
+	for i := range text {
+		// A small alphabet with a zero byte gives many repeats.
+		text[i] = []byte{0, 'a', 'b', 0xff}[random.Intn(4)]
+	}
+
+	for _, sampleRate := range []int{1, 7, 32} {
+		x := New(text, sampleRate)
+		for i := 0; i < 200; i++ {
+			start := random.Intn(len(text))
+			end := min(start+1+random.Intn(8), len(text))
+			pattern := text[start:end]
+
+			expected := naiveLocate(text, pattern)
+			assert.Equal(t, len(expected), x.Count(pattern))
+			assert.Equal(t, expected, x.Locate(pattern))
+		}
+	}
+}
+
+func TestIndexIliad(t *testing.T) {
+	text, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	x := New(text, DefaultSampleRate)
+	for _, word := range []string{"Achilles", "Hector", "wrath", "swift-footed", "the", "Zeus"} {
+		expected := naiveLocate(text, []byte(word))
+		assert.Equal(t, len(expected), x.Count([]byte(word)), word)
+		assert.Equal(t, expected, x.Locate([]byte(word)), word)
+	}
+}
+
+func BenchmarkIndexNewIliad(b *testing.B) {
+	text, err := os.ReadFile(iliadPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		New(text, DefaultSampleRate)
+	}
+}
+
+func BenchmarkIndexLocateIliad(b *testing.B) {
+	text, err := os.ReadFile(iliadPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	x := New(text, DefaultSampleRate)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Locate([]byte("Achilles"))
+	}
+}
+
+// fromBWT builds an Index over the rotations of text as a reader of a
+// container with search data would.
+func fromBWT(t *testing.T, text []byte, sampleRate int) *Index {
+	bwt, primary := bwtlib.BWTIndexed(text)
+	x, err := FromBWT(bwt, primary, Samples(bwt, primary, sampleRate))
+	assert.NoError(t, err)
+
+	return x
+}
+
+func TestFromBWTBasic(t *testing.T) {
+	x := fromBWT(t, []byte("BANANA"), 1)
+
+	assert.Equal(t, 6, x.Len())
+	assert.Equal(t, 3, x.Count([]byte("A")))
+	assert.Equal(t, 2, x.Count([]byte("ANA")))
+	assert.Equal(t, 1, x.Count([]byte("BANANA")))
+	assert.Equal(t, []int{1, 3}, x.Locate([]byte("ANA")))
+
+	// Over the rotations "AB" and "NANAB" wrap around the end of the text.
+	assert.Equal(t, 0, x.Count([]byte("AB")))
+	assert.Equal(t, []int{}, x.Locate([]byte("AB")))
+	assert.Equal(t, 0, x.Count([]byte("NANAB")))
+	assert.Equal(t, 0, x.Count([]byte("BANANAB")))
+}
+
+func TestFromBWTRandom(t *testing.T) {
+	random := rand.New(rand.NewSource(17))
+	text := make([]byte, 5000)
+	for i := range text {
+		text[i] = []byte{0, 'a', 'b', 0xff}[random.Intn(4)]
+	}
+
+	for _, sampleRate := range []int{1, 7, 32} {
+		x := fromBWT(t, text, sampleRate)
+		for i := 0; i < 200; i++ {
+			start := random.Intn(len(text))
+			end := min(start+1+random.Intn(8), len(text))
+			pattern := text[start:end]
+
+			expected := naiveLocate(text, pattern)
+			assert.Equal(t, len(expected), x.Count(pattern))
+			assert.Equal(t, expected, x.Locate(pattern))
+			assert.Equal(t, pattern, x.Extract(start, end))
+		}
+
+		assert.Equal(t, text, x.Extract(0, len(text)))
+		assert.Equal(t, []byte{}, x.Extract(len(text), len(text)))
+	}
+}
+
+func TestFromBWTPeriodic(t *testing.T) {
+	bwt, primary := bwtlib.BWTIndexed([]byte("abcabcabc"))
+	assert.Nil(t, Samples(bwt, primary, 4))
+
+	bwt, primary = bwtlib.BWTIndexed([]byte("abcabcabd"))
+	assert.NotNil(t, Samples(bwt, primary, 4))
+}
+
+func TestFromBWTMalformed(t *testing.T) {
+	bwt, primary := bwtlib.BWTIndexed([]byte("mississippi"))
+	samples := Samples(bwt, primary, 4)
+
+	_, err := FromBWT(bwt, primary, samples[:len(samples)-1])
+	assert.ErrorIs(t, err, ErrMalformedSamples)
+
+	_, err = FromBWT(bwt, (primary+1)%len(bwt), samples)
+	assert.ErrorIs(t, err, ErrMalformedSamples)
+
+	duplicate := append([]byte{}, samples...)
+	copy(duplicate[8:], duplicate[4:8])
+	_, err = FromBWT(bwt, primary, duplicate)
+	assert.ErrorIs(t, err, ErrMalformedSamples)
+}
+
+func TestExtract(t *testing.T) {
+	text := []byte("the quick brown fox jumps over the lazy dog")
+	x := New(text, 5)
+
+	for start := 0; start <= len(text); start++ {
+		for end := start; end <= len(text); end++ {
+			assert.Equal(t, text[start:end], x.Extract(start, end))
+		}
+	}
+}
+
+func TestLocateFold(t *testing.T) {
+	text := []byte("Sing, O goddess, the anger of Achilles son of Peleus, ACHILLES, achilles.")
+
+	for _, x := range []*Index{New(text, 3), fromBWT(t, text, 3)} {
+		assert.Equal(t, []int{30, 54, 64}, x.LocateFold([]byte("aChIlLeS")))
+		assert.Equal(t, []int{30}, x.Locate([]byte("Achilles")))
+		assert.Equal(t, []int{4}, x.LocateFold([]byte(", o")))
+		assert.Equal(t, []int{}, x.LocateFold([]byte("zeus")))
+	}
+}
@@ -0,0 +1,376 @@
+package formatlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrChecksum is wrapped by a CorruptionError when decoded data does not
+// match its checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// CorruptionError reports a block that could not be decoded or did not match
+// its checksum.
+type CorruptionError struct {
+	// Block is the index of the corrupt block. A stream checksum mismatch
+	// reports the number of blocks in the stream.
+	Block int
+	// Offset is where the block starts in the reader's output.
+	Offset int64
+	// Err describes the corruption.
+	Err error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt block %v at offset %v: %v", e.Block, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Checksum returns the CRC32 stored for a block of original data.
+func Checksum(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// combineChecksum folds a block checksum into the stream checksum, as bzip2
+// does, so that missing or reordered blocks change the result.
+func combineChecksum(stream uint32, block uint32) uint32 {
+	return (stream<<1 | stream>>31) ^ block
+}
+
+func checksumMismatch(expected, actual uint32) error {
+	return fmt.Errorf("%w: expected %#08x, got %#08x", ErrChecksum, expected, actual)
+}
+
+// Block is a block read by a BlockReader.
+type Block struct {
+	// Index is the position of the block in the stream.
+	Index int
+	// Data is the encoded block.
+	Data []byte
+	// Checksum is the CRC32 of the block's original data, if the container
+	// has FlagChecksum.
+	Checksum uint32
+	// Search is the block's search data, if the container has FlagSearch.
+	Search []byte
+}
+
+const (
+	// maxBlockExpansion bounds how many times larger than the header's
+	// BlockSize a block's encoded data and search data may be. Stages can
+	// grow a block, such as run length coding with long run lengths, but
+	// by far less than this, so a larger frame must be corrupt.
+	maxBlockExpansion = 16
+	// maxFrameSlack allows for the fixed size fields stages add to small
+	// blocks, such as the primary index and coding tables.
+	maxFrameSlack = 64 * 1024
+	// maxRawFrameSize bounds the frames of headerless streams, which do not
+	// record their block size.
+	maxRawFrameSize = 1 << 28
+)
+
+// maxFrameSize returns the largest encoded block and search data a frame of a
+// container with header may hold, so that a corrupt frame size is rejected
+// rather than allocated.
+func maxFrameSize(header Header, raw bool) int {
+	if raw {
+		return maxRawFrameSize
+	}
+
+	return maxBlockExpansion*header.BlockSize + maxFrameSlack
+}
+
+// MaxStageSize returns the largest block any stage of a container with header
+// may decode to, which is the largest frame it may hold. Decoders whose
+// output is not bounded by the size of their input check against it, so that
+// a small corrupt block cannot make them allocate without limit.
+func (h Header) MaxStageSize() int {
+	return maxFrameSize(h, false)
+}
+
+// frameTooLarge describes a frame larger than maxFrameSize.
+func frameTooLarge(size, limit int) error {
+	return fmt.Errorf("frame of %v bytes exceeds the maximum of %v", size, limit)
+}
+
+// frameHeaderSize returns the size of the fields before each block's data: the
+// size, then the checksum with FlagChecksum and the search data size with
+// FlagSearch.
+func frameHeaderSize(flags Flags) int {
+	size := 4
+	if flags&FlagChecksum != 0 {
+		size += 4
+	}
+
+	if flags&FlagSearch != 0 {
+		size += 4
+	}
+
+	return size
+}
+
+// parseFrameHeader fills in the checksum of block from a frame header and
+// returns the size of its search data.
+func parseFrameHeader(flags Flags, frameHeader []byte, block *Block) int {
+	if flags&FlagChecksum != 0 {
+		block.Checksum = binary.LittleEndian.Uint32(frameHeader[4:])
+	}
+
+	if flags&FlagSearch == 0 {
+		return 0
+	}
+
+	return int(binary.LittleEndian.Uint32(frameHeader[len(frameHeader)-4:]))
+}
+
+// BlockWriter writes the blocks of a container. When the header has
+// FlagChecksum each block's size is followed by the checksum of its original
+// data, and the end of stream marker is followed by the stream checksum. When
+// it has FlagSearch each block is followed by its search data.
+type BlockWriter struct {
+	w              io.Writer
+	header         Header
+	raw            bool
+	streamChecksum uint32
+}
+
+// NewBlockWriter writes the container header to w and returns a BlockWriter
+// for its blocks.
+func NewBlockWriter(w io.Writer, header Header) (*BlockWriter, error) {
+	if err := WriteHeader(w, header); err != nil {
+		return nil, err
+	}
+
+	return &BlockWriter{w: w, header: header}, nil
+}
+
+// NewRawBlockWriter returns a BlockWriter for the headerless streams written
+// by bwtlib.BWTStream, which have no checksums or end of stream marker.
+func NewRawBlockWriter(w io.Writer) *BlockWriter {
+	return &BlockWriter{w: w, raw: true}
+}
+
+// WriteBlock writes an encoded block along with the checksum of its original
+// data, which is ignored without FlagChecksum.
+func (b *BlockWriter) WriteBlock(data []byte, checksum uint32) error {
+	return b.WriteSearchableBlock(data, checksum, nil)
+}
+
+// WriteSearchableBlock writes an encoded block along with the checksum of its
+// original data and its search data, which are ignored without FlagChecksum
+// and FlagSearch respectively.
+func (b *BlockWriter) WriteSearchableBlock(data []byte, checksum uint32, search []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if b.header.Flags&FlagSearch == 0 {
+		search = nil
+	}
+
+	if limit := maxFrameSize(b.header, b.raw); len(data)+len(search) > limit {
+		return frameTooLarge(len(data)+len(search), limit)
+	}
+
+	if b.header.Flags&(FlagChecksum|FlagSearch) == 0 {
+		return WriteBlock(b.w, data)
+	}
+
+	frameHeader := make([]byte, 0, frameHeaderSize(b.header.Flags))
+	frameHeader = binary.LittleEndian.AppendUint32(frameHeader, uint32(len(data)))
+	if b.header.Flags&FlagChecksum != 0 {
+		b.streamChecksum = combineChecksum(b.streamChecksum, checksum)
+		frameHeader = binary.LittleEndian.AppendUint32(frameHeader, checksum)
+	}
+
+	if b.header.Flags&FlagSearch != 0 {
+		frameHeader = binary.LittleEndian.AppendUint32(frameHeader, uint32(len(search)))
+	}
+
+	for _, part := range [][]byte{frameHeader, data, search} {
+		if _, err := b.w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close writes the end of stream marker and trailer. It does not close the
+// underlying writer.
+func (b *BlockWriter) Close() error {
+	if b.raw {
+		return nil
+	}
+
+	if err := WriteEnd(b.w); err != nil {
+		return err
+	}
+
+	if b.header.Flags&FlagChecksum == 0 {
+		return nil
+	}
+
+	_, err := b.w.Write(binary.LittleEndian.AppendUint32(nil, b.streamChecksum))
+
+	return err
+}
+
+// BlockReader reads the blocks of a container written by a BlockWriter.
+type BlockReader struct {
+	// Header is the container header.
+	Header Header
+
+	r              io.Reader
+	raw            bool
+	index          int
+	offset         int64
+	streamChecksum uint32
+	trailer        []byte
+}
+
+// NewBlockReader reads the container header from r and returns a BlockReader
+// for its blocks.
+func NewBlockReader(r io.Reader) (*BlockReader, error) {
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockReader{Header: header, r: r}, nil
+}
+
+// NewRawBlockReader returns a BlockReader for the headerless streams written by
+// bwtlib.BWTStream, which may end at a block boundary without a marker.
+func NewRawBlockReader(r io.Reader) *BlockReader {
+	return &BlockReader{r: r, raw: true}
+}
+
+// Next reads the next block into buffer, growing it if needed. It returns
+// io.EOF at the end of stream, after which Finish checks the stream checksum.
+func (b *BlockReader) Next(buffer []byte) (Block, error) {
+	frameHeader := make([]byte, frameHeaderSize(b.Header.Flags))
+	n, err := io.ReadFull(b.r, frameHeader[:4])
+	if err != nil {
+		if b.raw && n == 0 && errors.Is(err, io.EOF) {
+			return Block{}, io.EOF
+		}
+
+		return Block{}, truncated(err)
+	}
+
+	blockSize := int(binary.LittleEndian.Uint32(frameHeader))
+	if blockSize == 0 {
+		return Block{}, b.end()
+	}
+
+	if _, err := io.ReadFull(b.r, frameHeader[4:]); err != nil {
+		return Block{}, truncated(err)
+	}
+
+	block := Block{Index: b.index}
+	searchSize := parseFrameHeader(b.Header.Flags, frameHeader, &block)
+	if limit := maxFrameSize(b.Header, b.raw); blockSize+searchSize > limit {
+		return Block{}, &CorruptionError{Block: b.index, Offset: b.offset, Err: frameTooLarge(blockSize+searchSize, limit)}
+	}
+
+	if cap(buffer) < blockSize+searchSize {
+		buffer = make([]byte, blockSize+searchSize)
+	}
+
+	payload := buffer[:blockSize+searchSize]
+	if _, err := io.ReadFull(b.r, payload); err != nil {
+		return Block{}, truncated(err)
+	}
+
+	block.Data = payload[:blockSize]
+	if searchSize > 0 {
+		block.Search = payload[blockSize:]
+	}
+
+	if b.Header.Flags&FlagChecksum != 0 {
+		b.streamChecksum = combineChecksum(b.streamChecksum, block.Checksum)
+	}
+	b.index++
+
+	return block, nil
+}
+
+// end reads the trailer after the end of stream marker.
+func (b *BlockReader) end() error {
+	if b.Header.Flags&FlagChecksum == 0 {
+		return io.EOF
+	}
+
+	b.trailer = make([]byte, 4)
+	if _, err := io.ReadFull(b.r, b.trailer); err != nil {
+		return truncated(err)
+	}
+
+	return io.EOF
+}
+
+// Finish checks the stream checksum in the trailer. It must be called after
+// Next has returned io.EOF and every block has been verified, so that a
+// corrupt block is reported in preference to the stream checksum.
+func (b *BlockReader) Finish() error {
+	if b.trailer == nil {
+		return nil
+	}
+
+	expected := binary.LittleEndian.Uint32(b.trailer)
+	if expected != b.streamChecksum {
+		return &CorruptionError{Block: b.index, Offset: b.offset, Err: checksumMismatch(expected, b.streamChecksum)}
+	}
+
+	return nil
+}
+
+// Verify checks original, the decoded data of block, against the block's
+// checksum and advances the output offset past it. Blocks must be verified in
+// order.
+func (b *BlockReader) Verify(block Block, original []byte) error {
+	if err := VerifyBlock(b.Header, block, original, b.offset); err != nil {
+		return err
+	}
+
+	b.Advance(len(original))
+
+	return nil
+}
+
+// VerifyBlock checks original, the decoded data of block, against the block's
+// checksum if the container has one. offset is where the block starts in the
+// original data.
+func VerifyBlock(header Header, block Block, original []byte, offset int64) error {
+	if header.Flags&FlagChecksum == 0 {
+		return nil
+	}
+
+	if actual := Checksum(original); actual != block.Checksum {
+		return &CorruptionError{Block: block.Index, Offset: offset, Err: checksumMismatch(block.Checksum, actual)}
+	}
+
+	return nil
+}
+
+// Advance moves the output offset past n bytes decoded from the current
+// block, for readers that do not verify the original data.
+func (b *BlockReader) Advance(n int) {
+	b.offset += int64(n)
+}
+
+// Corrupt wraps an error decoding block in a CorruptionError.
+func (b *BlockReader) Corrupt(block Block, err error) error {
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) {
+		return err
+	}
+
+	return &CorruptionError{Block: block.Index, Offset: b.offset, Err: err}
+}
@@ -0,0 +1,422 @@
+package formatlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Magic is written at the start of every container.
+const Magic = "BWTZ"
+
+// Version is the container format version written by this package.
+const Version = 1
+
+var (
+	// ErrBadMagic is returned when the input is not a container.
+	ErrBadMagic = errors.New("not a bwt container: bad magic number")
+	// ErrUnsupportedVersion is returned for containers from a newer format.
+	ErrUnsupportedVersion = errors.New("unsupported bwt container version")
+	// ErrStageMismatch is returned when a container was not produced by the
+	// stages the reader expects.
+	ErrStageMismatch = errors.New("bwt container stage mismatch")
+	// ErrTruncated is returned when a container ends before its end of stream
+	// marker.
+	ErrTruncated = errors.New("bwt container truncated")
+)
+
+// Stage identifies a transform applied to every block of a container.
+type Stage byte
+
+const (
+	// StageBWT is the Burrows-Wheeler transform from bwtlib.
+	StageBWT Stage = iota + 1
+	// StageMTF is the move to front transform from mtflib.
+	StageMTF
+	// StageRLE is the run length encoding from compresslib.
+	StageRLE
+	// StageHuffman is the Huffman coding from huffmanlib.
+	StageHuffman
+	// StageRange is the adaptive range coding from rangelib.
+	StageRange
+	// StageDistance is the distance coding from distancelib.
+	StageDistance
+	// StageInversion is the inversion frequencies transform from
+	// distancelib.
+	StageInversion
+	// StageRLE1 is the run length encoding from compresslib with its RLE1
+	// parameters, applied before StageBWT to shorten long runs.
+	StageRLE1
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageBWT:
+		return "bwt"
+	case StageMTF:
+		return "mtf"
+	case StageRLE:
+		return "rle"
+	case StageHuffman:
+		return "huffman"
+	case StageRange:
+		return "range"
+	case StageDistance:
+		return "dc"
+	case StageInversion:
+		return "if"
+	case StageRLE1:
+		return "rle1"
+	default:
+		return fmt.Sprintf("stage(%d)", byte(s))
+	}
+}
+
+// Flags enables optional container features.
+type Flags byte
+
+const (
+	// FlagChecksum stores a CRC32 of the original data of each block and of
+	// the whole stream.
+	FlagChecksum Flags = 1 << iota
+	// FlagIndex appends an index of every block after the trailer, so that
+	// the container can be read from any offset.
+	FlagIndex
+	// FlagSearch stores search data after each block, such as the fmindexlib
+	// samples written by pipelinelib, so that the block can be searched
+	// without being decoded.
+	FlagSearch
+
+	knownFlags = FlagChecksum | FlagIndex | FlagSearch
+)
+
+// Header describes how the blocks of a container were encoded.
+type Header struct {
+	// Flags enables optional container features.
+	Flags Flags
+	// Stages lists the transforms applied to each block, in the order they
+	// were applied.
+	Stages []Stage
+	// BlockSize is the maximum number of original bytes in a block.
+	BlockSize int
+	// Transform is the bwtlib.Transform used by StageBWT.
+	Transform byte
+	// MTFVariant is the mtflib.Variant used by StageMTF.
+	MTFVariant byte
+	// MinRun and RunLengthBytes are the compresslib parameters used by
+	// StageRLE.
+	MinRun         int
+	RunLengthBytes int
+	// RLEMode is the compresslib.Mode used by StageRLE.
+	RLEMode byte
+}
+
+// LastStage returns the most recently applied stage, or 0 if there are none.
+func (h Header) LastStage() Stage {
+	if len(h.Stages) == 0 {
+		return 0
+	}
+
+	return h.Stages[len(h.Stages)-1]
+}
+
+// StagesString formats the stages as a pipeline, such as "bwt|mtf|rle".
+func (h Header) StagesString() string {
+	names := make([]string, 0, len(h.Stages))
+	for _, stage := range h.Stages {
+		names = append(names, stage.String())
+	}
+
+	return strings.Join(names, "|")
+}
+
+// ExpectStages returns ErrStageMismatch unless the header has exactly the
+// given stages.
+func (h Header) ExpectStages(stages ...Stage) error {
+	expected := Header{Stages: stages}
+	if h.StagesString() != expected.StagesString() {
+		return fmt.Errorf("%w: expected %q, got %q", ErrStageMismatch, expected.StagesString(), h.StagesString())
+	}
+
+	return nil
+}
+
+// stageParams returns the parameters stored after a stage in the header.
+func (h Header) stageParams(stage Stage) []byte {
+	switch stage {
+	case StageBWT:
+		return []byte{h.Transform}
+	case StageMTF:
+		return []byte{h.MTFVariant}
+	case StageRLE:
+		return []byte{byte(h.MinRun), byte(h.RunLengthBytes), h.RLEMode}
+	default:
+		return nil
+	}
+}
+
+// minStageParams returns the fewest parameters a stage may have. Parameters
+// added to a stage after containers were first written with it are optional,
+// leaving their zero values, so that older containers can still be read.
+func minStageParams(stage Stage) int {
+	switch stage {
+	case StageBWT:
+		return 1
+	case StageRLE:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// setStageParams reads the parameters stored after a stage in the header.
+func (h *Header) setStageParams(stage Stage, params []byte) error {
+	if expected := minStageParams(stage); len(params) < expected {
+		return fmt.Errorf("malformed %v parameters of %v bytes, expected %v", stage, len(params), expected)
+	}
+
+	switch stage {
+	case StageBWT:
+		h.Transform = params[0]
+	case StageMTF:
+		if len(params) > 0 {
+			h.MTFVariant = params[0]
+		}
+	case StageHuffman, StageRange, StageDistance, StageInversion, StageRLE1:
+	case StageRLE:
+		h.MinRun = int(params[0])
+		h.RunLengthBytes = int(params[1])
+		if len(params) > 2 {
+			h.RLEMode = params[2]
+		}
+	default:
+		return fmt.Errorf("unknown stage %v", stage)
+	}
+
+	return nil
+}
+
+// WriteHeader writes the container header. The header is laid out as the
+// magic number, the version, the flags, the 4 byte little-endian
+// block size and the stage count, followed by each stage's id, parameter
+// length and parameters.
+func WriteHeader(output io.Writer, h Header) error {
+	if len(h.Stages) > 0xff {
+		return fmt.Errorf("too many stages: %v", len(h.Stages))
+	}
+
+	buffer := make([]byte, 0, 16)
+	buffer = append(buffer, Magic...)
+	buffer = append(buffer, Version, byte(h.Flags))
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(h.BlockSize))
+	buffer = append(buffer, byte(len(h.Stages)))
+	for _, stage := range h.Stages {
+		params := h.stageParams(stage)
+		buffer = append(buffer, byte(stage), byte(len(params)))
+		buffer = append(buffer, params...)
+	}
+
+	_, err := output.Write(buffer)
+
+	return err
+}
+
+// ReadHeader reads and validates a container header.
+func ReadHeader(input io.Reader) (Header, error) {
+	var h Header
+
+	fixed := make([]byte, len(Magic)+7)
+	if _, err := io.ReadFull(input, fixed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return h, ErrBadMagic
+		}
+
+		return h, err
+	}
+
+	if string(fixed[:len(Magic)]) != Magic {
+		return h, ErrBadMagic
+	}
+
+	fixed = fixed[len(Magic):]
+	if fixed[0] != Version {
+		return h, fmt.Errorf("%w: %v", ErrUnsupportedVersion, fixed[0])
+	}
+
+	h.Flags = Flags(fixed[1])
+	if h.Flags&^knownFlags != 0 {
+		return h, fmt.Errorf("%w: unknown flags %#x", ErrUnsupportedVersion, byte(h.Flags&^knownFlags))
+	}
+
+	h.BlockSize = int(binary.LittleEndian.Uint32(fixed[2:]))
+	stageCount := int(fixed[6])
+
+	stageHeader := make([]byte, 2)
+	for i := 0; i < stageCount; i++ {
+		if _, err := io.ReadFull(input, stageHeader); err != nil {
+			return h, truncated(err)
+		}
+
+		params := make([]byte, stageHeader[1])
+		if _, err := io.ReadFull(input, params); err != nil {
+			return h, truncated(err)
+		}
+
+		stage := Stage(stageHeader[0])
+		if err := h.setStageParams(stage, params); err != nil {
+			return h, err
+		}
+
+		h.Stages = append(h.Stages, stage)
+	}
+
+	return h, nil
+}
+
+// truncated converts an unexpected end of input into ErrTruncated.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+
+	return err
+}
+
+// WriteBlock writes a block as its 4 byte little-endian size followed by its
+// contents. Empty blocks are skipped as a size of 0 marks the end of stream.
+func WriteBlock(output io.Writer, block []byte) error {
+	if len(block) == 0 {
+		return nil
+	}
+
+	if _, err := output.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(block)))); err != nil {
+		return err
+	}
+
+	_, err := output.Write(block)
+
+	return err
+}
+
+// WriteEnd writes the end of stream marker.
+func WriteEnd(output io.Writer) error {
+	_, err := output.Write(make([]byte, 4))
+
+	return err
+}
+
+// ReadBlock reads the next block into buffer, growing it if needed, and
+// returns the block. It returns io.EOF at the end of stream marker and
+// ErrTruncated if the input ends before the marker.
+func ReadBlock(input io.Reader, buffer []byte) ([]byte, error) {
+	blockSizeBuffer := make([]byte, 4)
+	if _, err := io.ReadFull(input, blockSizeBuffer); err != nil {
+		return nil, truncated(err)
+	}
+
+	blockSize := int(binary.LittleEndian.Uint32(blockSizeBuffer))
+	if blockSize == 0 {
+		return nil, io.EOF
+	}
+
+	if cap(buffer) < blockSize {
+		buffer = make([]byte, blockSize)
+	}
+
+	block := buffer[:blockSize]
+	if _, err := io.ReadFull(input, block); err != nil {
+		return nil, truncated(err)
+	}
+
+	return block, nil
+}
+
+// BlockFunc transforms a single block of a container described by header.
+type BlockFunc func(header Header, block []byte) ([]byte, error)
+
+// Push reads a container from input and writes it to output with stage
+// appended to its header. configure may set the stage's parameters, and every
+// block is replaced by the result of fn.
+func Push(input io.Reader, output io.Writer, stage Stage, configure func(*Header), fn BlockFunc) error {
+	reader, err := NewBlockReader(input)
+	if err != nil {
+		return err
+	}
+
+	h := reader.Header
+	h.Stages = append(append([]Stage{}, h.Stages...), stage)
+	if configure != nil {
+		configure(&h)
+	}
+
+	return copyBlocks(reader, output, h, fn)
+}
+
+// Pop reads a container whose last stage is stage from input and writes it to
+// output without that stage, replacing every block by the result of fn.
+func Pop(input io.Reader, output io.Writer, stage Stage, fn BlockFunc) error {
+	reader, err := NewBlockReader(input)
+	if err != nil {
+		return err
+	}
+
+	h := reader.Header
+	if h.LastStage() != stage {
+		return fmt.Errorf("%w: expected last stage %v, got %q", ErrStageMismatch, stage, h.StagesString())
+	}
+
+	popped := h
+	popped.Stages = h.Stages[:len(h.Stages)-1]
+
+	return copyBlocks(reader, output, popped, fn)
+}
+
+// copyBlocks writes a container with header h to output, holding the blocks
+// from reader after passing them through fn. The checksums of the original
+// data are carried over unchanged, and verified once every stage has been
+// undone. The block index and search data are dropped as the blocks move.
+func copyBlocks(reader *BlockReader, output io.Writer, h Header, fn BlockFunc) error {
+	h.Flags &^= FlagIndex | FlagSearch
+
+	writer, err := NewBlockWriter(output, h)
+	if err != nil {
+		return err
+	}
+
+	var buffer []byte
+	for {
+		block, err := reader.Next(buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return err
+		}
+		buffer = block.Data
+
+		data, err := fn(h, block.Data)
+		if err != nil {
+			return reader.Corrupt(block, err)
+		}
+		if len(h.Stages) == 0 {
+			if err := reader.Verify(block, data); err != nil {
+				return err
+			}
+		} else {
+			reader.Advance(len(data))
+		}
+
+		if err := writer.WriteBlock(data, block.Checksum); err != nil {
+			return err
+		}
+	}
+
+	if err := reader.Finish(); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
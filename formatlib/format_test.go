@@ -0,0 +1,403 @@
+package formatlib
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderBasic(t *testing.T) {
+	header := Header{
+		Stages:         []Stage{StageBWT, StageMTF, StageRLE},
+		BlockSize:      512 * 1024,
+		Transform:      1,
+		MTFVariant:     3,
+		MinRun:         4,
+		RunLengthBytes: 1,
+		RLEMode:        2,
+	}
+	expected := []byte("BWTZ\x01\x00\x00\x00\x08\x00\x03\x01\x01\x01\x02\x01\x03\x03\x03\x04\x01\x02")
+
+	var output bytes.Buffer
+	err := WriteHeader(&output, header)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, output.Bytes())
+
+	decoded, err := ReadHeader(bytes.NewReader(expected))
+	assert.NoError(t, err)
+	assert.Equal(t, header, decoded)
+}
+
+func TestReadHeaderOptionalParams(t *testing.T) {
+	// Containers written before the MTF variants and RLE modes have no MTF
+	// parameters and two RLE parameters.
+	header, err := ReadHeader(bytes.NewReader([]byte("BWTZ\x01\x00\x00\x00\x08\x00\x03\x01\x01\x01\x02\x00\x03\x02\x04\x01")))
+	assert.NoError(t, err)
+	assert.Equal(t, []Stage{StageBWT, StageMTF, StageRLE}, header.Stages)
+	assert.Equal(t, byte(0), header.MTFVariant)
+	assert.Equal(t, 4, header.MinRun)
+	assert.Equal(t, 1, header.RunLengthBytes)
+	assert.Equal(t, byte(0), header.RLEMode)
+
+	_, err = ReadHeader(bytes.NewReader([]byte("BWTZ\x01\x00\x00\x00\x08\x00\x01\x03\x01\x04")))
+	assert.Error(t, err)
+}
+
+func TestReadHeaderBadMagic(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("\x08\x00\x00\x00\x03ANNB\x02AA")))
+	assert.ErrorIs(t, err, ErrBadMagic)
+}
+
+func TestReadHeaderEmpty(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte{}))
+	assert.ErrorIs(t, err, ErrBadMagic)
+}
+
+func TestReadHeaderNewerVersion(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("BWTZ\x02\x00\x00\x00\x08\x00\x00")))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestReadHeaderUnknownFlags(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("BWTZ\x01\x80\x00\x00\x08\x00\x00")))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestReadHeaderUnknownStage(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("BWTZ\x01\x00\x00\x00\x08\x00\x01\x7f\x00")))
+	assert.Error(t, err)
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("BWTZ\x01\x00\x00\x00\x08\x00\x01\x01")))
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestExpectStages(t *testing.T) {
+	header := Header{Stages: []Stage{StageBWT, StageMTF}}
+
+	assert.NoError(t, header.ExpectStages(StageBWT, StageMTF))
+	assert.ErrorIs(t, header.ExpectStages(StageBWT), ErrStageMismatch)
+}
+
+func TestReadBlock(t *testing.T) {
+	input := bytes.NewReader([]byte("\x03\x00\x00\x00abc\x01\x00\x00\x00d\x00\x00\x00\x00"))
+
+	block, err := ReadBlock(input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), block)
+
+	block, err = ReadBlock(input, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), block)
+
+	_, err = ReadBlock(input, block)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadBlockTruncated(t *testing.T) {
+	_, err := ReadBlock(bytes.NewReader([]byte("\x03\x00\x00\x00ab")), nil)
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	_, err = ReadBlock(bytes.NewReader([]byte{}), nil)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestPushPop(t *testing.T) {
+	var input bytes.Buffer
+	assert.NoError(t, WriteHeader(&input, Header{Stages: []Stage{StageBWT}, BlockSize: 256}))
+	assert.NoError(t, WriteBlock(&input, []byte("abc")))
+	assert.NoError(t, WriteBlock(&input, []byte("de")))
+	assert.NoError(t, WriteEnd(&input))
+	original := append([]byte{}, input.Bytes()...)
+
+	reverse := func(header Header, block []byte) ([]byte, error) {
+		reversed := make([]byte, len(block))
+		for i, c := range block {
+			reversed[len(block)-1-i] = c
+		}
+
+		return reversed, nil
+	}
+
+	var pushed bytes.Buffer
+	err := Push(&input, &pushed, StageRLE, func(h *Header) {
+		h.MinRun = 4
+		h.RunLengthBytes = 1
+	}, reverse)
+	assert.NoError(t, err)
+
+	header, err := ReadHeader(bytes.NewReader(pushed.Bytes()))
+	assert.NoError(t, err)
+	assert.NoError(t, header.ExpectStages(StageBWT, StageRLE))
+	assert.Equal(t, 4, header.MinRun)
+
+	var popped bytes.Buffer
+	err = Pop(bytes.NewReader(pushed.Bytes()), &popped, StageMTF, reverse)
+	assert.ErrorIs(t, err, ErrStageMismatch)
+
+	popped.Reset()
+	err = Pop(bytes.NewReader(pushed.Bytes()), &popped, StageRLE, reverse)
+	assert.NoError(t, err)
+	assert.Equal(t, original, popped.Bytes())
+}
+
+func TestPushConfiguredHeader(t *testing.T) {
+	var input bytes.Buffer
+	writer, err := NewBlockWriter(&input, Header{Flags: FlagChecksum, Stages: []Stage{StageBWT}, BlockSize: 256, Transform: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock([]byte("abc"), Checksum([]byte("abc"))))
+	assert.NoError(t, writer.WriteBlock([]byte("de"), Checksum([]byte("de"))))
+	assert.NoError(t, writer.Close())
+
+	var headers []Header
+	record := func(header Header, block []byte) ([]byte, error) {
+		headers = append(headers, header)
+		return block, nil
+	}
+
+	var pushed bytes.Buffer
+	err = Push(&input, &pushed, StageRLE, func(h *Header) {
+		h.MinRun = 3
+		h.RunLengthBytes = 2
+	}, record)
+	assert.NoError(t, err)
+
+	configured := Header{
+		Flags:          FlagChecksum,
+		Stages:         []Stage{StageBWT, StageRLE},
+		BlockSize:      256,
+		Transform:      1,
+		MinRun:         3,
+		RunLengthBytes: 2,
+	}
+	written, err := ReadHeader(bytes.NewReader(pushed.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, configured, written)
+	assert.Equal(t, []Header{configured, configured}, headers)
+
+	// Pop passes the header without the stage, keeping its parameters.
+	headers = nil
+	err = Pop(bytes.NewReader(pushed.Bytes()), io.Discard, StageRLE, record)
+	assert.NoError(t, err)
+
+	popped := configured
+	popped.Stages = []Stage{StageBWT}
+	assert.Equal(t, []Header{popped, popped}, headers)
+}
+
+func TestBlockChecksums(t *testing.T) {
+	header := Header{Flags: FlagChecksum, Stages: []Stage{StageBWT}, BlockSize: 256}
+
+	var output bytes.Buffer
+	writer, err := NewBlockWriter(&output, header)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock([]byte("cba"), Checksum([]byte("abc"))))
+	assert.NoError(t, writer.WriteBlock([]byte("ed"), Checksum([]byte("de"))))
+	assert.NoError(t, writer.Close())
+
+	reader, err := NewBlockReader(bytes.NewReader(output.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, header, reader.Header)
+
+	block, err := reader.Next(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, block.Index)
+	assert.Equal(t, []byte("cba"), block.Data)
+	assert.NoError(t, reader.Verify(block, []byte("abc")))
+
+	block, err = reader.Next(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, block.Index)
+
+	err = reader.Verify(block, []byte("dx"))
+	var corruption *CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, ErrChecksum)
+	assert.Equal(t, 1, corruption.Block)
+	assert.Equal(t, int64(3), corruption.Offset)
+
+	_, err = reader.Next(nil)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, reader.Finish())
+}
+
+func TestBlockReaderFrameTooLarge(t *testing.T) {
+	header := Header{Flags: FlagChecksum | FlagSearch, Stages: []Stage{StageBWT}, BlockSize: 256}
+
+	var output bytes.Buffer
+	writer, err := NewBlockWriter(&output, header)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteSearchableBlock([]byte("abc"), Checksum([]byte("abc")), []byte("s")))
+	prefix := len(output.Bytes())
+	assert.NoError(t, writer.WriteSearchableBlock([]byte("de"), Checksum([]byte("de")), nil))
+	assert.NoError(t, writer.Close())
+
+	// Claim a block of about 4 GiB, then a huge search data size, in the
+	// second frame.
+	for _, field := range []int{0, 8} {
+		stream := bytes.Clone(output.Bytes())
+		copy(stream[prefix+field:], "\xff\xff\xff\xff")
+
+		reader, err := NewBlockReader(bytes.NewReader(stream))
+		assert.NoError(t, err)
+
+		block, err := reader.Next(nil)
+		assert.NoError(t, err)
+		assert.NoError(t, reader.Verify(block, []byte("abc")))
+
+		_, err = reader.Next(nil)
+		var corruption *CorruptionError
+		assert.ErrorAs(t, err, &corruption)
+		assert.Equal(t, 1, corruption.Block)
+		assert.Equal(t, int64(3), corruption.Offset)
+	}
+
+	limit := maxFrameSize(header, false)
+	err = writer.WriteBlock(make([]byte, limit+1), 0)
+	assert.Error(t, err)
+}
+
+func TestBlockChecksumsStreamMismatch(t *testing.T) {
+	header := Header{Flags: FlagChecksum, Stages: []Stage{StageBWT}, BlockSize: 256}
+
+	var output bytes.Buffer
+	writer, err := NewBlockWriter(&output, header)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock([]byte("abc"), Checksum([]byte("abc"))))
+	assert.NoError(t, writer.Close())
+
+	stream := output.Bytes()
+	stream[len(stream)-1] ^= 0x01
+
+	reader, err := NewBlockReader(bytes.NewReader(stream))
+	assert.NoError(t, err)
+
+	block, err := reader.Next(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Verify(block, []byte("abc")))
+
+	_, err = reader.Next(nil)
+	assert.ErrorIs(t, err, io.EOF)
+
+	err = reader.Finish()
+	var corruption *CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorIs(t, err, ErrChecksum)
+	assert.Equal(t, 1, corruption.Block)
+	assert.Equal(t, int64(3), corruption.Offset)
+}
+
+func TestBlockChecksumsTruncatedTrailer(t *testing.T) {
+	var output bytes.Buffer
+	writer, err := NewBlockWriter(&output, Header{Flags: FlagChecksum, BlockSize: 256})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	reader, err := NewBlockReader(bytes.NewReader(output.Bytes()[:output.Len()-2]))
+	assert.NoError(t, err)
+
+	_, err = reader.Next(nil)
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestPopVerifiesChecksums(t *testing.T) {
+	var input bytes.Buffer
+	writer, err := NewBlockWriter(&input, Header{Flags: FlagChecksum, Stages: []Stage{StageMTF}, BlockSize: 256})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock([]byte("abc"), Checksum([]byte("abc"))))
+	assert.NoError(t, writer.WriteBlock([]byte("de"), Checksum([]byte("de"))))
+	assert.NoError(t, writer.Close())
+
+	identity := func(header Header, block []byte) ([]byte, error) {
+		return block, nil
+	}
+
+	err = Pop(bytes.NewReader(input.Bytes()), io.Discard, StageMTF, identity)
+	assert.NoError(t, err)
+
+	upper := func(header Header, block []byte) ([]byte, error) {
+		return bytes.ToUpper(block), nil
+	}
+
+	err = Pop(bytes.NewReader(input.Bytes()), io.Discard, StageMTF, upper)
+	var corruption *CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 0, corruption.Block)
+}
+
+func TestIndex(t *testing.T) {
+	entries := []IndexEntry{
+		{Offset: 14, Size: 10, OriginalOffset: 0, OriginalSize: 100},
+		{Offset: 24, Size: 7, OriginalOffset: 100, OriginalSize: 40},
+	}
+
+	var output bytes.Buffer
+	output.Write(make([]byte, 35))
+	assert.NoError(t, WriteIndex(&output, 35, entries))
+
+	decoded, err := ReadIndex(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	assert.NoError(t, err)
+	assert.Equal(t, entries, decoded)
+
+	_, err = ReadIndex(bytes.NewReader(output.Bytes()[:output.Len()-1]), int64(output.Len()-1))
+	assert.ErrorIs(t, err, ErrNoIndex)
+}
+
+func TestIndexMalformed(t *testing.T) {
+	// The second block does not follow on from the first.
+	entries := []IndexEntry{
+		{Offset: 14, Size: 10, OriginalOffset: 0, OriginalSize: 100},
+		{Offset: 24, Size: 7, OriginalOffset: 90, OriginalSize: 40},
+	}
+
+	var output bytes.Buffer
+	output.Write(make([]byte, 35))
+	assert.NoError(t, WriteIndex(&output, 35, entries))
+
+	_, err := ReadIndex(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	assert.Error(t, err)
+}
+
+func TestBlockSearchData(t *testing.T) {
+	header := Header{Flags: FlagChecksum | FlagSearch, Stages: []Stage{StageBWT}, BlockSize: 16}
+
+	var output bytes.Buffer
+	writer, err := NewBlockWriter(&output, header)
+	assert.NoError(t, err)
+	headerSize := int64(output.Len())
+	assert.NoError(t, writer.WriteSearchableBlock([]byte("first"), 1, []byte("samples")))
+	second := int64(output.Len())
+	assert.NoError(t, writer.WriteBlock([]byte("second"), 2))
+	assert.NoError(t, writer.Close())
+
+	reader, err := NewBlockReader(bytes.NewReader(output.Bytes()))
+	assert.NoError(t, err)
+
+	block, err := reader.Next(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), block.Data)
+	assert.Equal(t, []byte("samples"), block.Search)
+
+	block, err = reader.Next(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), block.Data)
+	assert.Nil(t, block.Search)
+
+	_, err = reader.Next(nil)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, reader.Finish())
+
+	entry := IndexEntry{Offset: headerSize, Size: int(second - headerSize)}
+	block, err = ReadBlockAt(bytes.NewReader(output.Bytes()), header, 0, entry, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), block.Data)
+	assert.Equal(t, uint32(1), block.Checksum)
+	assert.Equal(t, []byte("samples"), block.Search)
+
+	entry.Size--
+	_, err = ReadBlockAt(bytes.NewReader(output.Bytes()), header, 0, entry, nil)
+	assert.Error(t, err)
+}
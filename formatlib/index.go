@@ -0,0 +1,136 @@
+package formatlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoIndex is returned when random access is requested from a container
+// without FlagIndex.
+var ErrNoIndex = errors.New("bwt container has no block index")
+
+const (
+	indexMagic      = "BWTI"
+	indexEntrySize  = 24
+	indexFooterSize = 16
+)
+
+// IndexEntry locates a block within a container and within the original data.
+type IndexEntry struct {
+	// Offset and Size give the block's whole frame, including its size,
+	// checksum and search data, relative to the start of the container.
+	Offset int64
+	Size   int
+	// OriginalOffset and OriginalSize give the block's original data.
+	OriginalOffset int64
+	OriginalSize   int
+}
+
+// WriteIndex writes the block index of a container with FlagIndex after its
+// trailer, where offset is the position of the index in the container. Each
+// entry is written as the 8 byte frame offset, 4 byte frame size, 8 byte
+// original offset and 4 byte original size, and the index ends with a footer
+// holding the 4 byte entry count, the 8 byte index offset and a magic number,
+// all little-endian.
+func WriteIndex(output io.Writer, offset int64, entries []IndexEntry) error {
+	buffer := make([]byte, 0, len(entries)*indexEntrySize+indexFooterSize)
+	for _, entry := range entries {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry.Offset))
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(entry.Size))
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry.OriginalOffset))
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(entry.OriginalSize))
+	}
+
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(entries)))
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(offset))
+	buffer = append(buffer, indexMagic...)
+
+	_, err := output.Write(buffer)
+
+	return err
+}
+
+// ReadIndex reads the block index from the end of a container of size bytes,
+// checking that the entries describe consecutive blocks.
+func ReadIndex(input io.ReaderAt, size int64) ([]IndexEntry, error) {
+	if size < indexFooterSize {
+		return nil, ErrNoIndex
+	}
+
+	footer := make([]byte, indexFooterSize)
+	if _, err := input.ReadAt(footer, size-indexFooterSize); err != nil {
+		return nil, truncated(err)
+	}
+
+	if string(footer[12:]) != indexMagic {
+		return nil, ErrNoIndex
+	}
+
+	count := int64(binary.LittleEndian.Uint32(footer))
+	offset := int64(binary.LittleEndian.Uint64(footer[4:]))
+	if offset < 0 || offset+count*indexEntrySize != size-indexFooterSize {
+		return nil, fmt.Errorf("malformed index of %v blocks at offset %v", count, offset)
+	}
+
+	buffer := make([]byte, count*indexEntrySize)
+	if _, err := input.ReadAt(buffer, offset); err != nil {
+		return nil, truncated(err)
+	}
+
+	entries := make([]IndexEntry, count)
+	frameEnd := int64(0)
+	originalEnd := int64(0)
+	for i := range entries {
+		entry := buffer[i*indexEntrySize:]
+		entries[i] = IndexEntry{
+			Offset:         int64(binary.LittleEndian.Uint64(entry)),
+			Size:           int(binary.LittleEndian.Uint32(entry[8:])),
+			OriginalOffset: int64(binary.LittleEndian.Uint64(entry[12:])),
+			OriginalSize:   int(binary.LittleEndian.Uint32(entry[20:])),
+		}
+
+		e := entries[i]
+		if e.Offset < frameEnd || e.Offset+int64(e.Size) > offset || e.OriginalOffset != originalEnd {
+			return nil, fmt.Errorf("malformed index entry %v", i)
+		}
+
+		frameEnd = e.Offset + int64(e.Size)
+		originalEnd += int64(e.OriginalSize)
+	}
+
+	return entries, nil
+}
+
+// ReadBlockAt reads the frame of the block described by entry, the index'th
+// entry in the index of a container with header, into buffer.
+func ReadBlockAt(input io.ReaderAt, header Header, index int, entry IndexEntry, buffer []byte) (Block, error) {
+	if cap(buffer) < entry.Size {
+		buffer = make([]byte, entry.Size)
+	}
+
+	frame := buffer[:entry.Size]
+	if _, err := input.ReadAt(frame, entry.Offset); err != nil {
+		return Block{}, truncated(err)
+	}
+
+	frameHeader := frameHeaderSize(header.Flags)
+	if len(frame) <= frameHeader {
+		return Block{}, fmt.Errorf("malformed index entry %v", index)
+	}
+
+	block := Block{Index: index}
+	blockSize := int(binary.LittleEndian.Uint32(frame))
+	searchSize := parseFrameHeader(header.Flags, frame[:frameHeader], &block)
+	if blockSize == 0 || frameHeader+blockSize+searchSize != len(frame) {
+		return Block{}, fmt.Errorf("malformed index entry %v", index)
+	}
+
+	block.Data = frame[frameHeader : frameHeader+blockSize]
+	if searchSize > 0 {
+		block.Search = frame[frameHeader+blockSize:]
+	}
+
+	return block, nil
+}
@@ -0,0 +1,200 @@
+package huffmanlib
+
+import (
+	"container/heap"
+	"errors"
+
+	"git.neds.sh/jack.massey/bwt/bitlib"
+)
+
+// MaxCodeLength is the longest code length a Decoder accepts.
+const MaxCodeLength = 20
+
+type node struct {
+	weight int
+	id     int
+}
+
+type nodeHeap []node
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].weight != h[j].weight {
+		return h[i].weight < h[j].weight
+	}
+
+	return h[i].id < h[j].id
+}
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x any)   { *h = append(*h, x.(node)) }
+func (h *nodeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
+
+// buildLengths writes the Huffman code length of each symbol with a non-zero
+// weight into lengths and returns the longest length.
+func buildLengths(weights []int, lengths []uint8) int {
+	parents := make([]int, len(weights), 2*len(weights))
+	h := make(nodeHeap, 0, len(weights))
+	for symbol, weight := range weights {
+		lengths[symbol] = 0
+		parents[symbol] = -1
+		if weight > 0 {
+			h = append(h, node{weight: weight, id: symbol})
+		}
+	}
+
+	switch len(h) {
+	case 0:
+		return 0
+	case 1:
+		lengths[h[0].id] = 1
+		return 1
+	}
+
+	heap.Init(&h)
+	for h.Len() > 1 {
+		a := heap.Pop(&h).(node)
+		b := heap.Pop(&h).(node)
+		parent := len(parents)
+		parents = append(parents, -1)
+		parents[a.id] = parent
+		parents[b.id] = parent
+		heap.Push(&h, node{weight: a.weight + b.weight, id: parent})
+	}
+
+	longest := 0
+	for symbol, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+
+		length := 0
+		for i := symbol; parents[i] != -1; i = parents[i] {
+			length++
+		}
+
+		lengths[symbol] = uint8(length)
+		if length > longest {
+			longest = length
+		}
+	}
+
+	return longest
+}
+
+// CodeLengths returns Huffman code lengths for the symbol frequencies, none
+// longer than maxLength. Symbols with a zero frequency get a zero length. If
+// the optimal code is too long the frequencies are flattened and the code is
+// rebuilt, as bzip2 does.
+func CodeLengths(freqs []int, maxLength int) []uint8 {
+	lengths := make([]uint8, len(freqs))
+	weights := append([]int{}, freqs...)
+	for buildLengths(weights, lengths) > maxLength {
+		for i, weight := range weights {
+			if weight > 0 {
+				weights[i] = 1 + weight/2
+			}
+		}
+	}
+
+	return lengths
+}
+
+// CanonicalCodes assigns canonical codes to the code lengths. Codes are
+// handed out in order of length and then symbol, and symbols with a zero
+// length get no code.
+func CanonicalCodes(lengths []uint8) []uint32 {
+	var counts [MaxCodeLength + 2]uint32
+	for _, length := range lengths {
+		counts[length]++
+	}
+	counts[0] = 0
+
+	var next [MaxCodeLength + 2]uint32
+	code := uint32(0)
+	for length := 1; length < len(next); length++ {
+		code = (code + counts[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			codes[symbol] = next[length]
+			next[length]++
+		}
+	}
+
+	return codes
+}
+
+// Decoder decodes symbols coded with the canonical codes for a set of code
+// lengths.
+type Decoder struct {
+	counts  [MaxCodeLength + 1]int
+	symbols []int
+}
+
+// NewDecoder builds a Decoder for the code lengths. It fails if the lengths do
+// not describe a prefix code.
+func NewDecoder(lengths []uint8) (*Decoder, error) {
+	d := &Decoder{}
+	for _, length := range lengths {
+		if length > MaxCodeLength {
+			return nil, errors.New("huffman code length too long")
+		}
+		d.counts[length]++
+	}
+	d.counts[0] = 0
+
+	// Check the Kraft inequality so that every code decodes to one symbol.
+	left := 1
+	for length := 1; length <= MaxCodeLength; length++ {
+		left <<= 1
+		left -= d.counts[length]
+		if left < 0 {
+			return nil, errors.New("huffman code lengths are oversubscribed")
+		}
+	}
+
+	d.symbols = make([]int, 0, len(lengths))
+	for length := 1; length <= MaxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if int(symbolLength) == length {
+				d.symbols = append(d.symbols, symbol)
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// Decode reads one code from r and returns its symbol.
+func (d *Decoder) Decode(r *bitlib.Reader) (int, error) {
+	code := 0
+	first := 0
+	index := 0
+	for length := 1; length <= MaxCodeLength; length++ {
+		bit, err := r.ReadBits(1)
+		if err != nil {
+			return 0, err
+		}
+
+		code |= int(bit)
+		count := d.counts[length]
+		if code-first < count {
+			return d.symbols[index+code-first], nil
+		}
+
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+
+	return 0, errors.New("invalid huffman code")
+}
@@ -0,0 +1,484 @@
+package huffmanlib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/bitlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+const (
+	// GroupSize is the number of symbols coded with each selected table.
+	GroupSize = 50
+	// MaxTables is the most code tables a block can hold.
+	MaxTables = 6
+
+	// encodeMaxCodeLength keeps the encoder's codes well inside
+	// MaxCodeLength, as bzip2 does.
+	encodeMaxCodeLength = 17
+	optimiseIterations  = 4
+)
+
+// tableCount chooses how many code tables to use for a block of n symbols.
+func tableCount(n int) int {
+	switch {
+	case n < 200:
+		return 2
+	case n < 600:
+		return 3
+	case n < 1200:
+		return 4
+	case n < 2400:
+		return 5
+	default:
+		return MaxTables
+	}
+}
+
+// groupCost returns the number of bits needed to code group with lengths.
+func groupCost(group []int, lengths []uint8) int {
+	cost := 0
+	for _, symbol := range group {
+		cost += int(lengths[symbol])
+	}
+
+	return cost
+}
+
+// optimiseTables builds tableCount code tables for the symbols and selects a
+// table for each group. The tables start out covering bands of symbols with
+// similar total frequency and are refined by repeatedly coding each group
+// with its cheapest table and rebuilding the tables from the result.
+func optimiseTables(symbols []int, alphabetSize int, tables int) ([][]uint8, []int) {
+	freqs := make([]int, alphabetSize)
+	for _, symbol := range symbols {
+		freqs[symbol]++
+	}
+
+	lengths := make([][]uint8, tables)
+	remaining := len(symbols)
+	start := 0
+	for t := 0; t < tables; t++ {
+		target := remaining / (tables - t)
+		end := start
+		total := 0
+		for end < alphabetSize && (total < target || t == tables-1) {
+			total += freqs[end]
+			end++
+		}
+
+		lengths[t] = make([]uint8, alphabetSize)
+		for symbol := range lengths[t] {
+			if symbol < start || symbol >= end {
+				lengths[t][symbol] = 15
+			}
+		}
+
+		remaining -= total
+		start = end
+	}
+
+	groups := (len(symbols) + GroupSize - 1) / GroupSize
+	selectors := make([]int, groups)
+	tableFreqs := make([][]int, tables)
+	for t := range tableFreqs {
+		tableFreqs[t] = make([]int, alphabetSize)
+	}
+
+	for iteration := 0; iteration < optimiseIterations; iteration++ {
+		for t := range tableFreqs {
+			for symbol := range tableFreqs[t] {
+				tableFreqs[t][symbol] = 0
+			}
+		}
+
+		for g := range selectors {
+			group := symbols[g*GroupSize : min((g+1)*GroupSize, len(symbols))]
+
+			best := 0
+			bestCost := groupCost(group, lengths[0])
+			for t := 1; t < tables; t++ {
+				if cost := groupCost(group, lengths[t]); cost < bestCost {
+					best = t
+					bestCost = cost
+				}
+			}
+
+			selectors[g] = best
+			for _, symbol := range group {
+				tableFreqs[best][symbol]++
+			}
+		}
+
+		// Every symbol needs a code in every table, so count each once more.
+		for t := range lengths {
+			for symbol := range tableFreqs[t] {
+				tableFreqs[t][symbol]++
+			}
+
+			lengths[t] = CodeLengths(tableFreqs[t], encodeMaxCodeLength)
+		}
+	}
+
+	return lengths, selectors
+}
+
+// Tables builds code tables for symbols drawn from an alphabet of alphabetSize
+// symbols, choosing the number of tables from the symbol count. It returns the
+// code lengths of each table and the table selected for each group of
+// GroupSize symbols.
+func Tables(symbols []int, alphabetSize int) ([][]uint8, []int) {
+	return optimiseTables(symbols, alphabetSize, tableCount(len(symbols)))
+}
+
+// WriteTables writes the table selectors and code lengths as bzip2 does. Each
+// selector is move to front coded and written in unary, and each table's
+// lengths are written as a 5 bit starting length followed by the difference
+// from one length to the next.
+func WriteTables(w *bitlib.Writer, lengths [][]uint8, selectors []int) {
+	order := make([]int, len(lengths))
+	for t := range order {
+		order[t] = t
+	}
+
+	for _, selector := range selectors {
+		rank := 0
+		for order[rank] != selector {
+			rank++
+		}
+
+		copy(order[1:rank+1], order[:rank])
+		order[0] = selector
+
+		w.WriteBits(uint(rank), 1<<rank-1)
+		w.WriteBit(false)
+	}
+
+	for _, tableLengths := range lengths {
+		current := tableLengths[0]
+		w.WriteBits(5, uint64(current))
+		for _, length := range tableLengths {
+			for current < length {
+				w.WriteBits(2, 0b10)
+				current++
+			}
+
+			for current > length {
+				w.WriteBits(2, 0b11)
+				current--
+			}
+
+			w.WriteBit(false)
+		}
+	}
+}
+
+// Encode Huffman codes block. The encoded block starts with the 32 bit symbol
+// count, the bitmap of bytes in use and the number of tables. It follows that
+// with the move to front coded table selector of each group of GroupSize
+// symbols, the delta coded lengths of each table and finally the codes.
+func Encode(block []byte) []byte {
+	var output bytes.Buffer
+	w := bitlib.NewWriter(&output)
+	w.WriteBits(32, uint64(len(block)))
+	if len(block) == 0 {
+		w.Flush()
+		return output.Bytes()
+	}
+
+	var inUse [256]bool
+	for _, c := range block {
+		inUse[c] = true
+	}
+
+	// Map the bytes in use onto a dense alphabet.
+	var alphabet [256]int
+	alphabetSize := 0
+	for c := range inUse {
+		if inUse[c] {
+			alphabet[c] = alphabetSize
+			alphabetSize++
+		}
+	}
+
+	WriteInUse(w, &inUse)
+
+	symbols := make([]int, len(block))
+	for i, c := range block {
+		symbols[i] = alphabet[c]
+	}
+
+	lengths, selectors := Tables(symbols, alphabetSize)
+	tables := len(lengths)
+
+	w.WriteBits(3, uint64(tables))
+
+	WriteTables(w, lengths, selectors)
+
+	codes := make([][]uint32, tables)
+	for t := range codes {
+		codes[t] = CanonicalCodes(lengths[t])
+	}
+
+	for i, symbol := range symbols {
+		t := selectors[i/GroupSize]
+		w.WriteBits(uint(lengths[t][symbol]), uint64(codes[t][symbol]))
+	}
+
+	w.Flush()
+
+	return output.Bytes()
+}
+
+// WriteInUse writes the bitmap of bytes in use as bzip2 does, with a bit for
+// each group of 16 bytes followed by the 16 bits of each group in use.
+func WriteInUse(w *bitlib.Writer, inUse *[256]bool) {
+	for chunk := 0; chunk < 16; chunk++ {
+		w.WriteBit(chunkInUse(inUse[:], chunk))
+	}
+
+	for chunk := 0; chunk < 16; chunk++ {
+		if chunkInUse(inUse[:], chunk) {
+			for c := chunk * 16; c < (chunk+1)*16; c++ {
+				w.WriteBit(inUse[c])
+			}
+		}
+	}
+}
+
+func chunkInUse(inUse []bool, chunk int) bool {
+	for _, used := range inUse[chunk*16 : (chunk+1)*16] {
+		if used {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadInUse reverses WriteInUse, returning the bytes in use in order.
+func ReadInUse(r *bitlib.Reader) ([]byte, error) {
+	var chunks [16]bool
+	for chunk := range chunks {
+		var err error
+		if chunks[chunk], err = r.ReadBit(); err != nil {
+			return nil, err
+		}
+	}
+
+	alphabet := make([]byte, 0, 256)
+	for chunk := range chunks {
+		if !chunks[chunk] {
+			continue
+		}
+
+		for c := chunk * 16; c < (chunk+1)*16; c++ {
+			used, err := r.ReadBit()
+			if err != nil {
+				return nil, err
+			}
+
+			if used {
+				alphabet = append(alphabet, byte(c))
+			}
+		}
+	}
+
+	if len(alphabet) == 0 {
+		return nil, errors.New("no symbols in use")
+	}
+
+	return alphabet, nil
+}
+
+// ReadTables reverses WriteTables, reading selectorCount selectors and the
+// code lengths of the given number of tables over an alphabet of alphabetSize
+// symbols. It returns a Decoder for each table along with the selectors.
+func ReadTables(r *bitlib.Reader, tables int, selectorCount int, alphabetSize int) ([]*Decoder, []int, error) {
+	if tables < 1 || tables > MaxTables {
+		return nil, nil, fmt.Errorf("invalid table count %v", tables)
+	}
+
+	order := make([]int, tables)
+	for t := range order {
+		order[t] = t
+	}
+
+	selectors := make([]int, selectorCount)
+	for g := range selectors {
+		rank := 0
+		for {
+			bit, err := r.ReadBit()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !bit {
+				break
+			}
+
+			rank++
+			if rank >= len(order) {
+				return nil, nil, errors.New("invalid table selector")
+			}
+		}
+
+		selector := order[rank]
+		copy(order[1:rank+1], order[:rank])
+		order[0] = selector
+		selectors[g] = selector
+	}
+
+	decoders := make([]*Decoder, tables)
+	lengths := make([]uint8, alphabetSize)
+	for t := range decoders {
+		current, err := r.ReadBits(5)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for symbol := range lengths {
+			for {
+				if current < 1 || current > MaxCodeLength {
+					return nil, nil, fmt.Errorf("invalid code length %v", current)
+				}
+
+				bit, err := r.ReadBit()
+				if err != nil {
+					return nil, nil, err
+				}
+
+				if !bit {
+					break
+				}
+
+				decrement, err := r.ReadBit()
+				if err != nil {
+					return nil, nil, err
+				}
+
+				if decrement {
+					current--
+				} else {
+					current++
+				}
+			}
+
+			lengths[symbol] = uint8(current)
+		}
+
+		if decoders[t], err = NewDecoder(lengths); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return decoders, selectors, nil
+}
+
+// corrupt wraps err to say that an encoded block could not be decoded.
+func corrupt(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("malformed huffman block: unexpected end of block")
+	}
+
+	return fmt.Errorf("malformed huffman block: %w", err)
+}
+
+// Decode reverses Encode.
+func Decode(block []byte) ([]byte, error) {
+	r := bitlib.NewReader(bytes.NewReader(block))
+
+	n, err := r.ReadBits(32)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	if n == 0 {
+		return []byte{}, nil
+	}
+
+	// Every symbol takes at least one bit.
+	if n > uint64(len(block))*8 {
+		return nil, corrupt(fmt.Errorf("%v symbols in %v bytes", n, len(block)))
+	}
+
+	alphabet, err := ReadInUse(r)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	tables, err := r.ReadBits(3)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	selectorCount := (int(n) + GroupSize - 1) / GroupSize
+	decoders, selectors, err := ReadTables(r, int(tables), selectorCount, len(alphabet))
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	output := make([]byte, n)
+	for i := range output {
+		symbol, err := decoders[selectors[i/GroupSize]].Decode(r)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+
+		output[i] = alphabet[symbol]
+	}
+
+	return output, nil
+}
+
+// EncodeStream Huffman codes input in blocks of blockSize bytes, writing each
+// block with formatlib.WriteBlock followed by the end of stream marker.
+func EncodeStream(input io.Reader, output io.Writer, blockSize int) error {
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(input, block)
+		if n > 0 {
+			if err := formatlib.WriteBlock(output, Encode(block[:n])); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			return err
+		}
+	}
+
+	return formatlib.WriteEnd(output)
+}
+
+// DecodeStream reverses EncodeStream.
+func DecodeStream(input io.Reader, output io.Writer) error {
+	var buffer []byte
+	for {
+		block, err := formatlib.ReadBlock(input, buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+		buffer = block
+
+		decoded, err := Decode(block)
+		if err != nil {
+			return err
+		}
+
+		if _, err := output.Write(decoded); err != nil {
+			return err
+		}
+	}
+}
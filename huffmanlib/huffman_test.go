@@ -0,0 +1,158 @@
+package huffmanlib
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"git.neds.sh/jack.massey/bwt/bitlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeLengthsBasic(t *testing.T) {
+	lengths := CodeLengths([]int{5, 0, 1, 1, 2}, MaxCodeLength)
+	assert.Equal(t, []uint8{1, 0, 3, 3, 2}, lengths)
+}
+
+func TestCodeLengthsSingleSymbol(t *testing.T) {
+	lengths := CodeLengths([]int{0, 7, 0}, MaxCodeLength)
+	assert.Equal(t, []uint8{0, 1, 0}, lengths)
+}
+
+func TestCodeLengthsLimited(t *testing.T) {
+	// Fibonacci frequencies give the deepest possible tree.
+	freqs := []int{1, 1}
+	for len(freqs) < 30 {
+		freqs = append(freqs, freqs[len(freqs)-1]+freqs[len(freqs)-2])
+	}
+
+	lengths := CodeLengths(freqs, 10)
+	for _, length := range lengths {
+		assert.True(t, length >= 1 && length <= 10)
+	}
+
+	_, err := NewDecoder(lengths)
+	assert.NoError(t, err)
+}
+
+func TestCanonicalCodesBasic(t *testing.T) {
+	codes := CanonicalCodes([]uint8{1, 0, 3, 3, 2})
+	assert.Equal(t, []uint32{0b0, 0, 0b110, 0b111, 0b10}, codes)
+}
+
+func TestDecoderBasic(t *testing.T) {
+	lengths := []uint8{1, 0, 3, 3, 2}
+	codes := CanonicalCodes(lengths)
+	message := []int{0, 4, 2, 3, 0, 0, 4}
+
+	var encoded bytes.Buffer
+	w := bitlib.NewWriter(&encoded)
+	for _, symbol := range message {
+		w.WriteBits(uint(lengths[symbol]), uint64(codes[symbol]))
+	}
+	assert.NoError(t, w.Flush())
+
+	d, err := NewDecoder(lengths)
+	assert.NoError(t, err)
+
+	r := bitlib.NewReader(bytes.NewReader(encoded.Bytes()))
+	for _, expected := range message {
+		symbol, err := d.Decode(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, symbol)
+	}
+}
+
+func TestNewDecoderOversubscribed(t *testing.T) {
+	_, err := NewDecoder([]uint8{1, 1, 1})
+	assert.Error(t, err)
+}
+
+func runRoundTripTest(t *testing.T, input []byte) []byte {
+	encoded := Encode(input)
+
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded)
+
+	return encoded
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	encoded := runRoundTripTest(t, []byte{})
+	assert.Equal(t, []byte{0, 0, 0, 0}, encoded)
+}
+
+func TestRoundTripSingleSymbol(t *testing.T) {
+	runRoundTripTest(t, []byte("A"))
+	runRoundTripTest(t, []byte(strings.Repeat("A", 1000)))
+}
+
+func TestRoundTripAllBytes(t *testing.T) {
+	input := make([]byte, 0, 256*3)
+	for i := 0; i < 3; i++ {
+		for c := 0; c < 256; c++ {
+			input = append(input, byte(c))
+		}
+	}
+
+	runRoundTripTest(t, input)
+}
+
+func TestRoundTripSkewed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 49, 50, 51, 199, 600, 5000, 100000} {
+		input := make([]byte, size)
+		for i := range input {
+			// Mostly small values, like MTF output.
+			input[i] = byte(rng.ExpFloat64() * 3)
+		}
+
+		encoded := runRoundTripTest(t, input)
+		if size >= 5000 {
+			assert.Less(t, len(encoded), len(input)/2)
+		}
+	}
+}
+
+func TestRoundTripIliad(t *testing.T) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	assert.NoError(t, err)
+
+	encoded := runRoundTripTest(t, input)
+	assert.Less(t, len(encoded), len(input)*3/4)
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	encoded := Encode([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES"))
+
+	_, err := Decode(encoded[:len(encoded)-2])
+	assert.Error(t, err)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	input := []byte(strings.Repeat("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES", 50))
+
+	var encoded bytes.Buffer
+	err := EncodeStream(bytes.NewReader(input), &encoded, 256)
+	assert.NoError(t, err)
+
+	var decoded bytes.Buffer
+	err = DecodeStream(&encoded, &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded.Bytes())
+}
+
+func BenchmarkEncodeIliad(b *testing.B) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		Encode(input)
+	}
+}
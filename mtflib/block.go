@@ -0,0 +1,177 @@
+package mtflib
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/exp/slices"
+)
+
+// streamChunkSize is the number of bytes the stream functions transform at a
+// time.
+const streamChunkSize = 64 * 1024
+
+// EncodeBlock appends the MoveToFront transform of src to dst and returns the
+// extended slice. The output is the same size as the input, so dst may be
+// src[:0] to transform src in place.
+func EncodeBlock(dst, src []byte) []byte {
+	l, _ := newList(VariantMTF)
+
+	return l.encodeBlock(dst, src)
+}
+
+// EncodeBlockWithVariant is EncodeBlock with the given variant.
+func EncodeBlockWithVariant(dst, src []byte, variant Variant) ([]byte, error) {
+	l, err := newList(variant)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.encodeBlock(dst, src), nil
+}
+
+// DecodeBlock reverses EncodeBlock, appending to dst. Like EncodeBlock, dst
+// may be src[:0] to decode src in place.
+func DecodeBlock(dst, src []byte) []byte {
+	l, _ := newList(VariantMTF)
+
+	return l.decodeBlock(dst, src)
+}
+
+// DecodeBlockWithVariant reverses EncodeBlockWithVariant with the same
+// variant.
+func DecodeBlockWithVariant(dst, src []byte, variant Variant) ([]byte, error) {
+	l, err := newList(variant)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.decodeBlock(dst, src), nil
+}
+
+// extend grows dst by n bytes, returning the extended slice and the n bytes
+// added.
+func extend(dst []byte, n int) ([]byte, []byte) {
+	start := len(dst)
+	dst = slices.Grow(dst, n)[:start+n]
+
+	return dst, dst[start:]
+}
+
+// encodeBlock appends the ranks of src to dst, updating the list. The output
+// is written after each input byte is read, so it may overlap src as
+// EncodeBlock allows.
+func (l *list) encodeBlock(dst, src []byte) []byte {
+	dst, output := extend(dst, len(src))
+	if l.variant != VariantMTF {
+		for i, x := range src {
+			output[i] = l.encode(x)
+		}
+
+		return dst
+	}
+
+	// Most ranks after a BWT are small, so searching from the front while
+	// shifting each symbol passed back one place beats the general path.
+	symbols := &l.symbols
+	for i, x := range src {
+		rank := byte(0)
+		previous := symbols[0]
+		for previous != x {
+			rank++
+			previous, symbols[rank] = symbols[rank], previous
+		}
+
+		symbols[0] = x
+		output[i] = rank
+	}
+
+	return dst
+}
+
+// decodeBlock appends the symbols ranked by src to dst, updating the list.
+func (l *list) decodeBlock(dst, src []byte) []byte {
+	dst, output := extend(dst, len(src))
+	if l.variant != VariantMTF {
+		for i, rank := range src {
+			output[i] = l.decode(rank)
+		}
+
+		return dst
+	}
+
+	symbols := &l.symbols
+	for i, rank := range src {
+		x := symbols[rank]
+		copy(symbols[1:int(rank)+1], symbols[:rank])
+		symbols[0] = x
+		output[i] = x
+	}
+
+	return dst
+}
+
+// transformStream reads input a chunk at a time, transforms each chunk in
+// place with fn and writes it to output. Inputs and outputs that also
+// implement io.Reader and io.Writer are read and written a chunk at a time.
+func transformStream(input io.ByteReader, output io.ByteWriter, fn func(dst, src []byte) []byte) error {
+	chunk := make([]byte, streamChunkSize)
+	for {
+		n, readErr := readChunk(input, chunk)
+		if n > 0 {
+			if err := writeChunk(output, fn(chunk[:0], chunk[:n])); err != nil {
+				return err
+			}
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				return nil
+			}
+
+			return readErr
+		}
+	}
+}
+
+// readChunk reads from input until chunk is full, returning the number of
+// bytes read. It returns io.EOF once input is exhausted. Inputs that also
+// implement io.Reader are read a chunk at a time.
+func readChunk(input io.ByteReader, chunk []byte) (int, error) {
+	if r, ok := input.(io.Reader); ok {
+		n, err := io.ReadFull(r, chunk)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+
+		return n, err
+	}
+
+	for i := range chunk {
+		x, err := input.ReadByte()
+		if err != nil {
+			return i, err
+		}
+
+		chunk[i] = x
+	}
+
+	return len(chunk), nil
+}
+
+// writeChunk writes chunk to output.
+func writeChunk(output io.ByteWriter, chunk []byte) error {
+	if w, ok := output.(io.Writer); ok {
+		_, err := w.Write(chunk)
+
+		return err
+	}
+
+	for _, x := range chunk {
+		if err := output.WriteByte(x); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
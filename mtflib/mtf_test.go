@@ -3,8 +3,11 @@ package mtflib
 import (
 	"bytes"
 	"io"
+	"os"
 	"testing"
+	"testing/quick"
 
+	"git.neds.sh/jack.massey/bwt/bwtlib"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,3 +35,272 @@ func TestIMTFStreamBasic(t *testing.T) {
 
 	runStreamTest(t, IMTF, input, expected)
 }
+
+func TestMTFStreamHighByte(t *testing.T) {
+	input := []byte("\xff\xff\x00\xfe\xff")
+	expected := []byte("\xff\x00\x01\xff\x02")
+
+	runStreamTest(t, MTF, input, expected)
+}
+
+func TestIMTFStreamHighByte(t *testing.T) {
+	input := []byte("\xff\x00\x01\xff\x02")
+	expected := []byte("\xff\xff\x00\xfe\xff")
+
+	runStreamTest(t, IMTF, input, expected)
+}
+
+func applyStream(f StreamFunc, input []byte) ([]byte, error) {
+	var output bytes.Buffer
+	err := f(bytes.NewReader(input), &output)
+
+	return output.Bytes(), err
+}
+
+func TestMTFIMTFIdentity(t *testing.T) {
+	identity := func(input []byte) bool {
+		ranks, err := applyStream(MTF, input)
+		if err != nil || len(ranks) != len(input) {
+			return false
+		}
+
+		output, err := applyStream(IMTF, ranks)
+
+		return err == nil && bytes.Equal(input, output)
+	}
+
+	assert.NoError(t, quick.Check(identity, &quick.Config{MaxCount: 500}))
+}
+
+func TestIMTFMTFIdentity(t *testing.T) {
+	identity := func(ranks []byte) bool {
+		output, err := applyStream(IMTF, ranks)
+		if err != nil {
+			return false
+		}
+
+		result, err := applyStream(MTF, output)
+
+		return err == nil && bytes.Equal(ranks, result)
+	}
+
+	assert.NoError(t, quick.Check(identity, &quick.Config{MaxCount: 500}))
+}
+
+func TestMTFIMTFAllBytes(t *testing.T) {
+	input := make([]byte, 0, 3*256)
+	for i := 0; i < 256; i++ {
+		input = append(input, byte(i), byte(255-i), byte(i))
+	}
+
+	ranks, err := applyStream(MTF, input)
+	assert.NoError(t, err)
+
+	output, err := applyStream(IMTF, ranks)
+	assert.NoError(t, err)
+	assert.Equal(t, input, output)
+}
+
+func variantFunc(f func(io.ByteReader, io.ByteWriter, Variant) error, variant Variant) StreamFunc {
+	return func(input io.ByteReader, output io.ByteWriter) error {
+		return f(input, output, variant)
+	}
+}
+
+func TestMTFWithVariantBasic(t *testing.T) {
+	cases := []struct {
+		variant  Variant
+		input    []byte
+		expected []byte
+	}{
+		{VariantMTF, []byte{1, 1, 2, 2, 1}, []byte{1, 0, 2, 0, 1}},
+		{VariantMTF1, []byte{1, 1, 2, 2, 1}, []byte{1, 0, 2, 1, 1}},
+		// The first symbol is not promoted from rank 1, as the previous
+		// rank is taken to be 0.
+		{VariantMTF2, []byte{1, 1, 2, 2, 1}, []byte{1, 1, 2, 1, 1}},
+		// 1 stays behind 0, which has been seen twice since 1 was.
+		{VariantTimestamp, []byte{1, 0, 0, 1, 1, 0}, []byte{1, 0, 0, 1, 1, 1}},
+		// 0 overtakes 2, whose occurrences are older, but not 1.
+		{VariantWFC, []byte{2, 2, 1, 1, 0}, []byte{2, 0, 2, 1, 2}},
+	}
+
+	for _, c := range cases {
+		runStreamTest(t, variantFunc(MTFWithVariant, c.variant), c.input, c.expected)
+		runStreamTest(t, variantFunc(IMTFWithVariant, c.variant), c.expected, c.input)
+	}
+}
+
+func TestMTFWithVariantIdentity(t *testing.T) {
+	for _, variant := range Variants {
+		identity := func(input []byte) bool {
+			ranks, err := applyStream(variantFunc(MTFWithVariant, variant), input)
+			if err != nil || len(ranks) != len(input) {
+				return false
+			}
+
+			output, err := applyStream(variantFunc(IMTFWithVariant, variant), ranks)
+
+			return err == nil && bytes.Equal(input, output)
+		}
+
+		assert.NoError(t, quick.Check(identity, &quick.Config{MaxCount: 200}), variant.String())
+	}
+}
+
+func TestMTFWithVariantLongInput(t *testing.T) {
+	// Enough symbols for VariantWFC to rescale its weights several times.
+	input := bytes.Repeat([]byte("abracadabra\x00\xff"), 2000)
+	for _, variant := range Variants {
+		ranks, err := applyStream(variantFunc(MTFWithVariant, variant), input)
+		assert.NoError(t, err)
+
+		output, err := applyStream(variantFunc(IMTFWithVariant, variant), ranks)
+		assert.NoError(t, err)
+		assert.Equal(t, input, output, variant.String())
+	}
+}
+
+func TestMTFWithVariantUnknown(t *testing.T) {
+	_, err := applyStream(variantFunc(MTFWithVariant, Variant(len(Variants))), []byte("a"))
+	assert.ErrorIs(t, err, ErrUnknownVariant)
+
+	_, err = applyStream(variantFunc(IMTFWithVariant, Variant(0xff)), []byte("a"))
+	assert.ErrorIs(t, err, ErrUnknownVariant)
+}
+
+func TestParseVariant(t *testing.T) {
+	for _, variant := range Variants {
+		parsed, err := ParseVariant(variant.String())
+		assert.NoError(t, err)
+		assert.Equal(t, variant, parsed)
+	}
+
+	_, err := ParseVariant("mtf3")
+	assert.ErrorIs(t, err, ErrUnknownVariant)
+}
+
+func TestEntropy(t *testing.T) {
+	assert.Equal(t, 0.0, Entropy(nil))
+	assert.Equal(t, 0.0, Entropy([]byte("aaaa")))
+	assert.InDelta(t, 1.0, Entropy([]byte("abab")), 1e-9)
+	assert.InDelta(t, 1.5, Entropy([]byte("aabc")), 1e-9)
+}
+
+// byteStream hides every method of a bytes.Reader or bytes.Buffer other than
+// ReadByte and WriteByte, so the stream functions fall back to a byte at a
+// time.
+type byteStream struct {
+	io.ByteReader
+	io.ByteWriter
+}
+
+func TestEncodeBlockMatchesStream(t *testing.T) {
+	// Longer than a chunk, so the list carries across chunks in the stream.
+	input := bytes.Repeat([]byte("abracadabra\x00\xff"), 10000)
+	for _, variant := range Variants {
+		expected, err := applyStream(variantFunc(MTFWithVariant, variant), input)
+		assert.NoError(t, err)
+
+		var byteRanks bytes.Buffer
+		err = MTFWithVariant(byteStream{ByteReader: bytes.NewReader(input)}, byteStream{ByteWriter: &byteRanks}, variant)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, byteRanks.Bytes(), variant.String())
+
+		ranks, err := EncodeBlockWithVariant([]byte("prefix"), input, variant)
+		assert.NoError(t, err)
+		assert.Equal(t, "prefix", string(ranks[:6]))
+		assert.Equal(t, expected, ranks[6:], variant.String())
+
+		output, err := DecodeBlockWithVariant(nil, ranks[6:], variant)
+		assert.NoError(t, err)
+		assert.Equal(t, input, output, variant.String())
+	}
+}
+
+func TestEncodeBlockInPlace(t *testing.T) {
+	input := []byte("BANANA")
+	block := bytes.Clone(input)
+
+	ranks := EncodeBlock(block[:0], block)
+	assert.Equal(t, []byte("\x42\x42\x4e\x01\x01\x01"), ranks)
+	assert.Equal(t, &block[0], &ranks[0])
+
+	assert.Equal(t, input, DecodeBlock(ranks[:0], ranks))
+}
+
+func TestEncodeBlockWithVariantUnknown(t *testing.T) {
+	_, err := EncodeBlockWithVariant(nil, []byte("a"), Variant(len(Variants)))
+	assert.ErrorIs(t, err, ErrUnknownVariant)
+
+	_, err = DecodeBlockWithVariant(nil, []byte("a"), Variant(0xff))
+	assert.ErrorIs(t, err, ErrUnknownVariant)
+}
+
+// readBWTIliad returns the BWT of a block of the Iliad, which has the mostly
+// small ranks MTF is given in a pipeline.
+func readBWTIliad(b *testing.B) []byte {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	output, _ := bwtlib.BWTIndexed(input[:512*1024])
+
+	return output
+}
+
+// benchmarkBlock compares block with stream reading and writing a chunk at a
+// time and a byte at a time.
+func benchmarkBlock(b *testing.B, input []byte, block func(dst, src []byte) []byte, stream StreamFunc) {
+	output := make([]byte, 0, len(input))
+	cases := []struct {
+		name string
+		run  func() error
+	}{
+		{"Block", func() error {
+			output = block(output[:0], input)
+			return nil
+		}},
+		{"Stream", func() error {
+			return stream(bytes.NewReader(input), bytes.NewBuffer(output[:0]))
+		}},
+		{"ByteStream", func() error {
+			return stream(byteStream{ByteReader: bytes.NewReader(input)}, byteStream{ByteWriter: bytes.NewBuffer(output[:0])})
+		}},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if err := c.run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMTF(b *testing.B) {
+	benchmarkBlock(b, readBWTIliad(b), EncodeBlock, MTF)
+}
+
+func BenchmarkIMTF(b *testing.B) {
+	benchmarkBlock(b, EncodeBlock(nil, readBWTIliad(b)), DecodeBlock, IMTF)
+}
+
+func BenchmarkEncodeBlockWithVariant(b *testing.B) {
+	input := readBWTIliad(b)
+	output := make([]byte, 0, len(input))
+	for _, variant := range Variants {
+		b.Run(variant.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				var err error
+				if output, err = EncodeBlockWithVariant(output[:0], input, variant); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package mtflib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrUnknownVariant is returned for a Variant this package does not
+// implement, such as one read from a newer container.
+var ErrUnknownVariant = errors.New("unknown mtf variant")
+
+// Variant selects how the list of symbols is reordered after each symbol.
+// Every variant outputs the rank of each symbol in the list before it is
+// reordered, starting from the list of bytes in order.
+type Variant byte
+
+const (
+	// VariantMTF moves every symbol to the front of the list.
+	VariantMTF Variant = iota
+	// VariantMTF1 moves a symbol at rank 1 to the front and any other to rank
+	// 1, so that a single symbol interrupting a run does not displace it.
+	VariantMTF1
+	// VariantMTF2 is VariantMTF1, except that a symbol at rank 1 only moves
+	// to the front if the previous rank was not 0.
+	VariantMTF2
+	// VariantTimestamp is Albers' Timestamp(0). A symbol moves in front of
+	// the first symbol ahead of it that has been seen at most once since the
+	// symbol was last seen, and does not move the first time it is seen.
+	VariantTimestamp
+	// VariantWFC keeps the list ordered by weighted frequency count, where
+	// each earlier occurrence of a symbol is weighted by how recent it is.
+	// The weights decay exponentially, halving about every 3 symbols.
+	VariantWFC
+)
+
+// Variants lists every Variant, in order.
+var Variants = []Variant{VariantMTF, VariantMTF1, VariantMTF2, VariantTimestamp, VariantWFC}
+
+func (v Variant) String() string {
+	switch v {
+	case VariantMTF:
+		return "mtf"
+	case VariantMTF1:
+		return "mtf1"
+	case VariantMTF2:
+		return "mtf2"
+	case VariantTimestamp:
+		return "ts0"
+	case VariantWFC:
+		return "wfc"
+	default:
+		return fmt.Sprintf("variant(%d)", byte(v))
+	}
+}
+
+// ParseVariant returns the Variant with the given String.
+func ParseVariant(name string) (Variant, error) {
+	for _, v := range Variants {
+		if v.String() == name {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w %q", ErrUnknownVariant, name)
+}
+
+// wfcDecay sets how quickly the weights of VariantWFC decay: every symbol
+// adds 2^-wfcDecay to the weight of the next.
+const wfcDecay = 2
+
+// wfcLimit is the weight at which VariantWFC scales every weight down by
+// 2^32, which keeps the scores well within a uint64.
+const wfcLimit = 1 << 48
+
+// list is the list of symbols kept by the encoder and decoder, along with the
+// state each variant uses to reorder it.
+type list struct {
+	variant Variant
+	symbols [256]byte
+	// previous is the previous rank, for VariantMTF2.
+	previous int
+
+	// time counts the symbols seen, and last and secondLast hold the times
+	// each symbol was last seen and seen before that, with 0 for never, for
+	// VariantTimestamp.
+	time       int
+	last       [256]int
+	secondLast [256]int
+
+	// scores holds the weighted frequency count of each symbol for
+	// VariantWFC. Rather than decaying every score after each symbol, the
+	// weight of the next symbol grows.
+	scores [256]uint64
+	weight uint64
+}
+
+func newList(variant Variant) (*list, error) {
+	if int(variant) >= len(Variants) {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownVariant, byte(variant))
+	}
+
+	l := &list{variant: variant, weight: 1 << 16}
+	for i := range l.symbols {
+		l.symbols[i] = byte(i)
+	}
+
+	return l, nil
+}
+
+// encode returns the rank of x and updates the list.
+func (l *list) encode(x byte) byte {
+	rank := bytes.IndexByte(l.symbols[:], x)
+	l.update(rank)
+
+	return byte(rank)
+}
+
+// decode returns the symbol at rank and updates the list.
+func (l *list) decode(rank byte) byte {
+	x := l.symbols[rank]
+	l.update(int(rank))
+
+	return x
+}
+
+// update moves the symbol at rank to where the variant places it.
+func (l *list) update(rank int) {
+	x := l.symbols[rank]
+
+	to := 0
+	switch l.variant {
+	case VariantMTF1:
+		if rank > 1 {
+			to = 1
+		}
+	case VariantMTF2:
+		if rank > 1 || (rank == 1 && l.previous == 0) {
+			to = 1
+		}
+	case VariantTimestamp:
+		to = rank
+		if l.last[x] != 0 {
+			for j := 0; j < rank; j++ {
+				if l.secondLast[l.symbols[j]] < l.last[x] {
+					to = j
+					break
+				}
+			}
+		}
+
+		l.time++
+		l.secondLast[x] = l.last[x]
+		l.last[x] = l.time
+	case VariantWFC:
+		// Only the score of x grows, so the list stays ordered by moving x
+		// ahead of every lower score.
+		l.scores[x] += l.weight
+		to = rank
+		for to > 0 && l.scores[l.symbols[to-1]] < l.scores[x] {
+			to--
+		}
+
+		l.weight += l.weight >> wfcDecay
+		if l.weight >= wfcLimit {
+			for i := range l.scores {
+				l.scores[i] >>= 32
+			}
+			l.weight >>= 32
+		}
+	}
+
+	copy(l.symbols[to+1:rank+1], l.symbols[to:rank])
+	l.symbols[to] = x
+	l.previous = rank
+}
+
+// Entropy returns the zero-order entropy of data in bits per byte, which is
+// the best an order-0 entropy coder can compress it to.
+func Entropy(data []byte) float64 {
+	var counts [256]int
+	for _, x := range data {
+		counts[x]++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy
+}
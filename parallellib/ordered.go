@@ -0,0 +1,111 @@
+package parallellib
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Workers returns the number of workers to use for a requested concurrency,
+// where anything below 1 means runtime.GOMAXPROCS.
+func Workers(concurrency int) int {
+	if concurrency < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	return concurrency
+}
+
+type result[R any] struct {
+	value R
+	err   error
+}
+
+// Ordered calls next until it returns io.EOF, runs work on each item across
+// up to workers goroutines and passes the results to emit in the order the
+// items were returned by next. At most workers items are in flight between
+// next and emit, which bounds memory use. next and emit are only called from
+// one goroutine at a time. The first error from any of the functions stops the
+// run and is returned.
+func Ordered[T, R any](workers int, next func() (T, error), work func(T) (R, error), emit func(R) error) error {
+	return OrderedWindow(workers, workers, next, work, emit)
+}
+
+// OrderedWindow is like Ordered, but allows up to window items to be in flight
+// so that next can read ahead of the workers. window is raised to workers if
+// it is smaller.
+func OrderedWindow[T, R any](workers int, window int, next func() (T, error), work func(T) (R, error), emit func(R) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if window < workers {
+		window = workers
+	}
+
+	running := make(chan struct{}, workers)
+	slots := make(chan struct{}, window)
+	futures := make(chan chan result[R], window)
+	done := make(chan struct{})
+
+	var readErr error
+	var producer sync.WaitGroup
+	producer.Add(1)
+	go func() {
+		defer producer.Done()
+		defer close(futures)
+
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			item, err := next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					readErr = err
+				}
+
+				return
+			}
+
+			future := make(chan result[R], 1)
+			go func() {
+				running <- struct{}{}
+				value, err := work(item)
+				<-running
+				future <- result[R]{value: value, err: err}
+			}()
+
+			futures <- future
+		}
+	}()
+
+	var err error
+	for future := range futures {
+		r := <-future
+		<-slots
+		if err != nil {
+			continue
+		}
+
+		err = r.err
+		if err == nil {
+			err = emit(r.value)
+		}
+
+		if err != nil {
+			close(done)
+		}
+	}
+
+	producer.Wait()
+	if err != nil {
+		return err
+	}
+
+	return readErr
+}
@@ -0,0 +1,147 @@
+package parallellib
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counter returns a next function producing 0 to n-1.
+func counter(n int) func() (int, error) {
+	i := 0
+
+	return func() (int, error) {
+		if i == n {
+			return 0, io.EOF
+		}
+		i++
+
+		return i - 1, nil
+	}
+}
+
+func TestOrderedPreservesOrder(t *testing.T) {
+	for _, workers := range []int{1, 2, 8, 100} {
+		var output []int
+		err := Ordered(workers, counter(200), func(i int) (int, error) {
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			return i * i, nil
+		}, func(r int) error {
+			output = append(output, r)
+			return nil
+		})
+		assert.NoError(t, err)
+
+		assert.Len(t, output, 200)
+		for i, r := range output {
+			assert.Equal(t, i*i, r)
+		}
+	}
+}
+
+func TestOrderedBoundsInFlight(t *testing.T) {
+	var inFlight, maxInFlight int32
+	next := counter(100)
+
+	err := Ordered(4, func() (int, error) {
+		i, err := next()
+		if err == nil {
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				seen := atomic.LoadInt32(&maxInFlight)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+					break
+				}
+			}
+		}
+
+		return i, err
+	}, func(i int) (int, error) {
+		time.Sleep(50 * time.Microsecond)
+		return i, nil
+	}, func(int) error {
+		atomic.AddInt32(&inFlight, -1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, maxInFlight <= 4, "%v blocks in flight", maxInFlight)
+}
+
+func TestOrderedWorkError(t *testing.T) {
+	failure := errors.New("failure")
+	emitted := 0
+
+	err := Ordered(4, counter(100), func(i int) (int, error) {
+		if i == 10 {
+			return 0, failure
+		}
+
+		return i, nil
+	}, func(int) error {
+		emitted++
+		return nil
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 10, emitted)
+}
+
+func TestOrderedNextError(t *testing.T) {
+	failure := errors.New("failure")
+	next := counter(5)
+
+	err := Ordered(2, func() (int, error) {
+		i, err := next()
+		if err != nil {
+			return 0, failure
+		}
+
+		return i, nil
+	}, func(i int) (int, error) {
+		return i, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, failure)
+}
+
+func TestOrderedEmitError(t *testing.T) {
+	failure := errors.New("failure")
+
+	err := Ordered(3, counter(100), func(i int) (int, error) {
+		return i, nil
+	}, func(i int) error {
+		if i == 50 {
+			return failure
+		}
+
+		return nil
+	})
+	assert.ErrorIs(t, err, failure)
+}
+
+func TestOrderedWindowBoundsWorkers(t *testing.T) {
+	var running, maxRunning int32
+
+	err := OrderedWindow(2, 16, counter(100), func(i int) (int, error) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Microsecond)
+		atomic.AddInt32(&running, -1)
+
+		return i, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, maxRunning <= 2, "%v workers running", maxRunning)
+}
@@ -0,0 +1,604 @@
+package pipelinelib
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+	"git.neds.sh/jack.massey/bwt/rangelib"
+	"github.com/stretchr/testify/assert"
+)
+
+const iliadPath = "../testfiles/iliad.mb.txt"
+
+func compress(t *testing.T, input []byte, opts *Options) []byte {
+	var output bytes.Buffer
+	writer := NewWriter(&output, opts)
+	_, err := writer.Write(input)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	return output.Bytes()
+}
+
+func decompress(t *testing.T, input []byte) []byte {
+	reader, err := NewReader(bytes.NewReader(input))
+	assert.NoError(t, err)
+
+	output, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+
+	return output
+}
+
+func TestRoundTripIliad(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	compressed := compress(t, input, nil)
+	assert.Less(t, len(compressed), len(input))
+	assert.Equal(t, input, decompress(t, compressed))
+}
+
+func TestRoundTripBinary(t *testing.T) {
+	input := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(input)
+	opts := &Options{BlockSize: 1024, Transform: bwtlib.TransformIndexed, MinRun: 2, RunLengthBytes: 2}
+
+	assert.Equal(t, input, decompress(t, compress(t, input, opts)))
+}
+
+func TestRoundTripBijective(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+	input = append(input[:64*1024], 0x02, 0x03, 0x00, 0xff)
+	opts := &Options{BlockSize: 16 * 1024, Transform: bwtlib.TransformBijective, MinRun: 4, RunLengthBytes: 1, Checksum: true}
+
+	assert.Equal(t, input, decompress(t, compress(t, input, opts)))
+}
+
+func TestRoundTripRLE1(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+	input = append(input[:64*1024], bytes.Repeat([]byte("AB"), 10000)...)
+	input = append(input, make([]byte, 100000)...)
+
+	for _, transform := range []bwtlib.Transform{bwtlib.TransformIndexed, bwtlib.TransformBijective} {
+		opts := &Options{BlockSize: 16 * 1024, Transform: transform, RLE1: true, Checksum: true, Index: true, Search: true}
+		compressed := compress(t, input, opts)
+
+		reader, err := NewReader(bytes.NewReader(compressed))
+		assert.NoError(t, err)
+		assert.Equal(t, "rle1|bwt|mtf|rle", reader.Header.StagesString())
+		assert.Equal(t, formatlib.FlagChecksum|formatlib.FlagIndex, reader.Header.Flags)
+		assert.Equal(t, input, decompress(t, compressed))
+
+		seekable, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+		assert.NoError(t, err)
+		buffer := make([]byte, 100)
+		_, err = seekable.ReadAt(buffer, 70000)
+		assert.NoError(t, err)
+		assert.Equal(t, input[70000:70100], buffer)
+	}
+}
+
+func TestRoundTripMTFVariants(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+	input = input[:64*1024]
+
+	for _, variant := range mtflib.Variants {
+		opts := &Options{BlockSize: 16 * 1024, Transform: bwtlib.TransformIndexed, MTFVariant: variant}
+		compressed := compress(t, input, opts)
+
+		reader, err := NewReader(bytes.NewReader(compressed))
+		assert.NoError(t, err)
+		assert.Equal(t, byte(variant), reader.Header.MTFVariant)
+		assert.Equal(t, input, decompress(t, compressed))
+	}
+}
+
+func TestRoundTripRLEModes(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+	input = append(input[:64*1024], make([]byte, 100000)...)
+
+	for _, mode := range compresslib.Modes {
+		opts := &Options{BlockSize: 64 * 1024, Transform: bwtlib.TransformIndexed, RLEMode: mode}
+		compressed := compress(t, input, opts)
+
+		reader, err := NewReader(bytes.NewReader(compressed))
+		assert.NoError(t, err)
+		assert.Equal(t, byte(mode), reader.Header.RLEMode)
+		assert.Equal(t, input, decompress(t, compressed))
+	}
+}
+
+func TestRoundTripNoEntropy(t *testing.T) {
+	input := bytes.Repeat([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES"), 100)
+	opts := &Options{BlockSize: 1024, Entropy: EntropyNone}
+
+	compressed := compress(t, input, opts)
+	assert.Equal(t, input, decompress(t, compressed))
+
+	reader, err := NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Header.ExpectStages(formatlib.StageBWT, formatlib.StageMTF, formatlib.StageRLE))
+}
+
+func TestHuffmanShrinksIliad(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	withoutEntropy := compress(t, input, &Options{Entropy: EntropyNone})
+	withHuffman := compress(t, input, nil)
+	assert.Less(t, len(withHuffman), len(withoutEntropy)*2/3)
+}
+
+func TestRangeShrinksIliad(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	for _, model := range []rangelib.Model{rangelib.ModelStructured, rangelib.ModelOrder0} {
+		opts := &Options{Transform: bwtlib.TransformIndexed, Entropy: EntropyRange, RangeModel: model}
+		compressed := compress(t, input, opts)
+		assert.Equal(t, input, decompress(t, compressed))
+
+		reader, err := NewReader(bytes.NewReader(compressed))
+		assert.NoError(t, err)
+		assert.Equal(t, formatlib.StageRange, reader.Header.LastStage())
+
+		if model == rangelib.ModelStructured {
+			huffman := *opts
+			huffman.Entropy = EntropyHuffman
+			assert.Less(t, len(compressed), len(compress(t, input, &huffman)))
+		}
+	}
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	compressed := compress(t, []byte{}, nil)
+
+	assert.Equal(t, []byte{}, decompress(t, compressed))
+}
+
+func TestWriterSmallWrites(t *testing.T) {
+	input := bytes.Repeat([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES"), 100)
+	opts := &Options{BlockSize: 300}
+
+	var output bytes.Buffer
+	writer := NewWriter(&output, opts)
+	_, err := io.Copy(writer, iotest.OneByteReader(bytes.NewReader(input)))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	assert.Equal(t, compress(t, input, opts), output.Bytes())
+
+	reader, err := NewReader(iotest.HalfReader(bytes.NewReader(output.Bytes())))
+	assert.NoError(t, err)
+
+	decoded, err := io.ReadAll(iotest.OneByteReader(reader))
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded)
+}
+
+func TestWriterHeader(t *testing.T) {
+	compressed := compress(t, []byte("BANANA"), &Options{BlockSize: 256, MinRun: 3, Entropy: EntropyHuffman})
+
+	reader, err := NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Header.ExpectStages(
+		formatlib.StageBWT, formatlib.StageMTF, formatlib.StageRLE, formatlib.StageHuffman,
+	))
+	assert.Equal(t, 256, reader.Header.BlockSize)
+	assert.Equal(t, 3, reader.Header.MinRun)
+	assert.Equal(t, DefaultRunLengthBytes, reader.Header.RunLengthBytes)
+}
+
+func TestWriterInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{MinRun: 1},
+		{MinRun: 300},
+		{RunLengthBytes: 8},
+		{RLE1: true, Transform: bwtlib.TransformSentinel},
+		{Transform: 3},
+		{MTFVariant: 5},
+		{RLEMode: 4},
+		{Entropy: 3},
+		{Entropy: -1},
+	} {
+		var compressed bytes.Buffer
+		writer := NewWriter(&compressed, &opts)
+		_, err := writer.Write([]byte("AAAAAA"))
+		assert.Error(t, err, opts)
+		assert.Error(t, writer.Close(), opts)
+		assert.Equal(t, 0, compressed.Len(), opts)
+	}
+
+	writer := NewWriter(io.Discard, &Options{RLE1: true, Transform: bwtlib.TransformSentinel})
+	assert.ErrorContains(t, writer.Close(), "RLE1 needs a transform that allows any byte")
+
+	writer = NewWriter(io.Discard, &Options{MTFVariant: 5})
+	assert.ErrorIs(t, writer.Close(), mtflib.ErrUnknownVariant)
+
+	writer = NewWriter(io.Discard, &Options{RLEMode: 4})
+	assert.ErrorIs(t, writer.Close(), compresslib.ErrUnknownMode)
+}
+
+func TestWriterClosed(t *testing.T) {
+	writer := NewWriter(io.Discard, nil)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, writer.Close())
+
+	_, err := writer.Write([]byte("A"))
+	assert.Error(t, err)
+}
+
+func TestReaderForeignInput(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("plain text")))
+	assert.ErrorIs(t, err, formatlib.ErrBadMagic)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	compressed := compress(t, []byte("BANANA"), nil)
+
+	index, err := formatlib.ReadIndex(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+	end := index[0].Offset + int64(index[0].Size)
+
+	reader, err := NewReader(bytes.NewReader(compressed[:end-4]))
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, formatlib.ErrTruncated)
+}
+
+func TestReaderChecksum(t *testing.T) {
+	input := bytes.Repeat([]byte("ABRACADABRA"), 200)
+	opts := &Options{BlockSize: 1024, Checksum: true}
+	compressed := compress(t, input, opts)
+
+	reader, err := NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	assert.Equal(t, formatlib.FlagChecksum, reader.Header.Flags)
+	assert.Equal(t, input, decompress(t, compressed))
+
+	// Flip a byte near the end of the third and last block.
+	compressed[len(compressed)-9] ^= 0x01
+
+	reader, err = NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 2, corruption.Block)
+	assert.Equal(t, int64(2048), corruption.Offset)
+}
+
+func TestReaderExpansionLimit(t *testing.T) {
+	// A zero run coding 2 GiB of zeros in a container of 64 byte blocks.
+	header := formatlib.Header{
+		Stages:    []formatlib.Stage{formatlib.StageBWT, formatlib.StageMTF, formatlib.StageRLE},
+		BlockSize: 64,
+		RLEMode:   byte(compresslib.ModeZeroRun),
+	}
+
+	var stream bytes.Buffer
+	writer, err := formatlib.NewBlockWriter(&stream, header)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteBlock(bytes.Repeat([]byte{compresslib.RunB}, 30), 0))
+	assert.NoError(t, writer.Close())
+
+	reader, err := NewReader(&stream)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.ErrorContains(t, err, "exceeds the maximum")
+}
+
+func TestReaderStageContainer(t *testing.T) {
+	input := []byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES")
+
+	var stream bytes.Buffer
+	err := bwtlib.BWTStreamWithOptions(bytes.NewReader(input), &stream, bwtlib.StreamOptions{BlockSize: 16})
+	assert.NoError(t, err)
+
+	assert.Equal(t, input, decompress(t, stream.Bytes()))
+}
+
+func seekableIliad(t *testing.T) ([]byte, *SeekableReader) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.BlockSize = 64 * 1024
+	compressed := compress(t, input, &opts)
+
+	reader, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(input)), reader.Size())
+
+	return input, reader
+}
+
+func TestSeekableReaderRange(t *testing.T) {
+	input, reader := seekableIliad(t)
+
+	output := make([]byte, 1000)
+	n, err := reader.ReadAt(output, 400000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n)
+	assert.Equal(t, input[400000:401000], output)
+	assert.Equal(t, 1, reader.decodes)
+
+	// 393216 is the start of the seventh block.
+	n, err = reader.ReadAt(output, 393000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n)
+	assert.Equal(t, input[393000:394000], output)
+	assert.Equal(t, 3, reader.decodes)
+}
+
+func TestSeekableReaderEnd(t *testing.T) {
+	input, reader := seekableIliad(t)
+
+	output := make([]byte, 1000)
+	n, err := reader.ReadAt(output, int64(len(input)-10))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, input[len(input)-10:], output[:n])
+
+	_, err = reader.ReadAt(output, int64(len(input)))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSeekableReaderSeek(t *testing.T) {
+	input, reader := seekableIliad(t)
+
+	offset, err := reader.Seek(-5000, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(input)-5000), offset)
+
+	output, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, input[len(input)-5000:], output)
+
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	output, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, input, output)
+}
+
+func TestSeekableReaderStreams(t *testing.T) {
+	input := bytes.Repeat([]byte("ABRACADABRA"), 200)
+	compressed := compress(t, input, nil)
+
+	// The index is ignored when reading the container from the start.
+	assert.Equal(t, input, decompress(t, compressed))
+
+	reader, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+
+	output := make([]byte, 11)
+	_, err = reader.ReadAt(output, 1100)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ABRACADABRA"), output)
+}
+
+func TestSeekableReaderEmpty(t *testing.T) {
+	compressed := compress(t, nil, nil)
+
+	reader, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), reader.Size())
+
+	output, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(output))
+}
+
+func TestSeekableReaderNoIndex(t *testing.T) {
+	compressed := compress(t, []byte("BANANA"), &Options{Entropy: EntropyHuffman})
+
+	_, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.ErrorIs(t, err, formatlib.ErrNoIndex)
+}
+
+func TestSeekableReaderCorrupt(t *testing.T) {
+	input := bytes.Repeat([]byte("ABRACADABRA"), 200)
+	compressed := compress(t, input, &Options{BlockSize: 1024, Checksum: true, Index: true})
+
+	// Flip a byte in the middle of the second block.
+	index, err := formatlib.ReadIndex(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+	compressed[index[1].Offset+int64(index[1].Size)/2] ^= 0x01
+
+	reader, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+
+	output := make([]byte, 10)
+	_, err = reader.ReadAt(output, 0)
+	assert.NoError(t, err)
+
+	_, err = reader.ReadAt(output, 1500)
+	var corruption *formatlib.CorruptionError
+	assert.ErrorAs(t, err, &corruption)
+	assert.Equal(t, 1, corruption.Block)
+	assert.Equal(t, int64(1024), corruption.Offset)
+}
+
+func BenchmarkWriterIliad(b *testing.B) {
+	input, err := os.ReadFile(iliadPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		writer := NewWriter(io.Discard, nil)
+		if _, err := writer.Write(input); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriterConcurrencyDeterministic(t *testing.T) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	var expected []byte
+	for _, concurrency := range []int{1, 2, 5, 0} {
+		opts := DefaultOptions()
+		opts.BlockSize = 64 * 1024
+		opts.Concurrency = concurrency
+
+		compressed := compress(t, input, &opts)
+		if expected == nil {
+			expected = compressed
+		}
+		assert.Equal(t, expected, compressed, "concurrency %v", concurrency)
+	}
+
+	assert.Equal(t, input, decompress(t, expected))
+}
+
+func TestWriterConcurrencyError(t *testing.T) {
+	writer := NewWriter(io.Discard, &Options{BlockSize: 4, Transform: bwtlib.TransformSentinel, Concurrency: 2})
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = writer.Write([]byte("AB\x02C"))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+
+	assert.Error(t, err)
+	assert.Equal(t, err, writer.Close())
+}
+
+// naiveLocate finds every occurrence of pattern, including overlapping ones.
+func naiveLocate(text []byte, pattern []byte, fold bool) []int64 {
+	matches := []int64{}
+	for i := 0; i+len(pattern) <= len(text); i++ {
+		if hasPrefix(text[i:], pattern, fold) {
+			matches = append(matches, int64(i))
+		}
+	}
+
+	return matches
+}
+
+func searchableIliad(t *testing.T) ([]byte, []byte, *Searcher) {
+	input, err := os.ReadFile(iliadPath)
+	assert.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.BlockSize = 16 * 1024
+	opts.Search = true
+	compressed := compress(t, input, &opts)
+
+	searcher, err := NewSearcher(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(input)), searcher.Size())
+
+	return input, compressed, searcher
+}
+
+func TestSearcherLocate(t *testing.T) {
+	input, _, searcher := searchableIliad(t)
+
+	// The last pattern crosses from the first block into the second.
+	for _, pattern := range []string{"Achilles", "the", "swift-footed", "\n", string(input[16380:16390])} {
+		matches, err := searcher.Locate([]byte(pattern), false)
+		assert.NoError(t, err)
+		assert.Equal(t, naiveLocate(input, []byte(pattern), false), matches, pattern)
+	}
+
+	matches, err := searcher.Locate([]byte("zzzz"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{}, matches)
+
+	// Every block is built once, as the blocks on either side of each
+	// boundary are cached.
+	searcher.builds = 0
+	_, err = searcher.Locate([]byte("Hector"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, len(searcher.index), searcher.builds)
+}
+
+func TestSearcherLocateFold(t *testing.T) {
+	input, _, searcher := searchableIliad(t)
+
+	for _, pattern := range []string{"achilles", "ZEUS", "O Goddess"} {
+		matches, err := searcher.Locate([]byte(pattern), true)
+		assert.NoError(t, err)
+		assert.Equal(t, naiveLocate(input, []byte(pattern), true), matches, pattern)
+	}
+}
+
+func TestSearcherReadAt(t *testing.T) {
+	input, compressed, searcher := searchableIliad(t)
+
+	random := rand.New(rand.NewSource(17))
+	for i := 0; i < 20; i++ {
+		offset := random.Intn(len(input))
+		output := make([]byte, min(1+random.Intn(40000), len(input)-offset))
+		n, err := searcher.ReadAt(output, int64(offset))
+		assert.NoError(t, err)
+		assert.Equal(t, len(output), n)
+		assert.Equal(t, input[offset:offset+n], output)
+	}
+
+	_, err := searcher.ReadAt(make([]byte, 1), int64(len(input)))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// The search data is skipped when reading the container from the start.
+	assert.Equal(t, input, decompress(t, compressed))
+}
+
+func TestSearcherPeriodic(t *testing.T) {
+	// The first block is aperiodic and the rest are stored without samples.
+	input := append([]byte("xyz"), bytes.Repeat([]byte("ab"), 3000)...)
+	compressed := compress(t, input, &Options{BlockSize: 1024, Index: true, Search: true, Transform: bwtlib.TransformIndexed})
+
+	searcher, err := NewSearcher(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(t, err)
+
+	for _, pattern := range []string{"zab", "bab", "abab"} {
+		matches, err := searcher.Locate([]byte(pattern), false)
+		assert.NoError(t, err)
+		assert.Equal(t, naiveLocate(input, []byte(pattern), false), matches, pattern)
+	}
+
+	output := make([]byte, 100)
+	_, err = searcher.ReadAt(output, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, input[1000:1100], output)
+}
+
+func TestSearcherNoSearch(t *testing.T) {
+	for _, opts := range []*Options{nil, {Search: true, Index: true}} {
+		compressed := compress(t, []byte("BANANA"), opts)
+
+		_, err := NewSearcher(bytes.NewReader(compressed), int64(len(compressed)))
+		assert.ErrorIs(t, err, ErrNoSearch)
+	}
+}
@@ -0,0 +1,137 @@
+package pipelinelib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/distancelib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/huffmanlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+	"git.neds.sh/jack.massey/bwt/rangelib"
+)
+
+// Reader decompresses a formatlib container, undoing the stages recorded in
+// its header for every block. Blocks that cannot be decoded or do not match
+// their checksum return a *formatlib.CorruptionError.
+type Reader struct {
+	// Header is the container header read by NewReader.
+	Header formatlib.Header
+
+	blocks  *formatlib.BlockReader
+	inv     bwtlib.Inverter
+	buffer  []byte
+	pending []byte
+	err     error
+}
+
+// NewReader reads the container header from r and returns a Reader that
+// decompresses the rest of the container.
+func NewReader(r io.Reader) (*Reader, error) {
+	blocks, err := formatlib.NewBlockReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{Header: blocks.Header, blocks: blocks}, nil
+}
+
+// Read decompresses into p, decoding the next block when the current one has
+// been consumed.
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.pending, z.err = z.nextBlock()
+	}
+
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+
+	return n, nil
+}
+
+// Close releases the Reader. It does not close the underlying reader.
+func (z *Reader) Close() error {
+	if errors.Is(z.err, io.EOF) {
+		return nil
+	}
+
+	return z.err
+}
+
+func (z *Reader) nextBlock() ([]byte, error) {
+	block, err := z.blocks.Next(z.buffer)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			if err := z.blocks.Finish(); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, err
+	}
+	z.buffer = block.Data
+
+	original, err := DecodeBlock(z.Header, block.Data, &z.inv)
+	if err != nil {
+		return nil, z.blocks.Corrupt(block, err)
+	}
+
+	if len(original) > z.Header.BlockSize {
+		err := fmt.Errorf("malformed block of %v bytes, expected at most %v", len(original), z.Header.BlockSize)
+		return nil, z.blocks.Corrupt(block, err)
+	}
+
+	if err := z.blocks.Verify(block, original); err != nil {
+		return nil, err
+	}
+
+	return original, nil
+}
+
+// DecodeBlock reverses EncodeBlock, undoing each stage listed in header in
+// reverse order. inv provides the BWT scratch space, and the returned slice is
+// only valid until it is next used.
+func DecodeBlock(header formatlib.Header, block []byte, inv *bwtlib.Inverter) ([]byte, error) {
+	return undoStages(header, block, inv, 0)
+}
+
+// undoStages undoes the stages listed in header in reverse order, stopping
+// after the stage at index first.
+func undoStages(header formatlib.Header, block []byte, inv *bwtlib.Inverter, first int) ([]byte, error) {
+	for i := len(header.Stages) - 1; i >= first; i-- {
+		var err error
+		switch stage := header.Stages[i]; stage {
+		case formatlib.StageRLE1:
+			block, err = compresslib.DecodeRLE1(block)
+		case formatlib.StageBWT:
+			block, err = inv.DecodeBlock(block, bwtlib.Transform(header.Transform))
+		case formatlib.StageMTF:
+			block, err = mtflib.DecodeBlockWithVariant(nil, block, mtflib.Variant(header.MTFVariant))
+		case formatlib.StageDistance:
+			block, err = distancelib.DecodeDistances(block, header.MaxStageSize())
+		case formatlib.StageInversion:
+			block, err = distancelib.DecodeInversions(block, header.MaxStageSize())
+		case formatlib.StageRLE:
+			block, err = compresslib.DecodeBlockWithMode(nil, block, compresslib.Mode(header.RLEMode), header.MinRun, header.RunLengthBytes, header.MaxStageSize())
+		case formatlib.StageHuffman:
+			block, err = huffmanlib.Decode(block)
+		case formatlib.StageRange:
+			block, err = rangelib.Decode(block)
+		default:
+			err = fmt.Errorf("unknown stage %v", stage)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return block, nil
+}
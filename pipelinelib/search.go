@@ -0,0 +1,379 @@
+package pipelinelib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/fmindexlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+// ErrNoSearch is returned by NewSearcher for containers written without
+// Options.Search.
+var ErrNoSearch = errors.New("bwt container has no search data")
+
+// searchable reports whether blocks encoded with header carry search data,
+// which is sampled from the indexed BWT in the first stage.
+func searchable(header formatlib.Header) bool {
+	return header.Flags&formatlib.FlagSearch != 0 &&
+		len(header.Stages) > 0 && header.Stages[0] == formatlib.StageBWT &&
+		bwtlib.Transform(header.Transform) == bwtlib.TransformIndexed
+}
+
+// Searcher finds patterns in a container written with Options.Search from an
+// io.ReaderAt. Each block is searched with an fmindexlib.Index built from its
+// BWT and samples, which also extracts the text around matches, so the BWT is
+// never inverted. Blocks stored without samples are decoded instead. Only
+// decoded blocks are checked against their checksums, so use Reader to verify
+// a container. Searcher implements io.ReaderAt, and its methods may be called
+// concurrently.
+type Searcher struct {
+	// Header is the container header read by NewSearcher.
+	Header formatlib.Header
+
+	r     io.ReaderAt
+	index []formatlib.IndexEntry
+	size  int64
+
+	mu  sync.Mutex
+	inv bwtlib.Inverter
+	// cache holds the two most recently used blocks, most recent first, so
+	// that reading across a block boundary does not rebuild either block.
+	cache [2]cachedBlock
+	// builds counts the blocks built, for tests.
+	builds int
+}
+
+// cachedBlock is a block built by Searcher.block.
+type cachedBlock struct {
+	index int
+	text  blockText
+}
+
+// blockText finds patterns in the original data of a block and extracts it.
+// It is implemented by fmindexlib.Index and by decodedText.
+type blockText interface {
+	Locate(pattern []byte) []int
+	LocateFold(pattern []byte) []int
+	Extract(start, end int) []byte
+}
+
+// NewSearcher reads the header and block index of the size byte container in
+// r. It returns ErrNoSearch if the container has no search data.
+func NewSearcher(r io.ReaderAt, size int64) (*Searcher, error) {
+	header, err := formatlib.ReadHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	if !searchable(header) {
+		return nil, ErrNoSearch
+	}
+
+	index, err := formatlib.ReadIndex(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Searcher{Header: header, r: r, index: index}
+	if len(index) > 0 {
+		last := index[len(index)-1]
+		s.size = last.OriginalOffset + int64(last.OriginalSize)
+	}
+
+	return s, nil
+}
+
+// Size returns the size of the original data.
+func (s *Searcher) Size() int64 {
+	return s.size
+}
+
+// Locate returns the offset in the original data of every occurrence of
+// pattern, including overlapping ones, in increasing order. With fold, ASCII
+// letters in pattern match either case.
+func (s *Searcher) Locate(pattern []byte, fold bool) ([]int64, error) {
+	matches := []int64{}
+	err := s.LocateFunc([][]byte{pattern}, fold, func(_ int, offset int64) error {
+		matches = append(matches, offset)
+		return nil
+	})
+
+	return matches, err
+}
+
+// LocateFunc calls fn with the index in patterns and the offset in the
+// original data of every occurrence of each pattern, in increasing order of
+// offset. It searches a block at a time, calling fn for the block's matches
+// before building the next, so fn reads cheaply from the Searcher around the
+// current match. It stops at the first error returned by fn.
+func (s *Searcher) LocateFunc(patterns [][]byte, fold bool, fn func(pattern int, offset int64) error) error {
+	for i := range s.index {
+		matches, err := s.locateBlock(i, patterns, fold)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			if err := fn(match.pattern, match.offset); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// match is an occurrence of a pattern found by LocateFunc.
+type match struct {
+	pattern int
+	offset  int64
+}
+
+// locateBlock returns the matches of patterns that start in block i, sorted
+// by offset.
+func (s *Searcher) locateBlock(i int, patterns [][]byte, fold bool) ([]match, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []match
+	for p, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+
+		if i+1 < len(s.index) {
+			crossing, err := s.crossing(i+1, pattern, fold)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, offset := range crossing {
+				matches = append(matches, match{pattern: p, offset: offset})
+			}
+		}
+
+		text, err := s.block(i)
+		if err != nil {
+			return nil, err
+		}
+
+		var positions []int
+		if fold {
+			positions = text.LocateFold(pattern)
+		} else {
+			positions = text.Locate(pattern)
+		}
+
+		for _, position := range positions {
+			matches = append(matches, match{pattern: p, offset: s.index[i].OriginalOffset + int64(position)})
+		}
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].offset != matches[b].offset {
+			return matches[a].offset < matches[b].offset
+		}
+
+		return matches[a].pattern < matches[b].pattern
+	})
+
+	return matches, nil
+}
+
+// crossing returns the matches of pattern that cross from an earlier block
+// into block i. They start in the last len(pattern)-1 bytes before the block,
+// so they are found in the original data around the boundary. A match that
+// crosses several boundaries is only returned for the first.
+func (s *Searcher) crossing(i int, pattern []byte, fold bool) ([]int64, error) {
+	boundary := s.index[i].OriginalOffset
+	start := max(s.index[i-1].OriginalOffset, boundary-int64(len(pattern))+1)
+	end := min(s.size, boundary+int64(len(pattern))-1)
+	if start >= boundary || end-start < int64(len(pattern)) {
+		return nil, nil
+	}
+
+	window := make([]byte, end-start)
+	if _, err := s.readAt(window, start); err != nil {
+		return nil, err
+	}
+
+	var matches []int64
+	for offset := start; offset < boundary; offset++ {
+		if hasPrefix(window[offset-start:], pattern, fold) {
+			matches = append(matches, offset)
+		}
+	}
+
+	return matches, nil
+}
+
+// ReadAt extracts len(p) bytes starting at offset off of the original data
+// into p.
+func (s *Searcher) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("pipelinelib.Searcher.ReadAt: negative offset")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readAt(p, off)
+}
+
+func (s *Searcher) readAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+
+	// Find the block holding off, which is the last block starting at or
+	// before it.
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].OriginalOffset > off
+	}) - 1
+
+	n := 0
+	for ; n < len(p) && i >= 0 && i < len(s.index); i++ {
+		text, err := s.block(i)
+		if err != nil {
+			return n, err
+		}
+
+		entry := s.index[i]
+		start := int(off + int64(n) - entry.OriginalOffset)
+		end := min(entry.OriginalSize, start+len(p)-n)
+		n += copy(p[n:], text.Extract(start, end))
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// block returns the text of block i, building it unless it is cached.
+func (s *Searcher) block(i int) (blockText, error) {
+	for j, cached := range s.cache {
+		if cached.text != nil && cached.index == i {
+			s.cache[0], s.cache[j] = s.cache[j], s.cache[0]
+			return cached.text, nil
+		}
+	}
+
+	text, err := s.build(i)
+	if err != nil {
+		entry := s.index[i]
+		return nil, &formatlib.CorruptionError{Block: i, Offset: entry.OriginalOffset, Err: err}
+	}
+
+	s.cache[1] = s.cache[0]
+	s.cache[0] = cachedBlock{index: i, text: text}
+
+	return text, nil
+}
+
+// build reads block i and builds an fmindexlib.Index from its BWT and
+// samples, or decodes it if it has no samples.
+func (s *Searcher) build(i int) (blockText, error) {
+	s.builds++
+
+	entry := s.index[i]
+	block, err := formatlib.ReadBlockAt(s.r, s.Header, i, entry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(block.Search) == 0 {
+		original, err := DecodeBlock(s.Header, block.Data, &s.inv)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(original) != entry.OriginalSize {
+			return nil, fmt.Errorf("malformed block of %v bytes, expected %v", len(original), entry.OriginalSize)
+		}
+
+		if err := formatlib.VerifyBlock(s.Header, block, original, entry.OriginalOffset); err != nil {
+			return nil, err
+		}
+
+		return decodedText(bytes.Clone(original)), nil
+	}
+
+	// The BWT stage is first, so undoing the others leaves the primary index
+	// followed by the BWT.
+	bwt, err := undoStages(s.Header, block.Data, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bwt) != 4+entry.OriginalSize {
+		return nil, fmt.Errorf("malformed block of %v bytes, expected %v", len(bwt)-4, entry.OriginalSize)
+	}
+
+	primary := int(binary.LittleEndian.Uint32(bwt))
+
+	return fmindexlib.FromBWT(bwt[4:], primary, block.Search)
+}
+
+// decodedText is the original data of a block stored without samples.
+type decodedText []byte
+
+func (d decodedText) Locate(pattern []byte) []int {
+	return d.locate(pattern, false)
+}
+
+func (d decodedText) LocateFold(pattern []byte) []int {
+	return d.locate(pattern, true)
+}
+
+func (d decodedText) locate(pattern []byte, fold bool) []int {
+	positions := []int{}
+	for i := 0; i+len(pattern) <= len(d); i++ {
+		if hasPrefix(d[i:], pattern, fold) {
+			positions = append(positions, i)
+		}
+	}
+
+	return positions
+}
+
+func (d decodedText) Extract(start, end int) []byte {
+	return d[start:end]
+}
+
+// hasPrefix reports whether text starts with pattern. With fold, ASCII
+// letters match either case.
+func hasPrefix(text []byte, pattern []byte, fold bool) bool {
+	if !fold {
+		return bytes.HasPrefix(text, pattern)
+	}
+
+	if len(text) < len(pattern) {
+		return false
+	}
+
+	for i, c := range pattern {
+		if lower(text[i]) != lower(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lower returns the lower case of an ASCII letter, or c itself.
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c - 'A' + 'a'
+	}
+
+	return c
+}
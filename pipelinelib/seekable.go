@@ -0,0 +1,174 @@
+package pipelinelib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+// SeekableReader decompresses a container written with Options.Index from an
+// io.ReaderAt, decoding only the blocks covering each read. It implements
+// io.ReaderAt and io.ReadSeeker, and ReadAt may be called concurrently.
+type SeekableReader struct {
+	// Header is the container header read by NewSeekableReader.
+	Header formatlib.Header
+
+	r      io.ReaderAt
+	index  []formatlib.IndexEntry
+	size   int64
+	offset int64
+
+	mu      sync.Mutex
+	inv     bwtlib.Inverter
+	buffer  []byte
+	cached  int
+	decoded []byte
+	// decodes counts the blocks decoded, for tests.
+	decodes int
+}
+
+// NewSeekableReader reads the header and block index of the size byte
+// container in r. It returns formatlib.ErrNoIndex if the container has no
+// index.
+func NewSeekableReader(r io.ReaderAt, size int64) (*SeekableReader, error) {
+	header, err := formatlib.ReadHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Flags&formatlib.FlagIndex == 0 {
+		return nil, formatlib.ErrNoIndex
+	}
+
+	index, err := formatlib.ReadIndex(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	z := &SeekableReader{Header: header, r: r, index: index, cached: -1}
+	if len(index) > 0 {
+		last := index[len(index)-1]
+		z.size = last.OriginalOffset + int64(last.OriginalSize)
+	}
+
+	return z, nil
+}
+
+// Size returns the size of the original data.
+func (z *SeekableReader) Size() int64 {
+	return z.size
+}
+
+// ReadAt decompresses len(p) bytes starting at offset off of the original
+// data into p.
+func (z *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("pipelinelib.SeekableReader.ReadAt: negative offset")
+	}
+
+	if off >= z.size {
+		return 0, io.EOF
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	// Find the block holding off, which is the last block starting at or
+	// before it.
+	i := sort.Search(len(z.index), func(i int) bool {
+		return z.index[i].OriginalOffset > off
+	}) - 1
+
+	n := 0
+	for ; n < len(p) && i >= 0 && i < len(z.index); i++ {
+		block, err := z.block(i)
+		if err != nil {
+			return n, err
+		}
+
+		start := off + int64(n) - z.index[i].OriginalOffset
+		n += copy(p[n:], block[start:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// block returns the original data of block i, decoding it unless it was the
+// last block decoded.
+func (z *SeekableReader) block(i int) ([]byte, error) {
+	if z.cached == i {
+		return z.decoded, nil
+	}
+
+	entry := z.index[i]
+	block, err := formatlib.ReadBlockAt(z.r, z.Header, i, entry, z.buffer)
+	if err != nil {
+		return nil, err
+	}
+	z.buffer = block.Data
+
+	z.cached = -1
+	z.decodes++
+	original, err := DecodeBlock(z.Header, block.Data, &z.inv)
+	if err != nil {
+		return nil, &formatlib.CorruptionError{Block: i, Offset: entry.OriginalOffset, Err: err}
+	}
+
+	if len(original) != entry.OriginalSize {
+		err := fmt.Errorf("malformed block of %v bytes, expected %v", len(original), entry.OriginalSize)
+		return nil, &formatlib.CorruptionError{Block: i, Offset: entry.OriginalOffset, Err: err}
+	}
+
+	if err := formatlib.VerifyBlock(z.Header, block, original, entry.OriginalOffset); err != nil {
+		return nil, err
+	}
+
+	z.cached = i
+	z.decoded = original
+
+	return original, nil
+}
+
+// Read decompresses into p from the current offset.
+func (z *SeekableReader) Read(p []byte) (int, error) {
+	if z.offset >= z.size {
+		return 0, io.EOF
+	}
+
+	n, err := z.ReadAt(p, z.offset)
+	z.offset += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek sets the offset in the original data for the next Read.
+func (z *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		offset += z.size
+	default:
+		return 0, errors.New("pipelinelib.SeekableReader.Seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("pipelinelib.SeekableReader.Seek: negative position")
+	}
+	z.offset = offset
+
+	return offset, nil
+}
@@ -0,0 +1,465 @@
+package pipelinelib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/bwtlib"
+	"git.neds.sh/jack.massey/bwt/compresslib"
+	"git.neds.sh/jack.massey/bwt/distancelib"
+	"git.neds.sh/jack.massey/bwt/fmindexlib"
+	"git.neds.sh/jack.massey/bwt/formatlib"
+	"git.neds.sh/jack.massey/bwt/huffmanlib"
+	"git.neds.sh/jack.massey/bwt/mtflib"
+	"git.neds.sh/jack.massey/bwt/parallellib"
+	"git.neds.sh/jack.massey/bwt/rangelib"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultBlockSize is the default number of input bytes in each block.
+const DefaultBlockSize = 512 * 1024
+
+// searchSampleRate is the distance between the block positions sampled for
+// Options.Search.
+const searchSampleRate = 64
+
+// Default run length encoding parameters.
+const (
+	DefaultMinRun         = 4
+	DefaultRunLengthBytes = 1
+)
+
+// Entropy selects the entropy coder run after the other stages.
+type Entropy int
+
+const (
+	// EntropyNone stops after run length encoding.
+	EntropyNone Entropy = iota
+	// EntropyHuffman codes each block with huffmanlib.
+	EntropyHuffman
+	// EntropyRange codes each block with rangelib, which is slower than
+	// Huffman coding but compresses further.
+	EntropyRange
+)
+
+// Options configures a Writer. Zero fields other than Transform, RLE1,
+// MTFVariant, RLEMode, Entropy, Checksum, Index, Search and Concurrency are
+// replaced by their defaults.
+type Options struct {
+	// BlockSize is the maximum number of input bytes in each block.
+	BlockSize int
+	// Transform selects the BWT block transform.
+	Transform bwtlib.Transform
+	// RLE1 applies compresslib.EncodeRLE1 to each block before the BWT, as
+	// bzip2 does, which speeds up sorting blocks with long runs. It cannot be
+	// used with bwtlib.TransformSentinel.
+	RLE1 bool
+	// MTFVariant selects the move to front variant.
+	MTFVariant mtflib.Variant
+	// MinRun and RunLengthBytes are the compresslib parameters.
+	MinRun         int
+	RunLengthBytes int
+	// RLEMode selects how compresslib codes runs.
+	RLEMode compresslib.Mode
+	// Entropy selects the final entropy coding stage.
+	Entropy Entropy
+	// RangeModel selects the model used by EntropyRange.
+	RangeModel rangelib.Model
+	// Checksum stores a CRC32 of each block and of the whole stream so that
+	// the Reader can detect corruption.
+	Checksum bool
+	// Index appends an index of every block so that SeekableReader can read
+	// from any offset.
+	Index bool
+	// Search stores fmindexlib samples with each block so that Searcher can
+	// find patterns without decoding the blocks, at a cost of 4 bytes per
+	// searchSampleRate bytes of input. It implies Index, and is ignored
+	// unless Transform is bwtlib.TransformIndexed and RLE1 is not set.
+	Search bool
+	// Concurrency is the number of blocks encoded at once. Values below 1 use
+	// runtime.GOMAXPROCS. The output does not depend on the concurrency.
+	Concurrency int
+}
+
+// DefaultOptions returns the options used when NewWriter is given nil. They
+// use the indexed transform so that any input can be written, and choose the
+// run length coding of each block.
+func DefaultOptions() Options {
+	return Options{
+		BlockSize:      DefaultBlockSize,
+		Transform:      bwtlib.TransformIndexed,
+		MinRun:         DefaultMinRun,
+		RunLengthBytes: DefaultRunLengthBytes,
+		RLEMode:        compresslib.ModeAuto,
+		Entropy:        EntropyHuffman,
+		Checksum:       true,
+		Index:          true,
+	}
+}
+
+// withDefaults fills in zero options with their defaults.
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.BlockSize == 0 {
+		o.BlockSize = defaults.BlockSize
+	}
+
+	if o.MinRun == 0 {
+		o.MinRun = defaults.MinRun
+	}
+
+	if o.RunLengthBytes == 0 {
+		o.RunLengthBytes = defaults.RunLengthBytes
+	}
+
+	return o
+}
+
+// validate rejects options that would write a container the Reader cannot
+// decode. MinRun and RunLengthBytes are checked even when RLEMode ignores
+// them.
+func (o Options) validate() error {
+	switch o.Transform {
+	case bwtlib.TransformSentinel, bwtlib.TransformIndexed, bwtlib.TransformBijective:
+	default:
+		return fmt.Errorf("unknown transform %v", o.Transform)
+	}
+
+	if !slices.Contains(mtflib.Variants, o.MTFVariant) {
+		return fmt.Errorf("%w: %v", mtflib.ErrUnknownVariant, byte(o.MTFVariant))
+	}
+
+	if !slices.Contains(compresslib.Modes, o.RLEMode) {
+		return fmt.Errorf("%w: %v", compresslib.ErrUnknownMode, byte(o.RLEMode))
+	}
+
+	switch o.Entropy {
+	case EntropyNone, EntropyHuffman, EntropyRange:
+	default:
+		return fmt.Errorf("unknown entropy coder %v", o.Entropy)
+	}
+
+	// EncodeRLE1 output may contain the sentinel byte.
+	if o.RLE1 && o.Transform == bwtlib.TransformSentinel {
+		return errors.New("RLE1 needs a transform that allows any byte")
+	}
+
+	p := compresslib.Params{Mode: compresslib.ModeFixed, MinRun: o.MinRun, RunLengthBytes: o.RunLengthBytes}
+
+	return p.Validate()
+}
+
+// header returns the container header describing blocks written with the
+// options.
+func (o Options) header() formatlib.Header {
+	header := formatlib.Header{
+		Stages:         []formatlib.Stage{formatlib.StageBWT, formatlib.StageMTF, formatlib.StageRLE},
+		BlockSize:      o.BlockSize,
+		Transform:      byte(o.Transform),
+		MTFVariant:     byte(o.MTFVariant),
+		MinRun:         o.MinRun,
+		RunLengthBytes: o.RunLengthBytes,
+		RLEMode:        byte(o.RLEMode),
+	}
+
+	if o.Checksum {
+		header.Flags |= formatlib.FlagChecksum
+	}
+
+	if o.RLE1 {
+		header.Stages = append([]formatlib.Stage{formatlib.StageRLE1}, header.Stages...)
+	}
+
+	if o.Index {
+		header.Flags |= formatlib.FlagIndex
+	}
+
+	if o.Search && o.Transform == bwtlib.TransformIndexed && !o.RLE1 {
+		header.Flags |= formatlib.FlagIndex | formatlib.FlagSearch
+	}
+
+	switch o.Entropy {
+	case EntropyHuffman:
+		header.Stages = append(header.Stages, formatlib.StageHuffman)
+	case EntropyRange:
+		header.Stages = append(header.Stages, formatlib.StageRange)
+	default:
+		// EntropyNone, and values rejected by validate, add no stage.
+	}
+
+	return header
+}
+
+// Writer compresses data written to it into a formatlib container, running
+// every block through BWT, MTF, RLE and the selected entropy coder. Full
+// blocks are handed to a background goroutine that encodes them concurrently
+// and writes them in order.
+type Writer struct {
+	w          *countingWriter
+	blocks     *formatlib.BlockWriter
+	rangeModel rangelib.Model
+	header     formatlib.Header
+	workers    int
+	block      []byte
+	index      []formatlib.IndexEntry
+	original   int64
+	closed     bool
+	err        error
+
+	// pending passes full blocks to the encoder, buffers returns them for
+	// reuse, and done is closed once the encoder has stopped with encodeErr.
+	pending   chan []byte
+	buffers   chan []byte
+	done      chan struct{}
+	encodeErr error
+}
+
+// countingWriter counts the bytes written to w, which gives the offsets in
+// the block index.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// NewWriter returns a Writer that compresses to w. It uses DefaultOptions if
+// opts is nil. Invalid options are returned by the first call to Write or
+// Close, before anything is written. Callers must Close the Writer to flush
+// the final block and end of stream marker, and to stop the encoder.
+func NewWriter(w io.Writer, opts *Options) *Writer {
+	o := DefaultOptions()
+	if opts != nil {
+		o = opts.withDefaults()
+	}
+
+	header := o.header()
+	workers := parallellib.Workers(o.Concurrency)
+
+	return &Writer{
+		w:          &countingWriter{w: w},
+		rangeModel: o.RangeModel,
+		header:     header,
+		workers:    workers,
+		block:      make([]byte, 0, header.BlockSize),
+		buffers:    make(chan []byte, workers),
+		err:        o.validate(),
+	}
+}
+
+// Write compresses p, writing out each block as it fills.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	if z.closed {
+		return 0, errors.New("write to closed pipelinelib.Writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(z.block[len(z.block):z.header.BlockSize], p)
+		z.block = z.block[:len(z.block)+n]
+		p = p[n:]
+		written += n
+
+		if len(z.block) == z.header.BlockSize {
+			if z.err = z.flushBlock(); z.err != nil {
+				return written, z.err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes any buffered data, the end of stream marker and the index. It
+// does not close the underlying writer.
+func (z *Writer) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+
+	if z.err = z.flushBlock(); z.err != nil {
+		return z.err
+	}
+
+	if z.pending != nil {
+		close(z.pending)
+		<-z.done
+		if z.err = z.encodeErr; z.err != nil {
+			return z.err
+		}
+	}
+
+	if z.err = z.writeHeader(); z.err != nil {
+		return z.err
+	}
+
+	if z.err = z.blocks.Close(); z.err != nil {
+		return z.err
+	}
+
+	if z.header.Flags&formatlib.FlagIndex != 0 {
+		z.err = formatlib.WriteIndex(z.w, z.w.n, z.index)
+	}
+
+	return z.err
+}
+
+func (z *Writer) writeHeader() error {
+	if z.blocks != nil {
+		return nil
+	}
+
+	var err error
+	z.blocks, err = formatlib.NewBlockWriter(z.w, z.header)
+
+	return err
+}
+
+// flushBlock hands the buffered block, if any, to the encoder.
+func (z *Writer) flushBlock() error {
+	if len(z.block) == 0 {
+		return nil
+	}
+
+	if z.pending == nil {
+		z.pending = make(chan []byte)
+		z.done = make(chan struct{})
+		go z.encode()
+	}
+
+	select {
+	case z.pending <- z.block:
+	case <-z.done:
+		return z.encodeErr
+	}
+
+	select {
+	case z.block = <-z.buffers:
+	default:
+		z.block = make([]byte, 0, z.header.BlockSize)
+	}
+	z.block = z.block[:0]
+
+	return nil
+}
+
+// encodedBlock is a block encoded by the encoder along with what the index
+// needs to know about the original.
+type encodedBlock struct {
+	data         []byte
+	checksum     uint32
+	search       []byte
+	originalSize int
+}
+
+// encode runs the encoder until pending is closed or a block fails, encoding
+// blocks concurrently and writing them in order.
+func (z *Writer) encode() {
+	defer close(z.done)
+
+	next := func() ([]byte, error) {
+		block, ok := <-z.pending
+		if !ok {
+			return nil, io.EOF
+		}
+
+		return block, nil
+	}
+
+	work := func(block []byte) (encodedBlock, error) {
+		encoded := encodedBlock{originalSize: len(block)}
+		if z.header.Flags&formatlib.FlagChecksum != 0 {
+			encoded.checksum = formatlib.Checksum(block)
+		}
+
+		var err error
+		encoded.data, encoded.search, err = encodeBlock(z.header, block, z.rangeModel)
+
+		select {
+		case z.buffers <- block:
+		default:
+		}
+
+		return encoded, err
+	}
+
+	z.encodeErr = parallellib.Ordered(z.workers, next, work, z.writeBlock)
+}
+
+// writeBlock writes an encoded block and records it in the index.
+func (z *Writer) writeBlock(encoded encodedBlock) error {
+	if err := z.writeHeader(); err != nil {
+		return err
+	}
+
+	entry := formatlib.IndexEntry{Offset: z.w.n, OriginalOffset: z.original, OriginalSize: encoded.originalSize}
+	if err := z.blocks.WriteSearchableBlock(encoded.data, encoded.checksum, encoded.search); err != nil {
+		return err
+	}
+
+	entry.Size = int(z.w.n - entry.Offset)
+	z.index = append(z.index, entry)
+	z.original += int64(encoded.originalSize)
+
+	return nil
+}
+
+// EncodeBlock runs block through each stage listed in header. rangeModel is
+// only used by formatlib.StageRange.
+func EncodeBlock(header formatlib.Header, block []byte, rangeModel rangelib.Model) ([]byte, error) {
+	block, _, err := encodeBlock(header, block, rangeModel)
+
+	return block, err
+}
+
+// encodeBlock is EncodeBlock, also returning the block's search data if header
+// has formatlib.FlagSearch. The samples are taken from the indexed BWT, and
+// are nil for periodic blocks.
+func encodeBlock(header formatlib.Header, block []byte, rangeModel rangelib.Model) ([]byte, []byte, error) {
+	var search []byte
+	for _, stage := range header.Stages {
+		var err error
+		switch stage {
+		case formatlib.StageRLE1:
+			block = compresslib.EncodeRLE1(block)
+		case formatlib.StageBWT:
+			block, err = bwtlib.EncodeBlock(block, bwtlib.Transform(header.Transform))
+			if err == nil && searchable(header) {
+				primary := int(binary.LittleEndian.Uint32(block))
+				search = fmindexlib.Samples(block[4:], primary, searchSampleRate)
+			}
+		case formatlib.StageMTF:
+			block, err = mtflib.EncodeBlockWithVariant(nil, block, mtflib.Variant(header.MTFVariant))
+		case formatlib.StageDistance:
+			block = distancelib.DistanceCode(block)
+		case formatlib.StageInversion:
+			block = distancelib.InversionFrequencies(block)
+		case formatlib.StageRLE:
+			block, err = compresslib.EncodeBlockWithMode(nil, block, compresslib.Mode(header.RLEMode), header.MinRun, header.RunLengthBytes)
+		case formatlib.StageHuffman:
+			block = huffmanlib.Encode(block)
+		case formatlib.StageRange:
+			block, err = rangelib.Encode(block, rangeModel)
+		default:
+			err = fmt.Errorf("unknown stage %v", stage)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return block, search, nil
+}
@@ -0,0 +1,124 @@
+package rangelib
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// topValue is the range below which the coders shift out a byte.
+	topValue = 1 << 24
+	// maxTotal bounds a model's total frequency so that range / total keeps
+	// enough precision.
+	maxTotal = 1 << 16
+)
+
+// encoder is a range encoder that propagates carries into bytes already
+// produced, as in LZMA.
+type encoder struct {
+	output    []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+func newEncoder(output []byte) *encoder {
+	return &encoder{output: output, rng: 0xffffffff, cacheSize: 1}
+}
+
+// encode narrows the range to the symbol occupying [start, start+size) of
+// total.
+func (e *encoder) encode(start, size, total uint32) {
+	r := e.rng / total
+	e.low += uint64(r) * uint64(start)
+	e.rng = r * size
+	for e.rng < topValue {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *encoder) shiftLow() {
+	if uint32(e.low) < 0xff000000 || e.low >= 1<<32 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.output = append(e.output, temp+carry)
+			temp = 0xff
+		}
+		e.cache = byte(e.low >> 24)
+	}
+
+	e.cacheSize++
+	e.low = (e.low & 0x00ffffff) << 8
+}
+
+// finish flushes the remaining state and returns the output.
+func (e *encoder) finish() []byte {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+
+	return e.output
+}
+
+// decoder reverses encoder.
+type decoder struct {
+	input []byte
+	code  uint32
+	rng   uint32
+	r     uint32
+}
+
+func newDecoder(input []byte) (*decoder, error) {
+	d := &decoder{input: input, rng: 0xffffffff}
+	for i := 0; i < 5; i++ {
+		if err := d.shift(); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func (d *decoder) shift() error {
+	if len(d.input) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	d.code = d.code<<8 | uint32(d.input[0])
+	d.input = d.input[1:]
+
+	return nil
+}
+
+// target returns where the code falls in [0, total). It must be followed by
+// a call to consume with the symbol found there.
+func (d *decoder) target(total uint32) uint32 {
+	d.r = d.rng / total
+	value := d.code / d.r
+	if value >= total {
+		return total - 1
+	}
+
+	return value
+}
+
+// consume removes the symbol occupying [start, start+size) from the code.
+func (d *decoder) consume(start, size uint32) error {
+	d.code -= d.r * start
+	d.rng = d.r * size
+	for d.rng < topValue {
+		d.rng <<= 8
+		if err := d.shift(); err != nil {
+			return err
+		}
+	}
+
+	if d.code >= d.rng {
+		return errors.New("malformed range coded block")
+	}
+
+	return nil
+}
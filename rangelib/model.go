@@ -0,0 +1,166 @@
+package rangelib
+
+import "math/bits"
+
+const (
+	// increment is added to a symbol's frequency each time it is coded.
+	increment = 24
+)
+
+// frequencyModel is an adaptive order-0 model over a small alphabet. The
+// cumulative frequencies are kept in a Fenwick tree so that both coding and
+// searching by cumulative frequency take O(log n).
+type frequencyModel struct {
+	freqs []uint32
+	tree  []uint32
+	total uint32
+	step  int
+}
+
+func newFrequencyModel(symbols int) *frequencyModel {
+	m := &frequencyModel{
+		freqs: make([]uint32, symbols),
+		tree:  make([]uint32, symbols+1),
+		step:  1 << (bits.Len(uint(symbols)) - 1),
+	}
+
+	for symbol := range m.freqs {
+		m.freqs[symbol] = 1
+	}
+	m.rebuild()
+
+	return m
+}
+
+func (m *frequencyModel) rebuild() {
+	m.total = 0
+	for i := range m.tree {
+		m.tree[i] = 0
+	}
+
+	for symbol, freq := range m.freqs {
+		m.total += freq
+		for i := symbol + 1; i < len(m.tree); i += i & -i {
+			m.tree[i] += freq
+		}
+	}
+}
+
+// start returns the cumulative frequency of the symbols before symbol.
+func (m *frequencyModel) start(symbol int) uint32 {
+	sum := uint32(0)
+	for i := symbol; i > 0; i -= i & -i {
+		sum += m.tree[i]
+	}
+
+	return sum
+}
+
+// find returns the symbol whose range holds target, along with its start.
+func (m *frequencyModel) find(target uint32) (int, uint32) {
+	symbol := 0
+	start := uint32(0)
+	for step := m.step; step > 0; step >>= 1 {
+		next := symbol + step
+		if next < len(m.tree) && start+m.tree[next] <= target {
+			symbol = next
+			start += m.tree[next]
+		}
+	}
+
+	return symbol, start
+}
+
+// update records an occurrence of symbol, halving every frequency once the
+// total grows too large.
+func (m *frequencyModel) update(symbol int) {
+	m.freqs[symbol] += increment
+	m.total += increment
+	for i := symbol + 1; i < len(m.tree); i += i & -i {
+		m.tree[i] += increment
+	}
+
+	if m.total > maxTotal {
+		for i, freq := range m.freqs {
+			m.freqs[i] = (freq + 1) / 2
+		}
+		m.rebuild()
+	}
+}
+
+func (m *frequencyModel) encode(e *encoder, symbol int) {
+	e.encode(m.start(symbol), m.freqs[symbol], m.total)
+	m.update(symbol)
+}
+
+func (m *frequencyModel) decode(d *decoder) (int, error) {
+	symbol, start := m.find(d.target(m.total))
+	if err := d.consume(start, m.freqs[symbol]); err != nil {
+		return 0, err
+	}
+	m.update(symbol)
+
+	return symbol, nil
+}
+
+// byteModel codes bytes with a range coder model.
+type byteModel interface {
+	encode(e *encoder, c byte)
+	decode(d *decoder) (byte, error)
+}
+
+// order0Model codes every byte with one adaptive frequency model.
+type order0Model struct {
+	model *frequencyModel
+}
+
+func newOrder0Model() *order0Model {
+	return &order0Model{model: newFrequencyModel(256)}
+}
+
+func (m *order0Model) encode(e *encoder, c byte) {
+	m.model.encode(e, int(c))
+}
+
+func (m *order0Model) decode(d *decoder) (byte, error) {
+	symbol, err := m.model.decode(d)
+
+	return byte(symbol), err
+}
+
+// structuredModel codes a byte as the bucket [2^(k-1), 2^k) that holds it and
+// then its offset within the bucket, with 0 and 1 getting buckets of their
+// own. MTF output is dominated by small ranks, so the bucket model adapts
+// quickly while the rarer large ranks share the statistics of their bucket.
+type structuredModel struct {
+	buckets *frequencyModel
+	offsets [9]*frequencyModel
+}
+
+func newStructuredModel() *structuredModel {
+	m := &structuredModel{buckets: newFrequencyModel(9)}
+	for bucket := 2; bucket < len(m.offsets); bucket++ {
+		m.offsets[bucket] = newFrequencyModel(1 << (bucket - 1))
+	}
+
+	return m
+}
+
+func (m *structuredModel) encode(e *encoder, c byte) {
+	bucket := bits.Len8(c)
+	m.buckets.encode(e, bucket)
+	if bucket >= 2 {
+		m.offsets[bucket].encode(e, int(c)-1<<(bucket-1))
+	}
+}
+
+func (m *structuredModel) decode(d *decoder) (byte, error) {
+	bucket, err := m.buckets.decode(d)
+	if err != nil || bucket < 2 {
+		return byte(bucket), err
+	}
+
+	offset, err := m.offsets[bucket].decode(d)
+
+	return byte(1<<(bucket-1) + offset), err
+}
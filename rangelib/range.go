@@ -0,0 +1,149 @@
+package rangelib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.neds.sh/jack.massey/bwt/formatlib"
+)
+
+// Model selects how the range coder predicts each byte.
+type Model byte
+
+const (
+	// ModelStructured splits each byte into a bucket and an offset, which
+	// suits the small ranks produced by MTF.
+	ModelStructured Model = iota
+	// ModelOrder0 uses a single adaptive frequency for every byte value.
+	ModelOrder0
+)
+
+func newByteModel(model Model) (byteModel, error) {
+	switch model {
+	case ModelStructured:
+		return newStructuredModel(), nil
+	case ModelOrder0:
+		return newOrder0Model(), nil
+	default:
+		return nil, fmt.Errorf("unknown range coder model %v", model)
+	}
+}
+
+// Encode range codes block with an adaptive model. The encoded block starts
+// with the model and the 4 byte little-endian length of block, so Decode
+// needs no other parameters.
+func Encode(block []byte, model Model) ([]byte, error) {
+	m, err := newByteModel(model)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]byte, 0, len(block)/2+16)
+	output = append(output, byte(model))
+	output = binary.LittleEndian.AppendUint32(output, uint32(len(block)))
+	if len(block) == 0 {
+		return output, nil
+	}
+
+	e := newEncoder(output)
+	for _, c := range block {
+		m.encode(e, c)
+	}
+
+	return e.finish(), nil
+}
+
+// Decode reverses Encode.
+func Decode(block []byte) ([]byte, error) {
+	if len(block) < 5 {
+		return nil, errors.New("malformed range coded block: missing header")
+	}
+
+	m, err := newByteModel(Model(block[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(block[1:])
+	if n == 0 {
+		return []byte{}, nil
+	}
+
+	// Even the most probable symbol costs more than 1/maxTotal of a bit.
+	if uint64(n) > uint64(len(block))*8*maxTotal {
+		return nil, fmt.Errorf("malformed range coded block: %v bytes in %v", n, len(block))
+	}
+
+	d, err := newDecoder(block[5:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed range coded block: %w", err)
+	}
+
+	output := make([]byte, 0, min(int(n), len(block)*16))
+	for i := uint32(0); i < n; i++ {
+		c, err := m.decode(d)
+		if err != nil {
+			return nil, fmt.Errorf("malformed range coded block: %w", err)
+		}
+
+		output = append(output, c)
+	}
+
+	return output, nil
+}
+
+// EncodeStream range codes input in blocks of blockSize bytes, writing each
+// block with formatlib.WriteBlock followed by the end of stream marker.
+func EncodeStream(input io.Reader, output io.Writer, blockSize int, model Model) error {
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(input, block)
+		if n > 0 {
+			encoded, err := Encode(block[:n], model)
+			if err != nil {
+				return err
+			}
+
+			if err := formatlib.WriteBlock(output, encoded); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			return err
+		}
+	}
+
+	return formatlib.WriteEnd(output)
+}
+
+// DecodeStream reverses EncodeStream.
+func DecodeStream(input io.Reader, output io.Writer) error {
+	var buffer []byte
+	for {
+		block, err := formatlib.ReadBlock(input, buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+		buffer = block
+
+		decoded, err := Decode(block)
+		if err != nil {
+			return err
+		}
+
+		if _, err := output.Write(decoded); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package rangelib
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"git.neds.sh/jack.massey/bwt/huffmanlib"
+	"github.com/stretchr/testify/assert"
+)
+
+var models = []Model{ModelStructured, ModelOrder0}
+
+func runRoundTripTest(t *testing.T, input []byte, model Model) []byte {
+	encoded, err := Encode(input, model)
+	assert.NoError(t, err)
+
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded, "model %v", model)
+
+	return encoded
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	for _, model := range models {
+		encoded := runRoundTripTest(t, []byte{}, model)
+		assert.Equal(t, []byte{byte(model), 0, 0, 0, 0}, encoded)
+	}
+}
+
+func TestRoundTripBasic(t *testing.T) {
+	for _, model := range models {
+		runRoundTripTest(t, []byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES"), model)
+		runRoundTripTest(t, []byte{0xff}, model)
+		runRoundTripTest(t, []byte(strings.Repeat("\x00", 100000)), model)
+	}
+}
+
+func TestRoundTripRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, model := range models {
+		for _, size := range []int{1, 10, 1000, 100000} {
+			input := make([]byte, size)
+			rng.Read(input)
+			runRoundTripTest(t, input, model)
+		}
+	}
+}
+
+func TestStructuredModelBeatsHuffmanOnRanks(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	input := make([]byte, 200000)
+	for i := range input {
+		input[i] = byte(min(rng.ExpFloat64()*2, 255))
+	}
+
+	encoded := runRoundTripTest(t, input, ModelStructured)
+	assert.Less(t, len(encoded), len(huffmanlib.Encode(input)))
+}
+
+func TestRoundTripIliad(t *testing.T) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	assert.NoError(t, err)
+
+	encoded := runRoundTripTest(t, input, ModelOrder0)
+	assert.Less(t, len(encoded), len(input)*3/4)
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	encoded, err := Encode([]byte("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES"), ModelOrder0)
+	assert.NoError(t, err)
+
+	_, err = Decode(encoded[:len(encoded)-3])
+	assert.Error(t, err)
+}
+
+func TestDecodeUnknownModel(t *testing.T) {
+	_, err := Decode([]byte{0x7f, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+	assert.Error(t, err)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	input := []byte(strings.Repeat("SIX.MIXED.PIXIES.SIFT.SIXTY.PIXIE.DUST.BOXES", 50))
+
+	var encoded bytes.Buffer
+	err := EncodeStream(bytes.NewReader(input), &encoded, 256, ModelOrder0)
+	assert.NoError(t, err)
+
+	var decoded bytes.Buffer
+	err = DecodeStream(&encoded, &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, input, decoded.Bytes())
+}
+
+func BenchmarkEncodeIliad(b *testing.B) {
+	input, err := os.ReadFile("../testfiles/iliad.mb.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Encode(input, ModelOrder0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}